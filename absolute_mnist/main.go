@@ -7,9 +7,11 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"time"
 
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/mnist"
+	"github.com/unixpickle/seqtree"
 )
 
 const Batch = 10000
@@ -20,7 +22,13 @@ func main() {
 
 	seqModel := NewSequenceModel()
 	seqModel.Load("model.json")
+
+	metrics, err := seqtree.OpenMetricsFile("metrics.jsonl")
+	essentials.Must(err)
+	defer metrics.Close()
+
 	for i := 0; true; i++ {
+		start := time.Now()
 		testSeqs := booleanSamples(testData, Batch)
 		testLoss := seqModel.MeanLoss(testSeqs)
 
@@ -29,6 +37,13 @@ func main() {
 
 		log.Printf("tree %d: loss=%f delta=%f test=%f", seqModel.NumTrees()-1, loss, -delta,
 			testLoss)
+		essentials.Must(metrics.WriteMetrics(&seqtree.IterationMetrics{
+			Iteration: seqModel.NumTrees() - 1,
+			TrainLoss: loss,
+			LossDelta: delta,
+			ValidLoss: &testLoss,
+			Seconds:   time.Since(start).Seconds(),
+		}))
 		seqModel.Save("model.json")
 		GenerateSamples(seqModel)
 	}
@@ -9,8 +9,17 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "summary" {
+		SummarizeRuns(os.Args[2:])
+		return
+	} else if len(os.Args) > 2 && os.Args[1] == "compare" {
+		CompareRuns(os.Args[2:])
+		return
+	}
 	if len(os.Args) != 2 {
-		essentials.Die("Usage: analysis <model.json>")
+		essentials.Die("Usage: analysis <model.json>\n" +
+			"       analysis summary <metrics.jsonl|metrics.csv> ...\n" +
+			"       analysis compare <metrics.jsonl|metrics.csv> ...")
 	}
 	path := os.Args[1]
 
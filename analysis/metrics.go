@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/seqtree"
+)
+
+// SummarizeRuns prints a table with one row per metrics
+// file.
+func SummarizeRuns(paths []string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "run\titers\tfinal_train\tbest_valid\tbest_iter\tmean_delta\tmean_step\t"+
+		"mean_leaves\tseconds")
+	for _, path := range paths {
+		metrics, err := seqtree.ReadMetrics(path)
+		essentials.Must(err)
+		if len(metrics) == 0 {
+			fmt.Fprintf(w, "%s\t0\t\t\t\t\t\t\t\n", runName(path))
+			continue
+		}
+		var totalDelta, totalStep, totalLeaves, totalSeconds float64
+		var best *seqtree.IterationMetrics
+		for i, m := range metrics {
+			totalDelta += float64(m.LossDelta)
+			totalStep += float64(m.StepSize)
+			totalLeaves += float64(m.NumLeaves)
+			totalSeconds += m.Seconds
+			if m.ValidLoss != nil && (best == nil || *m.ValidLoss < *best.ValidLoss) {
+				best = &metrics[i]
+			}
+		}
+
+		// Runs without validation leave the best loss empty.
+		bestValid, bestIterStr := "", ""
+		if best != nil {
+			bestValid = fmt.Sprintf("%f", *best.ValidLoss)
+			bestIterStr = strconv.Itoa(best.Iteration)
+		}
+
+		n := float64(len(metrics))
+		fmt.Fprintf(w, "%s\t%d\t%f\t%s\t%s\t%f\t%f\t%.1f\t%.1f\n", runName(path), len(metrics),
+			metrics[len(metrics)-1].TrainLoss, bestValid, bestIterStr, totalDelta/n, totalStep/n,
+			totalLeaves/n, totalSeconds)
+	}
+	w.Flush()
+}
+
+// CompareRuns prints a CSV file with the training and
+// validation loss of every run at every iteration, for
+// plotting.
+func CompareRuns(paths []string) {
+	runs := make([]map[int]seqtree.IterationMetrics, len(paths))
+	header := []string{"iteration"}
+	maxIter := -1
+	for i, path := range paths {
+		metrics, err := seqtree.ReadMetrics(path)
+		essentials.Must(err)
+		runs[i] = map[int]seqtree.IterationMetrics{}
+		for _, m := range metrics {
+			runs[i][m.Iteration] = m
+			maxIter = essentials.MaxInt(maxIter, m.Iteration)
+		}
+		name := runName(path)
+		header = append(header, name+"_train", name+"_valid")
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write(header)
+	for iter := 0; iter <= maxIter; iter++ {
+		row := []string{strconv.Itoa(iter)}
+		for _, run := range runs {
+			if m, ok := run[iter]; ok {
+				validLoss := ""
+				if m.ValidLoss != nil {
+					validLoss = formatLoss(*m.ValidLoss)
+				}
+				row = append(row, formatLoss(m.TrainLoss), validLoss)
+			} else {
+				row = append(row, "", "")
+			}
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	essentials.Must(w.Error())
+}
+
+func runName(path string) string {
+	return filepath.Base(filepath.Dir(path)) + "/" + filepath.Base(path)
+}
+
+func formatLoss(x float32) string {
+	return strconv.FormatFloat(float64(x), 'g', -1, 32)
+}
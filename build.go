@@ -52,9 +52,75 @@ type Builder struct {
 	// that single features should be used.
 	MaxUnion int
 
+	// UnionBeamWidth, if greater than 1, enables a beam
+	// search over unions. At every step, this many of the
+	// best partial unions are kept and extended, so that
+	// the first feature of a union does not have to be
+	// the best single feature.
+	//
+	// This is ignored when building branch formulas.
+	UnionBeamWidth int
+
+	// MaxUnionEvals, if non-zero, limits the number of
+	// unions which the beam search evaluates exactly for
+	// each branch.
+	MaxUnionEvals int
+
+	// RandomSplits, if non-zero, is the number of random
+	// unions to draw at every node. The best of these is
+	// used instead of searching for the best split, which
+	// is much faster for large feature spaces.
+	//
+	// Each union has between 1 and MaxUnion features.
+	// When this is set, branch formulas and beam search
+	// are not used.
+	RandomSplits int
+
+	// MaxConjunction is the maximum number of literals to
+	// AND together in each term of a branch formula.
+	//
+	// If this is greater than 1, or if Negation is set,
+	// branches use a BranchFormula with up to MaxUnion
+	// terms instead of a BranchFeatureUnion.
+	MaxConjunction int
+
+	// Negation, if true, allows negated literals in branch
+	// formulas.
+	Negation bool
+
 	// Horizons specifies the steps in the past to look at
 	// features for splits.
 	Horizons []int
+
+	// Offsets specifies relative grid positions to look at
+	// features for splits, in addition to Horizons.
+	// These may only be used with grid sequences.
+	Offsets []Offset2D
+
+	// GridWidth is the width of the row-major grids that
+	// Offsets refer to. It must be set if Offsets is used.
+	GridWidth int
+
+	// FeatureMask, if non-nil, specifies which features
+	// may be used for splits. Feature -1, which indicates
+	// a position outside of the sequence, is always
+	// allowed.
+	FeatureMask []bool
+
+	// HorizonSelector, if non-nil, is used to choose a
+	// subset of horizons for every tree, in which case
+	// the Horizons field is ignored.
+	HorizonSelector *HorizonSelector
+
+	// Rand, if non-nil, is used for random choices such as
+	// subsampling and random splits.
+	// If nil, the global RNG is used.
+	Rand *rand.Rand
+
+	// MaxProcs, if non-zero, limits the number of
+	// goroutines used to build a tree.
+	// If 0, GOMAXPROCS is used.
+	MaxProcs int
 }
 
 // Build builds a tree greedily using all of the provided
@@ -68,6 +134,14 @@ func (b *Builder) Build(samples []*TimestepSample) *Tree {
 		panic("no heuristic was specified")
 	}
 	data := newVecSamples(b.Heuristic, samples)
+	if b.HorizonSelector != nil {
+		b1 := *b
+		b1.Horizons = b.HorizonSelector.selectHorizons(b, data)
+		b1.HorizonSelector = nil
+		tree := b1.build(data, b.Depth)
+		b.HorizonSelector.RecordUsage(tree)
+		return tree
+	}
 	return b.build(data, b.Depth)
 }
 
@@ -81,6 +155,15 @@ func (b *Builder) build(samples []vecSample, depth int) *Tree {
 			},
 		}
 	}
+	if b.RandomSplits > 0 {
+		return b.buildRandom(samples, depth)
+	}
+	if b.MaxConjunction > 1 || b.Negation {
+		return b.buildFormula(nil, samples, nil, depth)
+	}
+	if b.UnionBeamWidth > 1 {
+		return b.buildUnionBeam(samples, depth)
+	}
 	return b.buildUnion(nil, samples, nil, depth)
 }
 
@@ -98,11 +181,11 @@ func (b *Builder) build(samples []vecSample, depth int) *Tree {
 func (b *Builder) buildUnion(union BranchFeatureUnion, falses, trues []vecSample,
 	depth int) *Tree {
 	if len(union) > 0 && len(union) >= b.MaxUnion {
-		return b.buildSubtree(union, falses, trues, depth)
+		return b.buildSubtree(union, nil, falses, trues, depth)
 	}
 
-	splitSamples, sampleFrac := subsampleLimit(falses, b.MaxSplitSamples)
-	features := b.sortFeatures(splitSamples, trues, sampleFrac)
+	splitSamples, sampleFrac := subsampleLimit(b.Rand, falses, b.MaxSplitSamples)
+	features, _ := b.sortFeatures(splitSamples, trues, sampleFrac)
 
 	var bestFeature *BranchFeature
 	if len(splitSamples) == len(falses) {
@@ -115,7 +198,7 @@ func (b *Builder) buildUnion(union BranchFeatureUnion, falses, trues []vecSample
 	}
 
 	if bestFeature == nil {
-		return b.buildSubtree(union, falses, trues, depth)
+		return b.buildSubtree(union, nil, falses, trues, depth)
 	}
 
 	var newFalses []vecSample
@@ -130,11 +213,136 @@ func (b *Builder) buildUnion(union BranchFeatureUnion, falses, trues []vecSample
 	return b.buildUnion(append(union, *bestFeature), newFalses, trues, depth)
 }
 
-// buildSubtree creates the branches (or leaf) node for
-// the given union and its resulting split.
-func (b *Builder) buildSubtree(union BranchFeatureUnion, falses, trues []vecSample,
+// buildFormula is like buildUnion(), but it grows a
+// formula of conjunctions instead of a union of features.
+//
+// This function may modify the trues slice, but not the
+// falses slice.
+func (b *Builder) buildFormula(formula BranchFormula, falses, trues []vecSample,
 	depth int) *Tree {
-	if len(union) == 0 {
+	if len(formula) > 0 && len(formula) >= b.MaxUnion {
+		return b.buildSubtree(nil, formula, falses, trues, depth)
+	}
+
+	term := b.buildTerm(falses, trues)
+	if term == nil {
+		return b.buildSubtree(nil, formula, falses, trues, depth)
+	}
+
+	var newFalses []vecSample
+	for _, sample := range falses {
+		if sample.BranchTerm(term) {
+			trues = append(trues, sample)
+		} else {
+			newFalses = append(newFalses, sample)
+		}
+	}
+
+	return b.buildFormula(append(formula, term), newFalses, trues, depth)
+}
+
+// buildTerm greedily grows a conjunction of literals that
+// moves samples from falses into trues.
+//
+// If no useful term is found, nil is returned.
+func (b *Builder) buildTerm(falses, trues []vecSample) BranchTerm {
+	first, quality := b.bestLiteral(falses, nil, trues)
+	if first == nil {
+		return nil
+	}
+	term, termQuality := b.growTerm(falses, trues, *first, quality)
+
+	if b.Negation && b.MaxConjunction > 1 {
+		// A literal and its negation often give similar
+		// splits, but only one of them may be worth
+		// narrowing down with more literals.
+		negated := *first
+		negated.Negate = !negated.Negate
+		sums := newLossSums(falses, nil, trues)
+		quality := b.literalSplitQuality(falses, trues, sums, negated, 1.0)
+		if quality > 0 {
+			negTerm, negQuality := b.growTerm(falses, trues, negated, quality)
+			if negQuality > termQuality {
+				term = negTerm
+			}
+		}
+	}
+
+	return term
+}
+
+// growTerm greedily adds literals to a term that starts
+// with the given literal, whose quality is also given.
+//
+// Every literal after the first narrows down the samples
+// which are moved, and literals are only added while they
+// improve the split.
+//
+// The resulting term and its quality are returned.
+func (b *Builder) growTerm(falses, trues []vecSample, first BranchLiteral,
+	quality float32) (BranchTerm, float32) {
+	term := BranchTerm{first}
+
+	// The pool contains the samples matched by the term,
+	// and the rest are not matched.
+	var pool, rest []vecSample
+	for _, sample := range falses {
+		if sample.BranchLiteral(first) {
+			pool = append(pool, sample)
+		} else {
+			rest = append(rest, sample)
+		}
+	}
+
+	for len(term) < b.MaxConjunction {
+		literal, newQuality := b.bestLiteral(pool, rest, trues)
+		if literal == nil || newQuality <= quality {
+			break
+		}
+		term = append(term, *literal)
+		quality = newQuality
+
+		var newPool []vecSample
+		for _, sample := range pool {
+			if sample.BranchLiteral(*literal) {
+				newPool = append(newPool, sample)
+			} else {
+				rest = append(rest, sample)
+			}
+		}
+		pool = newPool
+	}
+
+	return term, quality
+}
+
+// bestLiteral finds the literal which gives the best split
+// when it is used to move samples from falses into trues.
+// The rest argument specifies samples which stay on the
+// false side regardless of the literal.
+//
+// The exact quality of the split is also returned.
+// If no useful literal is found, nil is returned.
+func (b *Builder) bestLiteral(falses, rest, trues []vecSample) (*BranchLiteral, float32) {
+	splitSamples, sampleFrac := subsampleLimit(b.Rand, falses, b.MaxSplitSamples)
+	literals, qualities := b.sortLiterals(splitSamples, rest, trues, sampleFrac, b.Negation)
+	if len(splitSamples) == len(falses) {
+		// sortLiterals() gave an exact result.
+		if len(literals) > 0 {
+			return &literals[0], qualities[0]
+		}
+		return nil, 0
+	}
+	return b.optimalLiteral(falses, rest, trues, literals)
+}
+
+// buildSubtree creates the branches (or leaf) node for
+// the given union or formula and its resulting split.
+//
+// If formula is non-nil, it is used instead of union.
+func (b *Builder) buildSubtree(union BranchFeatureUnion, formula BranchFormula,
+	falses, trues []vecSample, depth int) *Tree {
+	if len(union) == 0 && len(formula) == 0 {
 		return b.build(falses, 0)
 	}
 	tree1 := b.build(falses, depth-1)
@@ -142,6 +350,7 @@ func (b *Builder) buildSubtree(union BranchFeatureUnion, falses, trues []vecSamp
 	return &Tree{
 		Branch: &Branch{
 			Feature:     union,
+			Formula:     formula,
 			FalseBranch: tree1,
 			TrueBranch:  tree2,
 		},
@@ -156,66 +365,87 @@ func (b *Builder) buildSubtree(union BranchFeatureUnion, falses, trues []vecSamp
 // It is assumed that the newly selected feature will act
 // to move samples from falses into trues.
 func (b *Builder) optimalFeature(falses, trues []vecSample, f []BranchFeature) *BranchFeature {
-	sums := newLossSums(falses, trues)
+	literals := make([]BranchLiteral, len(f))
+	for i, feature := range f {
+		literals[i].BranchFeature = feature
+	}
+	if l, _ := b.optimalLiteral(falses, nil, trues, literals); l != nil {
+		return &l.BranchFeature
+	}
+	return nil
+}
+
+// optimalLiteral is like optimalFeature(), but for a set
+// of ranked literals.
+//
+// The rest argument specifies samples which are on the
+// false side of the split but cannot be moved by the
+// literal.
+//
+// The quality of the resulting split is also returned.
+func (b *Builder) optimalLiteral(falses, rest, trues []vecSample,
+	l []BranchLiteral) (*BranchLiteral, float32) {
+	sums := newLossSums(falses, rest, trues)
 
 	var lock sync.Mutex
-	var bestFeature BranchFeature
+	var bestLiteral BranchLiteral
 	var bestQuality float32
-	var successfulFeatures int
-	var currentFeature int
+	var successfulLiterals int
+	var currentLiteral int
 
-	getNext := func() *BranchFeature {
+	getNext := func() *BranchLiteral {
 		lock.Lock()
 		defer lock.Unlock()
-		if successfulFeatures >= essentials.MaxInt(1, b.CandidateSplits) {
+		if successfulLiterals >= essentials.MaxInt(1, b.CandidateSplits) {
 			return nil
-		} else if currentFeature == len(f) {
+		} else if currentLiteral == len(l) {
 			return nil
 		}
-		res := &f[currentFeature]
-		currentFeature++
+		res := &l[currentLiteral]
+		currentLiteral++
 		return res
 	}
 
-	putResult := func(f BranchFeature, quality float32) {
+	putResult := func(l BranchLiteral, quality float32) {
 		lock.Lock()
 		defer lock.Unlock()
 		if quality <= 0 {
 			return
 		}
-		if quality > bestQuality || successfulFeatures == 0 {
+		if quality > bestQuality || successfulLiterals == 0 {
 			bestQuality = quality
-			bestFeature = f
+			bestLiteral = l
 		}
-		successfulFeatures++
+		successfulLiterals++
 	}
 
 	var wg sync.WaitGroup
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+	for i := 0; i < b.numProcs(); i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for {
-				fPtr := getNext()
-				if fPtr == nil {
+				lPtr := getNext()
+				if lPtr == nil {
 					return
 				}
-				feature := *fPtr
-				quality := b.featureSplitQuality(falses, trues, sums, feature, 1.0)
-				putResult(feature, quality)
+				literal := *lPtr
+				quality := b.literalSplitQuality(falses, trues, sums, literal, 1.0)
+				putResult(literal, quality)
 			}
 		}()
 	}
 	wg.Wait()
 
-	if successfulFeatures == 0 {
-		return nil
+	if successfulLiterals == 0 {
+		return nil, 0
 	}
-	return &bestFeature
+	return &bestLiteral, bestQuality
 }
 
 // sortFeatures finds features which produce reasonable
 // splits and sorts them by quality.
+// The qualities themselves are returned as well.
 //
 // The falses and trues arguments represent the current
 // split.
@@ -226,19 +456,42 @@ func (b *Builder) optimalFeature(falses, trues []vecSample, f []BranchFeature) *
 // the fraction of the original falses slice that was
 // passed.
 // The trues argument is never a subset.
-func (b *Builder) sortFeatures(falses, trues []vecSample, sampleFrac float32) []BranchFeature {
+func (b *Builder) sortFeatures(falses, trues []vecSample,
+	sampleFrac float32) ([]BranchFeature, []float32) {
+	literals, qualities := b.sortLiterals(falses, nil, trues, sampleFrac, false)
+	features := make([]BranchFeature, len(literals))
+	for i, l := range literals {
+		features[i] = l.BranchFeature
+	}
+	return features, qualities
+}
+
+// sortLiterals is like sortFeatures(), but it may also
+// produce negated features.
+//
+// The rest argument specifies samples which are on the
+// false side of the split but cannot be moved by the
+// literals. Like trues, it is never a subset.
+func (b *Builder) sortLiterals(falses, rest, trues []vecSample, sampleFrac float32,
+	negation bool) ([]BranchLiteral, []float32) {
 	if len(falses) == 0 {
 		panic("no data")
 	}
 
-	totalSum := newLossSums(falses, trues)
+	totalSum := newLossSums(falses, rest, trues)
 	for i, x := range totalSum.True {
 		totalSum.True[i] = x * sampleFrac
+		totalSum.Rest[i] *= sampleFrac
 	}
-	baseQuality := b.Heuristic.Quality(totalSum.False) + b.Heuristic.Quality(totalSum.True)
+	allFalseSum := make([]float32, len(totalSum.False))
+	for i, x := range totalSum.False {
+		allFalseSum[i] = x + totalSum.Rest[i]
+	}
+	baseQuality := b.Heuristic.Quality(allFalseSum) + b.Heuristic.Quality(totalSum.True)
 
 	counts := b.countFeatureOccurrences(falses)
-	usable, trueIsMinority := b.filterFeatures(counts, len(falses), len(trues), sampleFrac)
+	usable, trueIsMinority := b.filterFeatures(counts, len(falses), len(rest), len(trues),
+		sampleFrac, negation)
 	sums := b.sumMinorities(falses, counts, usable, trueIsMinority)
 
 	var lock sync.Mutex
@@ -261,12 +514,14 @@ func (b *Builder) sortFeatures(falses, trues []vecSample, sampleFrac float32) []
 		return horizonIdx, f, true
 	}
 
+	horizons := b.horizons()
+
 	var resultLock sync.Mutex
-	var resultingFeatures []BranchFeature
+	var resultingLiterals []BranchLiteral
 	var resultingQualities []float32
 
 	var wg sync.WaitGroup
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+	for i := 0; i < b.numProcs(); i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -275,31 +530,44 @@ func (b *Builder) sortFeatures(falses, trues []vecSample, sampleFrac float32) []
 				if !more {
 					return
 				}
-				horizon := b.Horizons[i]
-				feature := usable[i][j]
-				sum := sums[i][j].Sum()
-				tIsMin := trueIsMinority[i][j]
+				feature := horizons[i]
+				feature.Feature = usable[i][j]
+				count := counts[i][feature.Feature+1]
 
-				majoritySum := make([]float32, len(sum))
+				minoritySum := sums[i][j].Sum()
+				majoritySum := make([]float32, len(minoritySum))
 				for k, x := range totalSum.False {
-					majoritySum[k] = x - sum[k]
+					majoritySum[k] = x - minoritySum[k]
 				}
-				trueSum, falseSum := sum, majoritySum
-				if !tIsMin {
-					trueSum, falseSum = falseSum, trueSum
+				posSum, negSum := minoritySum, majoritySum
+				if !trueIsMinority[i][j] {
+					posSum, negSum = negSum, posSum
 				}
-				for k, x := range totalSum.True {
-					trueSum[k] += x
+
+				tryLiteral := func(l BranchLiteral, movedSum, keptSum []float32, movedCount int) {
+					if !b.splitAllowed(movedCount, len(falses)-movedCount, len(rest), len(trues),
+						sampleFrac) {
+						return
+					}
+					trueSum := make([]float32, len(movedSum))
+					falseSum := make([]float32, len(keptSum))
+					for k, x := range totalSum.True {
+						trueSum[k] = movedSum[k] + x
+						falseSum[k] = keptSum[k] + totalSum.Rest[k]
+					}
+					quality := b.Heuristic.Quality(trueSum) + b.Heuristic.Quality(falseSum) -
+						baseQuality
+					if quality > 1e-6*baseQuality {
+						resultLock.Lock()
+						resultingQualities = append(resultingQualities, quality)
+						resultingLiterals = append(resultingLiterals, l)
+						resultLock.Unlock()
+					}
 				}
-				quality := b.Heuristic.Quality(trueSum) + b.Heuristic.Quality(falseSum) - baseQuality
-				if quality > 1e-6*baseQuality {
-					resultLock.Lock()
-					resultingQualities = append(resultingQualities, quality)
-					resultingFeatures = append(resultingFeatures, BranchFeature{
-						Feature:     feature,
-						StepsInPast: horizon,
-					})
-					resultLock.Unlock()
+				tryLiteral(BranchLiteral{BranchFeature: feature}, posSum, negSum, count)
+				if negation {
+					tryLiteral(BranchLiteral{BranchFeature: feature, Negate: true}, negSum, posSum,
+						len(falses)-count)
 				}
 			}
 		}()
@@ -308,15 +576,16 @@ func (b *Builder) sortFeatures(falses, trues []vecSample, sampleFrac float32) []
 
 	essentials.VoodooSort(resultingQualities, func(i, j int) bool {
 		return resultingQualities[i] > resultingQualities[j]
-	}, resultingFeatures)
+	}, resultingLiterals)
 
-	return resultingFeatures
+	return resultingLiterals, resultingQualities
 }
 
 func (b *Builder) countFeatureOccurrences(samples []vecSample) [][]int {
+	horizons := b.horizons()
 	numFeatures := samples[0].Timestep().Features.Len() + 1
 	makeCounts := func() [][]int {
-		res := make([][]int, len(b.Horizons))
+		res := make([][]int, len(horizons))
 		for i := range res {
 			res[i] = make([]int, numFeatures)
 		}
@@ -326,7 +595,7 @@ func (b *Builder) countFeatureOccurrences(samples []vecSample) [][]int {
 	var lock sync.Mutex
 	var wg sync.WaitGroup
 	sum := makeCounts()
-	numProcs := runtime.GOMAXPROCS(0)
+	numProcs := b.numProcs()
 	for i := 0; i < numProcs; i++ {
 		wg.Add(1)
 		go func(i int) {
@@ -335,11 +604,10 @@ func (b *Builder) countFeatureOccurrences(samples []vecSample) [][]int {
 			for j := i; j < len(samples); j += numProcs {
 				sample := samples[j]
 				for k, counts := range localCounts {
-					horizon := b.Horizons[k]
-					if horizon > sample.Index {
+					ts := sample.featureTimestep(horizons[k])
+					if ts == nil {
 						counts[0]++
 					} else {
-						ts := sample.Sequence[sample.Index-horizon]
 						for i := 1; i < numFeatures; i++ {
 							if ts.Features.Get(i - 1) {
 								counts[i]++
@@ -362,23 +630,23 @@ func (b *Builder) countFeatureOccurrences(samples []vecSample) [][]int {
 	return sum
 }
 
-func (b *Builder) filterFeatures(counts [][]int, falseCount, trueCount int,
-	sampleFrac float32) ([][]int, [][]bool) {
+func (b *Builder) filterFeatures(counts [][]int, falseCount, restCount, trueCount int,
+	sampleFrac float32, negation bool) ([][]int, [][]bool) {
 	var features [][]int
 	var trueIsMinority [][]bool
 	for _, horizonCounts := range counts {
 		var horizonFeatures []int
 		var horizonTrueIsMinority []bool
 		for i, n := range horizonCounts {
+			if !b.featureAllowed(i - 1) {
+				continue
+			}
 			splitTrueCount := n
 			splitFalseCount := falseCount - splitTrueCount
 
-			approxTrues := float32(trueCount) + float32(splitTrueCount)/sampleFrac
-			approxFalses := float32(splitFalseCount) / sampleFrac
-
-			if splitFalseCount == 0 || splitTrueCount == 0 ||
-				int(approxTrues) < b.MinSplitSamples ||
-				int(approxFalses) < b.MinSplitSamples {
+			if !b.splitAllowed(splitTrueCount, splitFalseCount, restCount, trueCount,
+				sampleFrac) && (!negation || !b.splitAllowed(splitFalseCount, splitTrueCount,
+				restCount, trueCount, sampleFrac)) {
 				// The split is unlikely to be allowed.
 				continue
 			}
@@ -392,6 +660,37 @@ func (b *Builder) filterFeatures(counts [][]int, falseCount, trueCount int,
 	return features, trueIsMinority
 }
 
+// numProcs gets the number of goroutines to use.
+func (b *Builder) numProcs() int {
+	if b.MaxProcs != 0 {
+		return b.MaxProcs
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// featureAllowed checks if a feature is allowed by the
+// FeatureMask.
+func (b *Builder) featureAllowed(feature int) bool {
+	return b.FeatureMask == nil || feature == -1 || b.FeatureMask[feature]
+}
+
+// splitAllowed checks if a split is likely to satisfy
+// MinSplitSamples.
+//
+// The split moves splitTrueCount samples to the true side
+// and leaves splitFalseCount samples on the false side.
+// These counts may come from a subset of the samples, as
+// described by sampleFrac, while restCount and trueCount
+// are exact.
+func (b *Builder) splitAllowed(splitTrueCount, splitFalseCount, restCount, trueCount int,
+	sampleFrac float32) bool {
+	approxTrues := float32(trueCount) + float32(splitTrueCount)/sampleFrac
+	approxFalses := float32(restCount) + float32(splitFalseCount)/sampleFrac
+	return splitFalseCount != 0 && splitTrueCount != 0 &&
+		int(approxTrues) >= b.MinSplitSamples &&
+		int(approxFalses) >= b.MinSplitSamples
+}
+
 func (b *Builder) sumMinorities(samples []vecSample, counts, features [][]int,
 	trueIsMinority [][]bool) [][]kahanSum {
 	vecSize := len(samples[0].Vector)
@@ -415,10 +714,12 @@ func (b *Builder) sumMinorities(samples []vecSample, counts, features [][]int,
 		return res
 	}
 
+	horizons := b.horizons()
+
 	var lock sync.Mutex
 	sum := makeSums()
 
-	numProcs := runtime.GOMAXPROCS(0)
+	numProcs := b.numProcs()
 	var wg sync.WaitGroup
 	for i := 0; i < numProcs; i++ {
 		wg.Add(1)
@@ -428,8 +729,8 @@ func (b *Builder) sumMinorities(samples []vecSample, counts, features [][]int,
 			for j := i; j < len(samples); j += numProcs {
 				sample := samples[j]
 				for k, horizonFeatures := range features {
-					horizon := b.Horizons[k]
-					if horizon > sample.Index {
+					ts := sample.featureTimestep(horizons[k])
+					if ts == nil {
 						for l, f := range horizonFeatures {
 							trueValue := f == -1
 							if trueValue == trueIsMinority[k][l] {
@@ -437,7 +738,6 @@ func (b *Builder) sumMinorities(samples []vecSample, counts, features [][]int,
 							}
 						}
 					} else {
-						ts := sample.Sequence[sample.Index-horizon]
 						for l, f := range horizonFeatures {
 							trueValue := f >= 0 && ts.Features.Get(f)
 							if trueValue == trueIsMinority[k][l] {
@@ -461,26 +761,50 @@ func (b *Builder) sumMinorities(samples []vecSample, counts, features [][]int,
 	return sum
 }
 
+// horizons gets all of the relative positions at which
+// features are considered for splits.
+//
+// Each position is represented as a BranchFeature with a
+// zero Feature field.
+func (b *Builder) horizons() []BranchFeature {
+	res := make([]BranchFeature, 0, len(b.Horizons)+len(b.Offsets))
+	for _, h := range b.Horizons {
+		res = append(res, BranchFeature{StepsInPast: h})
+	}
+	if len(b.Offsets) > 0 && b.GridWidth == 0 {
+		panic("grid offsets require a grid width")
+	}
+	for _, o := range b.Offsets {
+		o := o
+		res = append(res, BranchFeature{GridWidth: b.GridWidth, Offset: &o})
+	}
+	return res
+}
+
 // featureSplitQuality evaluates a given split.
 // The result is greater for better splits.
 //
 // See sortFeatures() for details on sampleFrac.
 func (b *Builder) featureSplitQuality(falses, trues []vecSample, sums *lossSums, f BranchFeature,
 	sampleFrac float32) float32 {
-	featureValues, splitFalseCount, splitTrueCount := b.evaluateFeature(falses, f)
+	return b.literalSplitQuality(falses, trues, sums, BranchLiteral{BranchFeature: f}, sampleFrac)
+}
 
-	approxTrues := float32(len(trues)) + float32(splitTrueCount)/sampleFrac
-	approxFalses := float32(len(falses)-splitTrueCount) / sampleFrac
+// literalSplitQuality is like featureSplitQuality(), but
+// for a literal.
+//
+// The Rest field of sums is kept on the false side.
+func (b *Builder) literalSplitQuality(falses, trues []vecSample, sums *lossSums, l BranchLiteral,
+	sampleFrac float32) float32 {
+	literalValues, splitFalseCount, splitTrueCount := b.evaluateLiteral(falses, l)
 
-	if splitFalseCount == 0 || splitTrueCount == 0 ||
-		int(approxTrues) < b.MinSplitSamples ||
-		int(approxFalses) < b.MinSplitSamples {
+	if !b.splitAllowed(splitTrueCount, splitFalseCount, sums.RestCount, len(trues), sampleFrac) {
 		// The split is unlikely to be allowed.
 		return 0
 	}
 
 	trueIsMinority := splitTrueCount < splitFalseCount
-	minoritySum := b.minoritySum(falses, featureValues, trueIsMinority)
+	minoritySum := b.minoritySum(falses, literalValues, trueIsMinority)
 	majoritySum := make([]float32, len(sums.False))
 	for i, x := range sums.False {
 		majoritySum[i] = x - minoritySum[i]
@@ -492,13 +816,18 @@ func (b *Builder) featureSplitQuality(falses, trues []vecSample, sums *lossSums,
 	}
 
 	oldTrueSum := make([]float32, len(newTrueSum))
+	oldFalseSum := make([]float32, len(newFalseSum))
 	for i, x := range sums.True {
 		newTrueSum[i] += x * sampleFrac
 		oldTrueSum[i] = x * sampleFrac
 	}
+	for i, x := range sums.Rest {
+		newFalseSum[i] += x * sampleFrac
+		oldFalseSum[i] = sums.False[i] + x*sampleFrac
+	}
 
 	newQuality := b.Heuristic.Quality(newFalseSum) + b.Heuristic.Quality(newTrueSum)
-	oldQuality := b.Heuristic.Quality(sums.False) + b.Heuristic.Quality(oldTrueSum)
+	oldQuality := b.Heuristic.Quality(oldFalseSum) + b.Heuristic.Quality(oldTrueSum)
 
 	// Avoid numerically insignificant deltas.
 	minDelta := math.Min(math.Abs(float64(newQuality)), math.Abs(float64(oldQuality))) * 1e-6
@@ -509,11 +838,11 @@ func (b *Builder) featureSplitQuality(falses, trues []vecSample, sums *lossSums,
 	return newQuality - oldQuality
 }
 
-func (b *Builder) evaluateFeature(samples []vecSample, f BranchFeature) (values []bool,
+func (b *Builder) evaluateLiteral(samples []vecSample, l BranchLiteral) (values []bool,
 	falses, trues int) {
 	values = make([]bool, len(samples))
 	for i, s := range samples {
-		val := s.BranchFeature(f)
+		val := s.BranchLiteral(l)
 		values[i] = val
 		if val {
 			trues++
@@ -537,25 +866,40 @@ func (b *Builder) minoritySum(samples []vecSample, values []bool, trueIsMinority
 type lossSums struct {
 	False []float32
 	True  []float32
+
+	// Rest is the sum of samples which are on the false
+	// side of a split, but are not in False because they
+	// cannot be moved to the true side.
+	Rest      []float32
+	RestCount int
 }
 
-func newLossSums(falses, trues []vecSample) *lossSums {
+func newLossSums(falses, rest, trues []vecSample) *lossSums {
 	falseSum := newKahanSum(len(falses[0].Vector))
+	restSum := newKahanSum(len(falseSum.Sum()))
 	trueSum := newKahanSum(len(falseSum.Sum()))
 	for _, s := range falses {
 		falseSum.Add(s.Vector)
 	}
+	for _, s := range rest {
+		restSum.Add(s.Vector)
+	}
 	for _, s := range trues {
 		trueSum.Add(s.Vector)
 	}
-	return &lossSums{False: falseSum.Sum(), True: trueSum.Sum()}
+	return &lossSums{
+		False:     falseSum.Sum(),
+		True:      trueSum.Sum(),
+		Rest:      restSum.Sum(),
+		RestCount: len(rest),
+	}
 }
 
-func subsampleLimit(samples []vecSample, max int) ([]vecSample, float32) {
+func subsampleLimit(gen *rand.Rand, samples []vecSample, max int) ([]vecSample, float32) {
 	splitSamples := samples
 	if max != 0 && len(splitSamples) > max {
 		splitSamples = make([]vecSample, max)
-		for i, j := range rand.Perm(len(samples))[:max] {
+		for i, j := range randPerm(gen, len(samples))[:max] {
 			splitSamples[i] = samples[j]
 		}
 	}
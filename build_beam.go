@@ -0,0 +1,180 @@
+package seqtree
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// buildUnionBeam is like buildUnion(), but it uses a beam
+// search to find the union.
+//
+// At every step, each union in the beam is extended by its
+// top features, and the best UnionBeamWidth extensions
+// are kept for the next step.
+// The best union from any step is used for the split.
+func (b *Builder) buildUnionBeam(samples []vecSample, depth int) *Tree {
+	beam := []*unionBeamState{{Falses: samples}}
+	best := beam[0]
+	var evals int
+	for len(beam) > 0 && len(beam[0].Union) < essentials.MaxInt(1, b.MaxUnion) {
+		candidates := b.unionBeamCandidates(beam)
+		if b.MaxUnionEvals != 0 && len(candidates) > b.MaxUnionEvals-evals {
+			candidates = candidates[:b.MaxUnionEvals-evals]
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		evals += len(candidates)
+		b.scoreUnionCandidates(candidates)
+		beam = b.nextUnionBeam(candidates)
+		for _, state := range beam {
+			if state.Quality > best.Quality {
+				best = state
+			}
+		}
+	}
+	return b.buildSubtree(best.Union, nil, best.Falses, best.Trues, depth)
+}
+
+// unionBeamCandidates finds the features to try adding to
+// each union in the beam.
+//
+// The candidates are ordered by rank, so that truncating
+// the result keeps the most promising candidates.
+func (b *Builder) unionBeamCandidates(beam []*unionBeamState) []*unionBeamCandidate {
+	numFeatures := essentials.MaxInt(b.UnionBeamWidth, b.CandidateSplits)
+	var stateCandidates [][]*unionBeamCandidate
+	for _, state := range beam {
+		splitSamples, sampleFrac := subsampleLimit(b.Rand, state.Falses, b.MaxSplitSamples)
+		features, _ := b.sortFeatures(splitSamples, state.Trues, sampleFrac)
+		if len(features) > numFeatures {
+			features = features[:numFeatures]
+		}
+		var candidates []*unionBeamCandidate
+		for _, f := range features {
+			candidates = append(candidates, &unionBeamCandidate{Parent: state, Feature: f})
+		}
+		stateCandidates = append(stateCandidates, candidates)
+	}
+
+	var res []*unionBeamCandidate
+	for rank := 0; rank < numFeatures; rank++ {
+		for _, candidates := range stateCandidates {
+			if rank < len(candidates) {
+				res = append(res, candidates[rank])
+			}
+		}
+	}
+	return res
+}
+
+// scoreUnionCandidates computes the exact quality of every
+// candidate in parallel.
+func (b *Builder) scoreUnionCandidates(candidates []*unionBeamCandidate) {
+	sums := map[*unionBeamState]*lossSums{}
+	for _, c := range candidates {
+		if _, ok := sums[c.Parent]; !ok {
+			sums[c.Parent] = newLossSums(c.Parent.Falses, nil, c.Parent.Trues)
+		}
+	}
+
+	var wg sync.WaitGroup
+	numProcs := b.numProcs()
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(candidates); j += numProcs {
+				c := candidates[j]
+				c.Quality = b.featureSplitQuality(c.Parent.Falses, c.Parent.Trues,
+					sums[c.Parent], c.Feature, 1.0)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// nextUnionBeam selects the best candidates and creates
+// the resulting beam.
+func (b *Builder) nextUnionBeam(candidates []*unionBeamCandidate) []*unionBeamState {
+	var useful []*unionBeamCandidate
+	var qualities []float32
+	for _, c := range candidates {
+		if c.Quality > 0 {
+			useful = append(useful, c)
+			qualities = append(qualities, c.Parent.Quality+c.Quality)
+		}
+	}
+	essentials.VoodooSort(qualities, func(i, j int) bool {
+		return qualities[i] > qualities[j]
+	}, useful)
+
+	var res []*unionBeamState
+	seen := map[string]bool{}
+	for i, c := range useful {
+		if len(res) >= essentials.MaxInt(1, b.UnionBeamWidth) {
+			break
+		}
+		union := append(append(BranchFeatureUnion{}, c.Parent.Union...), c.Feature)
+		key := unionKey(union)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		state := &unionBeamState{
+			Union:   union,
+			Trues:   append([]vecSample{}, c.Parent.Trues...),
+			Quality: qualities[i],
+		}
+		for _, sample := range c.Parent.Falses {
+			if sample.BranchFeature(c.Feature) {
+				state.Trues = append(state.Trues, sample)
+			} else {
+				state.Falses = append(state.Falses, sample)
+			}
+		}
+		res = append(res, state)
+	}
+	return res
+}
+
+// unionKey creates a string which uniquely identifies the
+// set of features in a union, regardless of their order.
+func unionKey(union BranchFeatureUnion) string {
+	var parts []string
+	for _, f := range union {
+		part := fmt.Sprintf("%d:%d", f.Feature, f.StepsInPast)
+		if f.Is2D() {
+			offset := f.offset()
+			part += fmt.Sprintf(":%d:%d,%d", f.GridWidth, offset.DX, offset.DY)
+		}
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// A unionBeamState is a union in the beam, along with the
+// split it produces.
+type unionBeamState struct {
+	Union  BranchFeatureUnion
+	Falses []vecSample
+	Trues  []vecSample
+
+	// Quality is the improvement of the split over not
+	// splitting at all.
+	Quality float32
+}
+
+// A unionBeamCandidate is a potential extension of a union
+// in the beam.
+type unionBeamCandidate struct {
+	Parent  *unionBeamState
+	Feature BranchFeature
+	Quality float32
+}
@@ -0,0 +1,107 @@
+package seqtree
+
+import (
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// buildRandom is like build(), but it picks the best of
+// RandomSplits random unions at every node instead of
+// searching for splits.
+func (b *Builder) buildRandom(samples []vecSample, depth int) *Tree {
+	union := b.randomUnion(samples)
+	if union == nil {
+		return b.build(samples, 0)
+	}
+	var falses, trues []vecSample
+	branch := &Branch{Feature: union}
+	for _, sample := range samples {
+		if branch.Evaluate(&sample.TimestepSample) {
+			trues = append(trues, sample)
+		} else {
+			falses = append(falses, sample)
+		}
+	}
+	return b.buildSubtree(union, nil, falses, trues, depth)
+}
+
+// randomUnion draws random unions and returns the one
+// which gives the best split, or nil if none of them gives
+// a useful split.
+//
+// Each union contains between 1 and MaxUnion features.
+func (b *Builder) randomUnion(samples []vecSample) BranchFeatureUnion {
+	horizons := b.horizons()
+	var features []int
+	for i := -1; i < samples[0].Timestep().Features.Len(); i++ {
+		if b.featureAllowed(i) {
+			features = append(features, i)
+		}
+	}
+	if len(horizons) == 0 || len(features) == 0 {
+		return nil
+	}
+	candidates := make([]BranchFeatureUnion, b.RandomSplits)
+	for i := range candidates {
+		size := randIntn(b.Rand, essentials.MaxInt(1, b.MaxUnion)) + 1
+		for j := 0; j < size; j++ {
+			f := horizons[randIntn(b.Rand, len(horizons))]
+			f.Feature = features[randIntn(b.Rand, len(features))]
+			candidates[i] = append(candidates[i], f)
+		}
+	}
+
+	totalSum := newKahanSum(len(samples[0].Vector))
+	for _, s := range samples {
+		totalSum.Add(s.Vector)
+	}
+	baseQuality := b.Heuristic.Quality(totalSum.Sum())
+
+	qualities := make([]float32, len(candidates))
+	var wg sync.WaitGroup
+	numProcs := b.numProcs()
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(candidates); j += numProcs {
+				qualities[j] = b.unionSplitQuality(samples, totalSum.Sum(), baseQuality,
+					candidates[j])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var best BranchFeatureUnion
+	var bestQuality float32
+	for i, q := range qualities {
+		if q > 1e-6*baseQuality && (best == nil || q > bestQuality) {
+			best = candidates[i]
+			bestQuality = q
+		}
+	}
+	return best
+}
+
+// unionSplitQuality computes the improvement in quality
+// from splitting the samples with a union.
+//
+// If the split is not allowed, 0 is returned.
+func (b *Builder) unionSplitQuality(samples []vecSample, totalSum []float32,
+	baseQuality float32, union BranchFeatureUnion) float32 {
+	branch := &Branch{Feature: union}
+	trueSum := newKahanSum(len(totalSum))
+	var trueCount int
+	for _, sample := range samples {
+		if branch.Evaluate(&sample.TimestepSample) {
+			trueSum.Add(sample.Vector)
+			trueCount++
+		}
+	}
+	if !b.splitAllowed(trueCount, len(samples)-trueCount, 0, 0, 1) {
+		return 0
+	}
+	falseSum := vectorDifference(totalSum, trueSum.Sum())
+	return b.Heuristic.Quality(trueSum.Sum()) + b.Heuristic.Quality(falseSum) - baseQuality
+}
@@ -0,0 +1,318 @@
+package seqtree
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BuildSource is like Build, but it streams the samples
+// from a SequenceSource one chunk at a time.
+//
+// Trees are grown breadth-first. Every pass over the data
+// adds one feature to the union of every unfinished
+// node, so the number of passes is roughly the depth
+// times the maximum union size.
+//
+// Every split is evaluated exactly, so MaxSplitSamples
+// and CandidateSplits are ignored.
+// Branch formulas, beam search, and random splits are not
+// supported, so MaxConjunction, Negation, UnionBeamWidth,
+// MaxUnionEvals, and RandomSplits are ignored as well.
+// Grid offsets are not supported, so Offsets must be
+// empty.
+func (b *Builder) BuildSource(src SequenceSource) (*Tree, error) {
+	if b.Heuristic == nil {
+		panic("no heuristic was specified")
+	}
+	if len(b.Offsets) > 0 {
+		return nil, errors.New("build source: grid offsets are not supported")
+	}
+	if b.HorizonSelector != nil {
+		samples, err := reservoirSamples(b.Rand, src, b.HorizonSelector.MaxSamples)
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == 0 {
+			panic("no data")
+		}
+		b1 := *b
+		b1.Horizons = b.HorizonSelector.selectHorizons(b, newVecSamples(b.Heuristic, samples))
+		b1.HorizonSelector = nil
+		tree, err := b1.BuildSource(src)
+		if err != nil {
+			return nil, err
+		}
+		b.HorizonSelector.RecordUsage(tree)
+		return tree, nil
+	}
+	root := &sourceNode{Tree: &Tree{}, Depth: b.Depth}
+	nodes := []*sourceNode{root}
+	for len(nodes) > 0 {
+		if err := b.accumulateSource(src, root.Tree, nodes); err != nil {
+			return nil, err
+		}
+		if root.Count() == 0 {
+			panic("no data")
+		}
+		var nextNodes []*sourceNode
+		for _, node := range nodes {
+			nextNodes = append(nextNodes, b.extendSourceNode(node)...)
+		}
+		nodes = nextNodes
+	}
+	return root.Tree, nil
+}
+
+// reservoirSamples uniformly samples up to max timesteps
+// from all of the chunks of a source.
+func reservoirSamples(gen *rand.Rand, src SequenceSource, max int) ([]*TimestepSample, error) {
+	if max <= 0 {
+		return nil, errors.New("build source: horizon selector requires MaxSamples")
+	}
+	var res []*TimestepSample
+	var seen int
+	err := src.IterateChunks(false, func(chunk []Sequence) {
+		for _, sample := range TimestepSamples(chunk) {
+			seen++
+			if len(res) < max {
+				res = append(res, sample)
+			} else if idx := randIntn(gen, seen); idx < max {
+				res[idx] = sample
+			}
+		}
+	})
+	return res, err
+}
+
+// accumulateSource routes every sample to its unfinished
+// node and computes split statistics for the node.
+func (b *Builder) accumulateSource(src SequenceSource, root *Tree, nodes []*sourceNode) error {
+	horizons := b.horizons()
+	nodeIndices := map[*Tree]int{}
+	for i, node := range nodes {
+		nodeIndices[node.Tree] = i
+		node.Reset()
+	}
+	numProcs := b.numProcs()
+	return src.IterateChunks(false, func(chunk []Sequence) {
+		samples := TimestepSamples(chunk)
+		sampleNodes := make([]int, len(samples))
+		vectors := make([][]float32, len(samples))
+
+		var wg sync.WaitGroup
+		for i := 0; i < numProcs; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := i; j < len(samples); j += numProcs {
+					node := routeSourceSample(root, samples[j])
+					if idx, ok := nodeIndices[node]; ok {
+						sampleNodes[j] = idx
+						vectors[j] = b.Heuristic.SampleVector(samples[j])
+					} else {
+						sampleNodes[j] = -1
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// Each goroutine owns a distinct subset of the nodes,
+		// so no synchronization is needed.
+		for i := 0; i < numProcs; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j, idx := range sampleNodes {
+					if idx >= 0 && idx%numProcs == i {
+						nodes[idx].Add(horizons, samples[j], vectors[j])
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+// extendSourceNode uses the accumulated statistics to
+// grow the union of a node, or to finish the node.
+//
+// It returns the nodes that still need more passes.
+func (b *Builder) extendSourceNode(node *sourceNode) []*sourceNode {
+	if len(node.Union) == 0 && (node.Depth == 0 || node.Count() <= b.MinSplitSamples) {
+		node.Tree.Leaf = &Leaf{OutputDelta: b.Heuristic.LeafOutput(node.FalseSum.Sum())}
+		return nil
+	}
+
+	horizon, feature, ok := node.BestFeature(b)
+	if ok {
+		f := b.horizons()[horizon]
+		f.Feature = feature
+		node.Union = append(node.Union, f)
+		count := node.FeatureCounts[horizon][feature+1]
+		sum := node.FeatureSums[horizon][feature+1]
+		node.TrueCount += count
+		node.FalseCount -= count
+		for i, x := range sum {
+			node.TrueSum.sum[i] += float32(x)
+			node.FalseSum.sum[i] -= float32(x)
+		}
+		if len(node.Union) < b.MaxUnion {
+			return []*sourceNode{node}
+		}
+	}
+
+	if len(node.Union) == 0 {
+		node.Tree.Leaf = &Leaf{OutputDelta: b.Heuristic.LeafOutput(node.FalseSum.Sum())}
+		return nil
+	}
+
+	var res []*sourceNode
+	makeChild := func(sum []float32, count int) *Tree {
+		if node.Depth-1 == 0 || count <= b.MinSplitSamples {
+			return &Tree{Leaf: &Leaf{OutputDelta: b.Heuristic.LeafOutput(sum)}}
+		}
+		child := &sourceNode{Tree: &Tree{}, Depth: node.Depth - 1}
+		res = append(res, child)
+		return child.Tree
+	}
+	node.Tree.Branch = &Branch{
+		Feature:     node.Union,
+		FalseBranch: makeChild(node.FalseSum.Sum(), node.FalseCount),
+		TrueBranch:  makeChild(node.TrueSum.Sum(), node.TrueCount),
+	}
+	return res
+}
+
+// routeSourceSample finds the unfinished node which a
+// sample belongs to, or a finished leaf.
+func routeSourceSample(t *Tree, ts *TimestepSample) *Tree {
+	for t.Branch != nil {
+		if t.Branch.Evaluate(ts) {
+			t = t.Branch.TrueBranch
+		} else {
+			t = t.Branch.FalseBranch
+		}
+	}
+	return t
+}
+
+// A sourceNode is a node which is being grown by
+// BuildSource.
+//
+// The Tree is empty until the node is finished, at which
+// point it is turned into a leaf or a branch.
+type sourceNode struct {
+	Tree  *Tree
+	Depth int
+	Union BranchFeatureUnion
+
+	FalseCount int
+	TrueCount  int
+	FalseSum   *kahanSum
+	TrueSum    *kahanSum
+
+	// FeatureCounts and FeatureSums are indexed by horizon
+	// and then by feature+1, and only include samples that
+	// are not in the union.
+	FeatureCounts [][]int
+	FeatureSums   [][][]float64
+}
+
+func (s *sourceNode) Reset() {
+	s.FalseCount = 0
+	s.TrueCount = 0
+	s.FalseSum = nil
+	s.TrueSum = nil
+	s.FeatureCounts = nil
+	s.FeatureSums = nil
+}
+
+func (s *sourceNode) Count() int {
+	return s.FalseCount + s.TrueCount
+}
+
+// Add adds a sample to the statistics of the node.
+func (s *sourceNode) Add(horizons []BranchFeature, sample *TimestepSample, vec []float32) {
+	if s.FalseSum == nil {
+		s.FalseSum = newKahanSum(len(vec))
+		s.TrueSum = newKahanSum(len(vec))
+	}
+	if len(s.Union) > 0 && (&Branch{Feature: s.Union}).Evaluate(sample) {
+		s.TrueCount++
+		s.TrueSum.Add(vec)
+		return
+	}
+	s.FalseCount++
+	s.FalseSum.Add(vec)
+
+	if s.Depth == 0 {
+		return
+	}
+	numFeatures := sample.Timestep().Features.Len() + 1
+	if s.FeatureCounts == nil {
+		s.FeatureCounts = make([][]int, len(horizons))
+		s.FeatureSums = make([][][]float64, len(horizons))
+		for i := range s.FeatureCounts {
+			s.FeatureCounts[i] = make([]int, numFeatures)
+			s.FeatureSums[i] = make([][]float64, numFeatures)
+		}
+	}
+	addFeature := func(h, f int) {
+		s.FeatureCounts[h][f]++
+		sum := s.FeatureSums[h][f]
+		if sum == nil {
+			sum = make([]float64, len(vec))
+			s.FeatureSums[h][f] = sum
+		}
+		for i, x := range vec {
+			sum[i] += float64(x)
+		}
+	}
+	for h, horizon := range horizons {
+		ts := sample.featureTimestep(horizon)
+		if ts == nil {
+			addFeature(h, 0)
+		} else {
+			for i := 1; i < numFeatures; i++ {
+				if ts.Features.Get(i - 1) {
+					addFeature(h, i)
+				}
+			}
+		}
+	}
+}
+
+// BestFeature finds the best feature to add to the union,
+// using the same criteria as Builder.sortFeatures().
+func (s *sourceNode) BestFeature(b *Builder) (horizon, feature int, ok bool) {
+	falseSum := s.FalseSum.Sum()
+	trueSum := s.TrueSum.Sum()
+	baseQuality := b.Heuristic.Quality(falseSum) + b.Heuristic.Quality(trueSum)
+
+	var bestQuality float32
+	newTrueSum := make([]float32, len(falseSum))
+	newFalseSum := make([]float32, len(falseSum))
+	for h, counts := range s.FeatureCounts {
+		for f, count := range counts {
+			if !b.featureAllowed(f-1) || count == 0 || count == s.FalseCount ||
+				s.TrueCount+count < b.MinSplitSamples ||
+				s.FalseCount-count < b.MinSplitSamples {
+				continue
+			}
+			for i, x := range s.FeatureSums[h][f] {
+				newTrueSum[i] = trueSum[i] + float32(x)
+				newFalseSum[i] = falseSum[i] - float32(x)
+			}
+			quality := b.Heuristic.Quality(newTrueSum) + b.Heuristic.Quality(newFalseSum) -
+				baseQuality
+			if quality > 1e-6*baseQuality && (!ok || quality > bestQuality) {
+				bestQuality = quality
+				horizon, feature, ok = h, f-1, true
+			}
+		}
+	}
+	return
+}
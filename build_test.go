@@ -1,7 +1,10 @@
 package seqtree
 
 import (
+	"encoding/json"
 	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -50,3 +53,309 @@ func BenchmarkBuildTreeDense(b *testing.B) {
 		builder.Build(TimestepSamples([]Sequence{seq}))
 	}
 }
+
+func TestBuildGridOffsets(t *testing.T) {
+	const width = 6
+	var seqs []Sequence
+	for i := 0; i < 20; i++ {
+		var seq Sequence
+		for j := 0; j < width*width; j++ {
+			ts := &Timestep{
+				Features: NewBitmap(1),
+				Output:   make([]float32, 2),
+				Target:   make([]float32, 2),
+			}
+			ts.Features.Set(0, rand.Intn(2) == 1)
+			seq = append(seq, ts)
+		}
+		// Each cell is predicted by the cell above it.
+		for j, ts := range seq {
+			if j >= width && seq[j-width].Features.Get(0) {
+				ts.Target[1] = 1
+			} else {
+				ts.Target[0] = 1
+			}
+		}
+		seqs = append(seqs, seq)
+	}
+
+	b := &Builder{
+		Heuristic: GradientHeuristic{Loss: Softmax{}},
+		Depth:     1,
+		Offsets:   []Offset2D{{DX: -1, DY: 0}, {DX: 0, DY: -1}, {DX: 1, DY: -1}},
+		GridWidth: width,
+	}
+	tree := b.Build(TimestepSamples(seqs))
+	if tree.Branch == nil {
+		t.Fatal("expected a branch")
+	}
+	expected := BranchFeatureUnion{{Feature: 0, GridWidth: width, Offset: &Offset2D{DX: 0, DY: -1}}}
+	if !reflect.DeepEqual(tree.Branch.Feature, expected) {
+		t.Errorf("unexpected branch feature: %v", tree.Branch.Feature)
+	}
+
+	// The grid width is part of the tree, so the model can
+	// be evaluated like any other.
+	m := &Model{BaseFeatures: 1}
+	m.Add(tree, 1)
+	m.EvaluateAll(seqs)
+	for _, seq := range seqs {
+		for j, ts := range seq {
+			leaf := tree.Evaluate(&TimestepSample{Sequence: seq, Index: j})
+			if !reflect.DeepEqual(ts.Output, leaf.OutputDelta) {
+				t.Fatalf("unexpected output at index %d", j)
+			}
+		}
+	}
+}
+
+func TestFeatureTimestepGrid(t *testing.T) {
+	const width = 4
+	seq := make(Sequence, width*3)
+	for i := range seq {
+		seq[i] = &Timestep{Features: NewBitmap(1)}
+	}
+	sample := &TimestepSample{Sequence: seq, Index: width + 1}
+	tests := []struct {
+		Offset   Offset2D
+		Expected int
+	}{
+		{Offset2D{DX: 0, DY: 0}, width + 1},
+		{Offset2D{DX: -1, DY: 0}, width},
+		{Offset2D{DX: -2, DY: 0}, -1},
+		{Offset2D{DX: 2, DY: -1}, 3},
+		{Offset2D{DX: 3, DY: -1}, -1},
+		{Offset2D{DX: 0, DY: -2}, -1},
+		{Offset2D{DX: 1, DY: 0}, -1},
+		{Offset2D{DX: 0, DY: 1}, -1},
+	}
+	for _, test := range tests {
+		offset := test.Offset
+		actual := sample.featureTimestep(BranchFeature{GridWidth: width, Offset: &offset})
+		if test.Expected == -1 {
+			if actual != nil {
+				t.Errorf("offset %v: expected out of bounds", offset)
+			}
+		} else if actual != seq[test.Expected] {
+			t.Errorf("offset %v: expected timestep %d", offset, test.Expected)
+		}
+	}
+}
+
+func TestBranchFeatureJSON(t *testing.T) {
+	data, err := json.Marshal(BranchFeature{Feature: 3, StepsInPast: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "Offset") {
+		t.Errorf("unexpected offset in 1D feature: %s", data)
+	}
+
+	expected := BranchFeature{Feature: 3, GridWidth: 4, Offset: &Offset2D{DX: 1, DY: -2}}
+	data, err = json.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual BranchFeature
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v but got %+v", expected, actual)
+	}
+}
+
+func TestBuildFormula(t *testing.T) {
+	var seqs []Sequence
+	for i := 0; i < 10; i++ {
+		var seq Sequence
+		for j := 0; j < 50; j++ {
+			ts := &Timestep{
+				Features: NewBitmap(2),
+				Output:   make([]float32, 2),
+				Target:   make([]float32, 2),
+			}
+			a, b := rand.Intn(2) == 1, rand.Intn(2) == 1
+			ts.Features.Set(0, a)
+			ts.Features.Set(1, b)
+			if a && !b {
+				ts.Target[1] = 1
+			} else {
+				ts.Target[0] = 1
+			}
+			seq = append(seq, ts)
+		}
+		seqs = append(seqs, seq)
+	}
+
+	b := &Builder{
+		Heuristic:      GradientHeuristic{Loss: Softmax{}},
+		Depth:          1,
+		MaxConjunction: 2,
+		Negation:       true,
+		Horizons:       []int{0, 1},
+	}
+	samples := TimestepSamples(seqs)
+	tree := b.Build(samples)
+	if tree.Branch == nil || len(tree.Branch.Formula) != 1 || len(tree.Branch.Formula[0]) != 2 {
+		t.Fatalf("unexpected tree: %v", tree.Branch)
+	}
+	for _, sample := range samples {
+		expected := sample.Timestep().Target[1] == 1
+		if tree.Branch.Evaluate(sample) != expected {
+			t.Fatalf("formula %v does not match the target", tree.Branch.Formula)
+		}
+	}
+}
+
+func TestBranchFormulaJSON(t *testing.T) {
+	formula := BranchFormula{
+		{
+			{BranchFeature: BranchFeature{Feature: 3, StepsInPast: 1}},
+			{BranchFeature: BranchFeature{Feature: -1, StepsInPast: 2}, Negate: true},
+		},
+		{
+			{BranchFeature: BranchFeature{Feature: 1}},
+		},
+	}
+	tree := &Tree{
+		Branch: &Branch{
+			Formula:     formula,
+			FalseBranch: &Tree{Leaf: &Leaf{OutputDelta: []float32{1}}},
+			TrueBranch:  &Tree{Leaf: &Leaf{OutputDelta: []float32{2}}},
+		},
+	}
+	data, err := json.Marshal(tree.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Tree
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Branch.Formula, formula) {
+		t.Errorf("expected formula %v but got %v", formula, decoded.Branch.Formula)
+	}
+
+	// Models from before formulas only have unions.
+	var old Tree
+	oldData := `{"Branch":{"Feature":[{"Feature":1,"StepsInPast":0}],` +
+		`"FalseBranch":{"Leaf":{"OutputDelta":[1],"Feature":0}},` +
+		`"TrueBranch":{"Leaf":{"OutputDelta":[2],"Feature":0}}},"Leaf":null}`
+	if err := json.Unmarshal([]byte(oldData), &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.Branch.Formula != nil {
+		t.Error("expected nil formula")
+	}
+	seq := Sequence{&Timestep{Features: NewBitmap(2)}}
+	seq[0].Features.Set(1, true)
+	if old.Evaluate(&TimestepSample{Sequence: seq}).OutputDelta[0] != 2 {
+		t.Error("unexpected evaluation of union")
+	}
+}
+
+func TestBuildUnionBeam(t *testing.T) {
+	// The target is (a OR b), but c is the best single
+	// feature and cannot be extended to a perfect union.
+	var seqs []Sequence
+	for i := 0; i < 5; i++ {
+		var seq Sequence
+		for j := 0; j < 100; j++ {
+			ts := &Timestep{
+				Features: NewBitmap(3),
+				Output:   make([]float32, 2),
+				Target:   make([]float32, 2),
+			}
+			ts.Features.Set(0, j < 20)
+			ts.Features.Set(1, j >= 20 && j < 40)
+			ts.Features.Set(2, j < 30 || (j >= 40 && j < 43))
+			if j < 40 {
+				ts.Target[1] = 1
+			} else {
+				ts.Target[0] = 1
+			}
+			seq = append(seq, ts)
+		}
+		seqs = append(seqs, seq)
+	}
+	samples := TimestepSamples(seqs)
+
+	b := &Builder{
+		Heuristic: GradientHeuristic{Loss: Softmax{}},
+		Depth:     1,
+		MaxUnion:  2,
+		Horizons:  []int{0},
+	}
+	greedy := b.Build(samples)
+	if greedy.Branch.Feature[0].Feature != 2 {
+		t.Fatalf("unexpected greedy union: %v", greedy.Branch.Feature)
+	}
+
+	b.UnionBeamWidth = 3
+	b.MaxUnionEvals = 100
+	tree := b.Build(samples)
+	key := unionKey(tree.Branch.Feature)
+	expected := unionKey(BranchFeatureUnion{{Feature: 0}, {Feature: 1}})
+	if key != expected {
+		t.Errorf("unexpected beam union: %v", tree.Branch.Feature)
+	}
+
+	// With a tiny budget, only single features can be
+	// evaluated.
+	b.MaxUnionEvals = 3
+	tree = b.Build(samples)
+	if len(tree.Branch.Feature) != 1 || tree.Branch.Feature[0].Feature != 2 {
+		t.Errorf("unexpected budgeted union: %v", tree.Branch.Feature)
+	}
+}
+
+func TestBuildRandomSplits(t *testing.T) {
+	m := &Model{BaseFeatures: 5}
+	var seqs []Sequence
+	for i := 0; i < 15; i++ {
+		seq := []int{rand.Intn(5)}
+		for j := 1; j < 20; j++ {
+			seq = append(seq, (seq[j-1]+1)%5)
+		}
+		seqs = append(seqs, MakeOneHotSequence(seq, 5, m.NumFeatures()))
+	}
+	samples := TimestepSamples(seqs)
+
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           3,
+		MinSplitSamples: 5,
+		MaxUnion:        2,
+		Horizons:        []int{0, 1},
+		RandomSplits:    20,
+	}
+	tree := b.Build(samples)
+	if tree.Branch == nil {
+		t.Fatal("expected a branch")
+	}
+	var checkTree func(tree *Tree, depth int)
+	checkTree = func(tree *Tree, depth int) {
+		if tree.Leaf != nil {
+			return
+		}
+		if depth == 0 {
+			t.Fatal("tree is too deep")
+		}
+		if len(tree.Branch.Feature) > 2 {
+			t.Fatalf("union is too large: %v", tree.Branch.Feature)
+		}
+		checkTree(tree.Branch.FalseBranch, depth-1)
+		checkTree(tree.Branch.TrueBranch, depth-1)
+	}
+	checkTree(tree, b.Depth)
+	if delta := AvgLossDelta(samples, tree, Softmax{}, 1); delta >= 0 {
+		t.Errorf("expected loss to decrease, but got delta %f", delta)
+	}
+
+	// Without any horizons, there is nothing to split on.
+	b.Horizons = nil
+	if tree := b.Build(samples); tree.Leaf == nil {
+		t.Error("expected a leaf without horizons")
+	}
+}
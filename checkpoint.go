@@ -0,0 +1,175 @@
+package seqtree
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	checkpointPrefix      = "checkpoint_"
+	checkpointSuffix      = ".json"
+	defaultCheckpointKeep = 3
+)
+
+// A Checkpoint is a snapshot of a training run, from which
+// the run can be resumed.
+type Checkpoint struct {
+	Model *Model
+
+	// Iteration is the number of completed iterations.
+	Iteration int
+
+	// Seed is the base seed of the run, which is combined
+	// with the iteration to seed each iteration.
+	Seed int64
+
+	// Metrics is the history of every iteration.
+	Metrics []IterationMetrics
+
+	// Early stopping state.
+	BestLoss  float32
+	BestTrees int
+	SinceBest int
+	Stopped   bool
+
+	// BestWeights is the model's tree weights at the best
+	// validation loss.
+	BestWeights []float32 `json:",omitempty"`
+
+	// HorizonUsage is the usage statistics of the
+	// Builder's HorizonSelector, if it has one.
+	HorizonUsage map[int]float32 `json:",omitempty"`
+
+	// Extra stores arbitrary state for experiments, such
+	// as the current stage of an encoder.
+	// It is produced by Trainer.ExtraState.
+	Extra json.RawMessage `json:",omitempty"`
+}
+
+// A Checkpointer saves checkpoints to a directory, keeping
+// only the most recent ones.
+//
+// Every checkpoint is written to a temporary file and then
+// renamed, so an interrupted save never corrupts existing
+// checkpoints.
+type Checkpointer struct {
+	Dir string
+
+	// Keep is the number of checkpoints to keep.
+	// If 0, a default is used.
+	Keep int
+}
+
+// Save writes a checkpoint and deletes old checkpoints.
+func (c *Checkpointer) Save(ckpt *Checkpoint) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return errors.Wrap(err, "save checkpoint")
+	}
+	data, err := json.Marshal(ckpt)
+	if err != nil {
+		return errors.Wrap(err, "save checkpoint")
+	}
+	name := fmt.Sprintf("%s%09d%s", checkpointPrefix, ckpt.Iteration, checkpointSuffix)
+	if err := writeFileAtomic(filepath.Join(c.Dir, name), data, 0644); err != nil {
+		return errors.Wrap(err, "save checkpoint")
+	}
+
+	paths, err := c.paths()
+	if err != nil {
+		return errors.Wrap(err, "save checkpoint")
+	}
+	keep := c.Keep
+	if keep == 0 {
+		keep = defaultCheckpointKeep
+	}
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return errors.Wrap(err, "save checkpoint")
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// Latest loads the most recent checkpoint.
+//
+// Checkpoints which cannot be decoded are skipped in favor
+// of older ones.
+// If there are no checkpoints, nil is returned.
+func (c *Checkpointer) Latest() (*Checkpoint, error) {
+	paths, err := c.paths()
+	if err != nil {
+		return nil, errors.Wrap(err, "load checkpoint")
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		data, err := ioutil.ReadFile(paths[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "load checkpoint")
+		}
+		var ckpt Checkpoint
+		if err := json.Unmarshal(data, &ckpt); err == nil && ckpt.Model != nil {
+			return &ckpt, nil
+		}
+	}
+	return nil, nil
+}
+
+// paths lists the checkpoint files, from oldest to newest.
+func (c *Checkpointer) paths() ([]string, error) {
+	entries, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, checkpointPrefix) && strings.HasSuffix(name, checkpointSuffix) {
+			res = append(res, filepath.Join(c.Dir, name))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// writeFileAtomic writes a file by writing a temporary
+// file in the same directory and renaming it.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
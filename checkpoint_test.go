@@ -0,0 +1,182 @@
+package seqtree
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckpointer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Checkpointer{Dir: filepath.Join(dir, "nested"), Keep: 2}
+	if ckpt, err := c.Latest(); err != nil || ckpt != nil {
+		t.Fatalf("expected no checkpoint but got %v (err=%v)", ckpt, err)
+	}
+	for i := 1; i <= 5; i++ {
+		ckpt := &Checkpoint{Model: &Model{BaseFeatures: i}, Iteration: i}
+		if err := c.Save(ckpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 files but got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Mode().Perm() != 0644 {
+			t.Errorf("unexpected mode for %s: %v", entry.Name(), entry.Mode())
+		}
+	}
+
+	ckpt, err := c.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ckpt.Iteration != 5 || ckpt.Model.BaseFeatures != 5 {
+		t.Errorf("unexpected latest checkpoint: %+v", ckpt)
+	}
+
+	// A corrupted checkpoint should be skipped.
+	latestPath := filepath.Join(c.Dir, entries[1].Name())
+	if err := ioutil.WriteFile(latestPath, []byte("{\"Model\":"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ckpt, err = c.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ckpt.Iteration != 4 {
+		t.Errorf("expected fallback to iteration 4 but got %d", ckpt.Iteration)
+	}
+}
+
+func TestModelSaveAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "model.json")
+	m := &Model{BaseFeatures: 3}
+	for i := 0; i < 2; i++ {
+		if err := m.Save(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the model file but got %d files", len(entries))
+	}
+	if entries[0].Mode().Perm() != 0644 {
+		t.Errorf("unexpected mode: %v", entries[0].Mode())
+	}
+	var loaded Model
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.BaseFeatures != 3 {
+		t.Errorf("unexpected model: %+v", loaded)
+	}
+}
+
+func TestTrainerResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	validation := successorTestSequences(nil, &Model{BaseFeatures: 5}, 10)
+	var restoredExtra string
+	newTrainer := func(dir string) *Trainer {
+		return &Trainer{
+			Model: &Model{BaseFeatures: 5},
+			Builder: &Builder{
+				Heuristic:       GradientHeuristic{Loss: Softmax{}},
+				Depth:           2,
+				MinSplitSamples: 5,
+				HorizonSelector: &HorizonSelector{
+					Candidates:  []int{0, 1, 2},
+					NumSelected: 2,
+					UsageWeight: 0.5,
+				},
+			},
+			Loss: Softmax{},
+			DART: &DART{DropRate: 0.5},
+			Train: func(m *Model, gen *rand.Rand) []Sequence {
+				return successorTestSequences(gen, m, 10)
+			},
+			Validation: func(m *Model, gen *rand.Rand) []Sequence {
+				return validation
+			},
+			Checkpointer: &Checkpointer{Dir: dir},
+			Seed:         1337,
+			ExtraState: func() json.RawMessage {
+				return json.RawMessage(`"extra"`)
+			},
+			RestoreExtraState: func(extra json.RawMessage) error {
+				restoredExtra = string(extra)
+				return nil
+			},
+		}
+	}
+
+	uninterrupted := newTrainer(filepath.Join(dir, "full"))
+	expectedMetrics, err := uninterrupted.Run(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interrupted := newTrainer(filepath.Join(dir, "resumed"))
+	if _, err := interrupted.Run(2); err != nil {
+		t.Fatal(err)
+	}
+	resumed := newTrainer(filepath.Join(dir, "resumed"))
+	resumed.Seed = 0
+	if ok, err := resumed.Resume(); err != nil || !ok {
+		t.Fatalf("failed to resume: ok=%v err=%v", ok, err)
+	}
+	if restoredExtra != `"extra"` {
+		t.Errorf("unexpected extra state: %s", restoredExtra)
+	}
+	actualMetrics, err := resumed.Run(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(actualMetrics) != len(expectedMetrics) {
+		t.Fatalf("expected %d metrics but got %d", len(expectedMetrics), len(actualMetrics))
+	}
+	for i, x := range expectedMetrics {
+		x.Seconds = actualMetrics[i].Seconds
+		if !reflect.DeepEqual(actualMetrics[i], x) {
+			t.Errorf("iteration %d: expected metrics %+v but got %+v", i, x, actualMetrics[i])
+		}
+	}
+	expectedData, _ := json.Marshal(uninterrupted.Model)
+	actualData, _ := json.Marshal(resumed.Model)
+	if string(expectedData) != string(actualData) {
+		t.Error("resumed model differs from uninterrupted model")
+	}
+	expectedUsage := uninterrupted.Builder.HorizonSelector.Usage
+	actualUsage := resumed.Builder.HorizonSelector.Usage
+	if !reflect.DeepEqual(actualUsage, expectedUsage) {
+		t.Errorf("expected horizon usage %v but got %v", expectedUsage, actualUsage)
+	}
+}
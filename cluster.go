@@ -17,6 +17,11 @@ type ClusterEncoder struct {
 	Stages  []*Clusters
 	Weights []float32
 	Loss    GradLossFunc `json:"-"`
+
+	// LineSearch, if non-nil, is used to scale the deltas
+	// of new stages. By default, a golden-section search
+	// over [0, 100] is used.
+	LineSearch LineSearch `json:"-"`
 }
 
 // Save saves the model to a JSON file.
@@ -25,7 +30,7 @@ func (c *ClusterEncoder) Save(path string) error {
 	if err != nil {
 		return errors.Wrap(err, "save encoder")
 	}
-	if err := ioutil.WriteFile(path, data, 0755); err != nil {
+	if err := writeFileAtomic(path, data, 0644); err != nil {
 		return errors.Wrap(err, "save encoder")
 	}
 	return nil
@@ -47,35 +52,46 @@ func (c *ClusterEncoder) Load(path string) error {
 	return nil
 }
 
-func (c *ClusterEncoder) AddStage(k *KMeans, data [][]float32, shrinkage float32) {
-	zeroOutput := make([]float32, len(data[0]))
-	prevOutputs := make([][]float32, len(data))
-	grads := make([][]float32, len(data))
+// A VectorProvider produces batches of vectors.
+//
+// Every call may return a different batch, for example by
+// sampling from a large dataset, so that algorithms can
+// see more data than fits in a single batch.
+type VectorProvider func() [][]float32
+
+// FixedVectors creates a VectorProvider which always
+// returns the same batch.
+func FixedVectors(data [][]float32) VectorProvider {
+	return func() [][]float32 {
+		return data
+	}
+}
 
-	var lock sync.Mutex
-	originalLoss := newKahanSum(1)
+// A Clusterer finds cluster centers for batches of vectors.
+type Clusterer interface {
+	ClusterBatches(p VectorProvider) [][]float32
+}
 
-	var wg sync.WaitGroup
-	numProcs := runtime.GOMAXPROCS(0)
-	for i := 0; i < numProcs; i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			localSum := newKahanSum(1)
-			for j := i; j < len(data); j += numProcs {
-				_, prevOutput := c.encodeWithOutput(zeroOutput, data[j])
-				grads[j] = c.Loss.LossGrad(prevOutput, data[j])
-				prevOutputs[j] = prevOutput
-				localSum.Add([]float32{c.Loss.Loss(prevOutput, data[j])})
-			}
-			lock.Lock()
-			originalLoss.Add(localSum.Sum())
-			lock.Unlock()
-		}(i)
+// AddStage adds a stage to the encoder.
+//
+// The clusterer is given the loss gradients of batches of
+// targets from p. The deltas and weight of the new stage
+// are then fit to fitBatches more batches from p.
+//
+// The line search for every delta evaluates the loss many
+// times, so the outputs and targets of the fit batches
+// are kept in memory, grouped by cluster. The gradients
+// are discarded after every batch.
+func (c *ClusterEncoder) AddStage(k Clusterer, p VectorProvider, fitBatches int,
+	shrinkage float32) {
+	if fitBatches < 1 {
+		panic("AddStage requires at least 1 fit batch")
 	}
-	wg.Wait()
+	centers := k.ClusterBatches(func() [][]float32 {
+		_, grads, _ := c.stageInputs(p())
+		return grads
+	})
 
-	centers := k.Cluster(grads)
 	clusters := &Clusters{
 		Centers: centers,
 		Deltas:  make([][]float32, len(centers)),
@@ -83,12 +99,24 @@ func (c *ClusterEncoder) AddStage(k *KMeans, data [][]float32, shrinkage float32
 
 	clusterData := map[int][][]float32{}
 	clusterTargets := map[int][][]float32{}
-	for i, x := range prevOutputs {
-		idx, _ := clusters.Find(grads[i])
-		clusterData[idx] = append(clusterData[idx], x)
-		clusterTargets[idx] = append(clusterTargets[idx], data[i])
+	originalLoss := newKahanSum(1)
+	var numSamples int
+	for i := 0; i < fitBatches; i++ {
+		data := p()
+		prevOutputs, grads, loss := c.stageInputs(data)
+		originalLoss.Add([]float32{loss})
+		numSamples += len(data)
+		for j, x := range prevOutputs {
+			idx, _ := clusters.Find(grads[j])
+			clusterData[idx] = append(clusterData[idx], x)
+			clusterTargets[idx] = append(clusterTargets[idx], data[j])
+		}
 	}
 
+	search := c.LineSearch
+	if search == nil {
+		search = &FixedGoldenSection{Max: 100, Iters: 50}
+	}
 	newLoss := newKahanSum(1)
 	for i, center := range centers {
 		delta := append([]float32{}, center...)
@@ -101,15 +129,15 @@ func (c *ClusterEncoder) AddStage(k *KMeans, data [][]float32, shrinkage float32
 		if m, ok := c.Loss.(*MultiSoftmax); ok {
 			start := 0
 			for _, s := range m.Sizes {
-				scaleOptimalStepCluster(data, targets, delta, Softmax{}, 100.0, 50, start, s)
+				scaleOptimalStepCluster(data, targets, delta, Softmax{}, search, start, s)
 				start += s
 			}
 		} else if _, ok := c.Loss.(Sigmoid); ok {
 			for i := range delta {
-				scaleOptimalStepCluster(data, targets, delta, c.Loss, 100.0, 50, i, 1)
+				scaleOptimalStepCluster(data, targets, delta, c.Loss, search, i, 1)
 			}
 		} else {
-			scaleOptimalStepCluster(data, targets, delta, c.Loss, 100.0, 50, 0, 0)
+			scaleOptimalStepCluster(data, targets, delta, c.Loss, search, 0, 0)
 		}
 
 		for i := range delta {
@@ -122,12 +150,47 @@ func (c *ClusterEncoder) AddStage(k *KMeans, data [][]float32, shrinkage float32
 		}
 	}
 
-	weight := (originalLoss.Sum()[0] - newLoss.Sum()[0]) / float32(len(data))
+	weight := (originalLoss.Sum()[0] - newLoss.Sum()[0]) / float32(numSamples)
 
 	c.Stages = append(c.Stages, clusters)
 	c.Weights = append(c.Weights, weight)
 }
 
+// stageInputs computes the current outputs and loss
+// gradients for a batch of targets, as well as the total
+// loss.
+func (c *ClusterEncoder) stageInputs(data [][]float32) (outputs, grads [][]float32,
+	loss float32) {
+	zeroOutput := make([]float32, len(data[0]))
+	outputs = make([][]float32, len(data))
+	grads = make([][]float32, len(data))
+
+	var lock sync.Mutex
+	totalLoss := newKahanSum(1)
+
+	var wg sync.WaitGroup
+	numProcs := runtime.GOMAXPROCS(0)
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			localSum := newKahanSum(1)
+			for j := i; j < len(data); j += numProcs {
+				_, prevOutput := c.encodeWithOutput(zeroOutput, data[j])
+				grads[j] = c.Loss.LossGrad(prevOutput, data[j])
+				outputs[j] = prevOutput
+				localSum.Add([]float32{c.Loss.Loss(prevOutput, data[j])})
+			}
+			lock.Lock()
+			totalLoss.Add(localSum.Sum())
+			lock.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	return outputs, grads, totalLoss.Sum()[0]
+}
+
 func (c *ClusterEncoder) Encode(targets []float32) []int {
 	res, _ := c.encodeWithOutput(nil, targets)
 	return res
@@ -166,7 +229,7 @@ func (c *Clusters) Find(v []float32) (int, float32) {
 	minDist := float32(math.Inf(1))
 	minIdx := 0
 	for i, center := range c.Centers {
-		dist := vectorNormSquared(vectorDifference(v, center))
+		dist := squaredDistance(v, center)
 		if dist < minDist {
 			minDist = dist
 			minIdx = i
@@ -179,6 +242,10 @@ func (c *Clusters) Find(v []float32) (int, float32) {
 type KMeans struct {
 	NumClusters   int
 	MaxIterations int
+
+	// InitRounds, if non-zero, initializes the centers with
+	// this many rounds of k-means|| rather than k-means++.
+	InitRounds int
 }
 
 // Cluster clusters the data points into centers.
@@ -195,19 +262,31 @@ func (k *KMeans) Cluster(data [][]float32) [][]float32 {
 	return result
 }
 
+// ClusterBatches clusters a single batch from p.
+func (k *KMeans) ClusterBatches(p VectorProvider) [][]float32 {
+	return k.Cluster(p())
+}
+
 func (k *KMeans) initialize(data [][]float32) [][]float32 {
+	if k.InitRounds != 0 {
+		return kMeansParallelInit(data, k.NumClusters, k.InitRounds)
+	}
+
 	var result [][]float32
 
 	// Random initial center.
 	result = append(result, data[rand.Intn(len(data))])
 
+	sqDists := make([]float32, len(data))
+	for i := range sqDists {
+		sqDists[i] = float32(math.Inf(1))
+	}
+
 	// Use k-means++ to sample remaining centers.
 	for len(result) < k.NumClusters {
-		var sqDists []float32
+		updateSquaredDistances(data, sqDists, result[len(result)-1:])
 		totalDist := newKahanSum(1)
-		for _, x := range data {
-			_, dist := (&Clusters{Centers: result}).Find(x)
-			sqDists = append(sqDists, dist)
+		for _, dist := range sqDists {
 			totalDist.Add([]float32{dist})
 		}
 
@@ -231,6 +310,21 @@ func (k *KMeans) initialize(data [][]float32) [][]float32 {
 }
 
 func (k *KMeans) iterate(data, centers [][]float32) [][]float32 {
+	sums, counts := clusterSums(data, centers)
+	res := make([][]float32, len(sums))
+	for i, s := range sums {
+		res[i] = make([]float32, len(centers[0]))
+		for j, x := range s.Sum() {
+			res[i][j] = x / float32(counts[i])
+		}
+	}
+	return res
+}
+
+// clusterSums assigns every vector to its closest center
+// and computes the sum and count of the vectors assigned
+// to each center.
+func clusterSums(data, centers [][]float32) ([]*kahanSum, []int) {
 	dim := len(centers[0])
 
 	var lock sync.Mutex
@@ -271,13 +365,36 @@ func (k *KMeans) iterate(data, centers [][]float32) [][]float32 {
 	}
 	wg.Wait()
 
-	res := make([][]float32, len(sums))
-	for i, s := range sums {
-		res[i] = make([]float32, dim)
-		for j, x := range s.Sum() {
-			res[i][j] = x / float32(counts[i])
-		}
+	return sums, counts
+}
+
+// updateSquaredDistances lowers each squared distance in
+// sqDists to the squared distance from the corresponding
+// vector to the closest of the new centers.
+func updateSquaredDistances(data [][]float32, sqDists []float32, centers [][]float32) {
+	numProcs := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(data); j += numProcs {
+				for _, center := range centers {
+					if dist := squaredDistance(data[j], center); dist < sqDists[j] {
+						sqDists[j] = dist
+					}
+				}
+			}
+		}(i)
 	}
+	wg.Wait()
+}
 
+func squaredDistance(v1, v2 []float32) float32 {
+	var res float32
+	for i, x := range v1 {
+		d := x - v2[i]
+		res += d * d
+	}
 	return res
 }
@@ -0,0 +1,248 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+)
+
+const (
+	defaultMiniBatchInitRounds = 5
+	kMeansParallelLloydIters   = 10
+)
+
+// MiniBatchKMeans builds clusters from a stream of
+// mini-batches.
+//
+// After every batch, each center moves towards the mean of
+// the batch vectors assigned to it, with a learning rate
+// equal to the fraction of the center's total assignments
+// which came from the batch. Thus, every center is the
+// running mean of the vectors assigned to it.
+type MiniBatchKMeans struct {
+	NumClusters int
+
+	// Iterations is the number of mini-batches to use for
+	// updating the centers.
+	Iterations int
+
+	// InitRounds is the number of rounds of k-means|| to
+	// run on an initial batch.
+	// If 0, a default is used.
+	InitRounds int
+}
+
+// ClusterBatches initializes centers with k-means|| on one
+// batch from p, and then updates them with m.Iterations
+// more batches.
+func (m *MiniBatchKMeans) ClusterBatches(p VectorProvider) [][]float32 {
+	initRounds := m.InitRounds
+	if initRounds == 0 {
+		initRounds = defaultMiniBatchInitRounds
+	}
+	centers := kMeansParallelInit(p(), m.NumClusters, initRounds)
+	for i, c := range centers {
+		centers[i] = append([]float32{}, c...)
+	}
+
+	totalCounts := make([]int, len(centers))
+	for i := 0; i < m.Iterations; i++ {
+		sums, counts := clusterSums(p(), centers)
+		for j, center := range centers {
+			if counts[j] == 0 {
+				continue
+			}
+			totalCounts[j] += counts[j]
+			lr := float32(counts[j]) / float32(totalCounts[j])
+			for k, x := range sums[j].Sum() {
+				mean := x / float32(counts[j])
+				center[k] += lr * (mean - center[k])
+			}
+		}
+	}
+	return centers
+}
+
+// kMeansParallelInit selects initial centers using
+// k-means||.
+//
+// Each round samples about 2*k candidates in parallel,
+// with probabilities proportional to their squared
+// distance from the existing candidates. The candidates
+// are then weighted by the number of vectors closest to
+// them and reduced to k centers with weighted greedy
+// k-means++ and a few Lloyd iterations.
+func kMeansParallelInit(data [][]float32, k, rounds int) [][]float32 {
+	candidates := [][]float32{data[rand.Intn(len(data))]}
+	sqDists := make([]float32, len(data))
+	for i := range sqDists {
+		sqDists[i] = float32(math.Inf(1))
+	}
+	updateSquaredDistances(data, sqDists, candidates)
+
+	oversampling := 2 * float64(k)
+	for round := 0; round < rounds; round++ {
+		var cost float64
+		for _, d := range sqDists {
+			cost += float64(d)
+		}
+		if cost == 0 {
+			break
+		}
+		newCandidates := sampleCandidates(data, sqDists, oversampling/cost)
+		updateSquaredDistances(data, sqDists, newCandidates)
+		candidates = append(candidates, newCandidates...)
+	}
+
+	for len(candidates) < k {
+		candidates = append(candidates, data[rand.Intn(len(data))])
+	}
+
+	_, counts := clusterSums(data, candidates)
+	weights := make([]float32, len(counts))
+	for i, c := range counts {
+		weights[i] = float32(c)
+	}
+	centers := weightedKMeansPlusPlus(candidates, weights, k)
+	return weightedLloyd(candidates, weights, centers, kMeansParallelLloydIters)
+}
+
+// sampleCandidates independently samples every vector
+// with probability min(1, scale*sqDist).
+func sampleCandidates(data [][]float32, sqDists []float32, scale float64) [][]float32 {
+	numProcs := runtime.GOMAXPROCS(0)
+	results := make([][][]float32, numProcs)
+	seeds := make([]int64, numProcs)
+	for i := range seeds {
+		seeds[i] = rand.Int63()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			gen := rand.New(rand.NewSource(seeds[i]))
+			for j := i; j < len(data); j += numProcs {
+				if gen.Float64() < scale*float64(sqDists[j]) {
+					results[i] = append(results[i], data[j])
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var res [][]float32
+	for _, r := range results {
+		res = append(res, r...)
+	}
+	return res
+}
+
+// weightedKMeansPlusPlus runs greedy k-means++ on weighted
+// points.
+//
+// At every step, a few centers are sampled and the one
+// which most reduces the weighted squared distances is
+// kept, which makes it unlikely for two centers to be
+// chosen from the same cluster.
+func weightedKMeansPlusPlus(points [][]float32, weights []float32, k int) [][]float32 {
+	numTrials := 2 + int(math.Log(float64(k)))
+
+	sqDists := make([]float32, len(points))
+	for i := range sqDists {
+		sqDists[i] = float32(math.Inf(1))
+	}
+	probs := make([]float64, len(points))
+	for i, w := range weights {
+		probs[i] = float64(w)
+	}
+
+	var centers [][]float32
+	for len(centers) < k {
+		var bestDists []float32
+		bestIdx := -1
+		bestPotential := math.Inf(1)
+		for trial := 0; trial < numTrials; trial++ {
+			idx := sampleIndex(probs)
+			dists := make([]float32, len(points))
+			var potential float64
+			for i, p := range points {
+				dists[i] = sqDists[i]
+				if d := squaredDistance(p, points[idx]); d < dists[i] {
+					dists[i] = d
+				}
+				potential += float64(weights[i]) * float64(dists[i])
+			}
+			if bestIdx == -1 || potential < bestPotential {
+				bestIdx = idx
+				bestDists = dists
+				bestPotential = potential
+			}
+		}
+		centers = append(centers, points[bestIdx])
+		sqDists = bestDists
+		for i, d := range sqDists {
+			probs[i] = float64(weights[i]) * float64(d)
+		}
+	}
+	return centers
+}
+
+// weightedLloyd runs Lloyd iterations on weighted points.
+//
+// Centers with no points assigned to them are left alone.
+func weightedLloyd(points [][]float32, weights []float32, centers [][]float32,
+	iters int) [][]float32 {
+	dim := len(points[0])
+	for iter := 0; iter < iters; iter++ {
+		c := &Clusters{Centers: centers}
+		sums := make([][]float64, len(centers))
+		totals := make([]float64, len(centers))
+		for i := range sums {
+			sums[i] = make([]float64, dim)
+		}
+		for i, p := range points {
+			idx, _ := c.Find(p)
+			totals[idx] += float64(weights[i])
+			for j, x := range p {
+				sums[idx][j] += float64(weights[i]) * float64(x)
+			}
+		}
+		newCenters := make([][]float32, len(centers))
+		for i, center := range centers {
+			if totals[i] == 0 {
+				newCenters[i] = center
+				continue
+			}
+			newCenters[i] = make([]float32, dim)
+			for j, x := range sums[i] {
+				newCenters[i][j] = float32(x / totals[i])
+			}
+		}
+		centers = newCenters
+	}
+	return centers
+}
+
+// sampleIndex samples an index with probability
+// proportional to its weight, or uniformly if all of the
+// weights are zero.
+func sampleIndex(weights []float64) int {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		return rand.Intn(len(weights))
+	}
+	p := rand.Float64() * total
+	for i, w := range weights {
+		p -= w
+		if p < 0 {
+			return i
+		}
+	}
+	return len(weights) - 1
+}
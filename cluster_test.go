@@ -0,0 +1,104 @@
+package seqtree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestMiniBatchKMeans(t *testing.T) {
+	centers := testClusterCenters()
+	k := &MiniBatchKMeans{NumClusters: len(centers), Iterations: 50}
+	actual := k.ClusterBatches(func() [][]float32 {
+		return testClusterBatch(centers, 200)
+	})
+	checkTestClusterCenters(t, centers, actual, 0.05)
+}
+
+func TestKMeansParallelInit(t *testing.T) {
+	centers := testClusterCenters()
+	k := &KMeans{NumClusters: len(centers), MaxIterations: 20, InitRounds: 3}
+	actual := k.ClusterBatches(FixedVectors(testClusterBatch(centers, 1000)))
+	checkTestClusterCenters(t, centers, actual, 0.1)
+}
+
+func TestClusterEncoderAddStage(t *testing.T) {
+	prototypes := make([][]float32, 8)
+	for i := range prototypes {
+		prototypes[i] = make([]float32, 10)
+		for j := range prototypes[i] {
+			prototypes[i][j] = float32(rand.Intn(2))
+		}
+	}
+	batch := func() [][]float32 {
+		res := make([][]float32, 500)
+		for i := range res {
+			res[i] = prototypes[rand.Intn(len(prototypes))]
+		}
+		return res
+	}
+	meanLoss := func(e *ClusterEncoder, data [][]float32) float32 {
+		var total float32
+		for _, x := range data {
+			_, outputs := e.encodeWithOutput(nil, x)
+			total += e.Loss.Loss(outputs, x)
+		}
+		return total / float32(len(data))
+	}
+
+	for _, k := range []Clusterer{
+		&KMeans{NumClusters: 4, MaxIterations: 10},
+		&MiniBatchKMeans{NumClusters: 4, Iterations: 10},
+	} {
+		e := &ClusterEncoder{Loss: Sigmoid{}}
+		data := batch()
+		lastLoss := meanLoss(e, data)
+		for i := 0; i < 3; i++ {
+			e.AddStage(k, batch, 2, 1)
+			loss := meanLoss(e, data)
+			if loss >= lastLoss {
+				t.Errorf("%T: stage %d did not decrease loss: %f -> %f", k, i, lastLoss, loss)
+			}
+			if e.Weights[i] <= 0 {
+				t.Errorf("%T: stage %d has non-positive weight %f", k, i, e.Weights[i])
+			}
+			lastLoss = loss
+		}
+		if len(e.Stages) != 3 || len(e.Encode(data[0])) != 3 {
+			t.Errorf("%T: unexpected number of stages", k)
+		}
+	}
+}
+
+func testClusterCenters() [][]float32 {
+	return [][]float32{
+		{0, 0, 0},
+		{5, 0, 0},
+		{0, 5, 0},
+		{0, 0, 5},
+		{5, 5, 5},
+	}
+}
+
+func testClusterBatch(centers [][]float32, n int) [][]float32 {
+	res := make([][]float32, n)
+	for i := range res {
+		center := centers[rand.Intn(len(centers))]
+		res[i] = make([]float32, len(center))
+		for j, x := range center {
+			res[i][j] = x + float32(rand.NormFloat64())*0.2
+		}
+	}
+	return res
+}
+
+func checkTestClusterCenters(t *testing.T, expected, actual [][]float32, tol float32) {
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d centers but got %d", len(expected), len(actual))
+	}
+	for _, center := range expected {
+		_, dist := (&Clusters{Centers: actual}).Find(center)
+		if dist > tol*tol {
+			t.Errorf("no center close to %v (squared distance %f)", center, dist)
+		}
+	}
+}
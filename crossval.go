@@ -0,0 +1,250 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// TrainParams stores the hyperparameters which are tuned
+// by cross-validation and search.
+type TrainParams struct {
+	Depth           int
+	MinSplitSamples int
+	MaxUnion        int
+
+	// MaxLeaves, if non-zero, prunes every tree to this
+	// many leaves using the Builder's heuristic.
+	MaxLeaves int
+
+	// MaxStep is passed to ScaleOptimalStep.
+	// If 0, the Trainer's default is used.
+	MaxStep float32
+
+	// Shrinkage is the constant step size.
+	// If 0, a step size of 1 is used.
+	Shrinkage float32
+}
+
+// A CrossValidator trains models on k-fold splits of a
+// fixed dataset to estimate their generalization loss.
+type CrossValidator struct {
+	// Builder is the template for building trees.
+	// The fields in TrainParams override the ones in the
+	// template.
+	Builder Builder
+
+	Loss LossFunc
+
+	// Folds is the number of folds.
+	Folds int
+
+	// NumTrees is the number of trees to train per fold.
+	NumTrees int
+
+	// BaseFeatures is the number of features in the data.
+	BaseFeatures int
+
+	// MinLeafSamples is passed to ScaleOptimalStep.
+	// If 0, the Trainer's default is used.
+	MinLeafSamples int
+
+	// Parallelism is the maximum number of models to train
+	// at once. If 0, GOMAXPROCS is used.
+	//
+	// The GOMAXPROCS budget is divided between the models
+	// being trained at once, each of which builds trees
+	// with its share of it.
+	Parallelism int
+}
+
+// A CVResult summarizes the cross-validation of a set of
+// hyperparameters.
+type CVResult struct {
+	Params TrainParams
+
+	// NumTrees is the number of trees trained per fold.
+	NumTrees int
+
+	// FoldLosses stores the mean validation loss per
+	// timestep for each fold.
+	FoldLosses []float32
+
+	// Mean and Stddev summarize FoldLosses.
+	Mean   float32
+	Stddev float32
+}
+
+// CrossValidate trains a model for every fold and reports
+// the validation loss on each held-out fold.
+func (c *CrossValidator) CrossValidate(seqs []Sequence, p TrainParams) *CVResult {
+	return c.crossValidateAll(seqs, []TrainParams{p}, c.NumTrees)[0]
+}
+
+// crossValidateAll cross-validates many sets of
+// hyperparameters, training every fold of every set in a
+// shared pool of workers.
+func (c *CrossValidator) crossValidateAll(seqs []Sequence, params []TrainParams,
+	numTrees int) []*CVResult {
+	if numTrees < 1 {
+		panic("cross-validation requires at least 1 tree")
+	}
+	folds := SplitFolds(seqs, c.Folds)
+	results := make([]*CVResult, len(params))
+	for i, p := range params {
+		results[i] = &CVResult{
+			Params:     p,
+			NumTrees:   numTrees,
+			FoldLosses: make([]float32, len(folds)),
+		}
+	}
+	c.runJobs(len(params)*len(folds), func(job, maxProcs int) {
+		paramIdx := job / len(folds)
+		foldIdx := job % len(folds)
+		var train []Sequence
+		for i, fold := range folds {
+			if i != foldIdx {
+				train = append(train, fold...)
+			}
+		}
+		loss := c.trainFold(train, folds[foldIdx], params[paramIdx], numTrees, maxProcs)
+		results[paramIdx].FoldLosses[foldIdx] = loss
+	})
+	for _, r := range results {
+		r.Mean, r.Stddev = meanStddev(r.FoldLosses)
+	}
+	return results
+}
+
+func (c *CrossValidator) trainFold(train, valid []Sequence, p TrainParams, numTrees,
+	maxProcs int) float32 {
+	builder := c.Builder
+	if builder.HorizonSelector != nil {
+		builder.HorizonSelector = builder.HorizonSelector.clone()
+	}
+	builder.MaxProcs = maxProcs
+	builder.Depth = p.Depth
+	builder.MinSplitSamples = p.MinSplitSamples
+	builder.MaxUnion = p.MaxUnion
+	trainer := &Trainer{
+		Model:          &Model{BaseFeatures: c.BaseFeatures},
+		Builder:        &builder,
+		Loss:           c.Loss,
+		Train:          FixedSamples(train),
+		MaxStep:        p.MaxStep,
+		MinLeafSamples: c.MinLeafSamples,
+	}
+	if p.MaxLeaves != 0 {
+		trainer.Pruner = &Pruner{Heuristic: builder.Heuristic, MaxLeaves: p.MaxLeaves}
+	}
+	if p.Shrinkage != 0 {
+		trainer.Shrinkage = ConstantShrinkage(p.Shrinkage)
+	}
+	// Without a Checkpointer or Metrics, Run cannot fail.
+	trainer.Run(numTrees)
+	return meanTimestepLoss(trainer.samples(FixedSamples(valid), nil, nil), c.Loss)
+}
+
+// runJobs runs n jobs on a pool of workers, giving each
+// job its share of GOMAXPROCS.
+func (c *CrossValidator) runJobs(n int, f func(job, maxProcs int)) {
+	if n == 0 {
+		return
+	}
+	numWorkers := c.Parallelism
+	if numWorkers == 0 {
+		numWorkers = runtime.GOMAXPROCS(0)
+	}
+	numWorkers = essentials.MinInt(numWorkers, n)
+	maxProcs := essentials.MaxInt(1, runtime.GOMAXPROCS(0)/numWorkers)
+	jobs := make(chan int, n)
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				f(job, maxProcs)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// SplitFolds splits sequences into k folds of nearly
+// equal size, assigning sequence i to fold i%k.
+//
+// Sequences should be shuffled beforehand if their order
+// is meaningful.
+func SplitFolds(seqs []Sequence, k int) [][]Sequence {
+	if k < 2 {
+		panic("cross-validation requires at least 2 folds")
+	}
+	folds := make([][]Sequence, k)
+	for i, seq := range seqs {
+		folds[i%k] = append(folds[i%k], seq)
+	}
+	return folds
+}
+
+// FixedSamples creates a SampleProvider which always
+// provides the same sequences.
+//
+// The sequences are copied with enough room for the
+// model's features, so the originals are never modified
+// and may be shared between providers.
+func FixedSamples(seqs []Sequence) SampleProvider {
+	var copied []Sequence
+	numFeatures := -1
+	return func(m *Model, gen *rand.Rand) []Sequence {
+		if m.NumFeatures() != numFeatures {
+			numFeatures = m.NumFeatures()
+			copied = resizeFeatures(seqs, m.BaseFeatures, numFeatures)
+		}
+		return copied
+	}
+}
+
+// resizeFeatures copies sequences, keeping only the first
+// baseFeatures features and leaving room for numFeatures
+// features in total.
+//
+// Targets are shared with the original sequences.
+func resizeFeatures(seqs []Sequence, baseFeatures, numFeatures int) []Sequence {
+	res := make([]Sequence, len(seqs))
+	for i, seq := range seqs {
+		res[i] = make(Sequence, len(seq))
+		for j, ts := range seq {
+			features := NewBitmap(numFeatures)
+			for k := 0; k < baseFeatures; k++ {
+				if ts.Features.Get(k) {
+					features.Set(k, true)
+				}
+			}
+			res[i][j] = &Timestep{
+				Features: features,
+				Output:   make([]float32, len(ts.Output)),
+				Target:   ts.Target,
+			}
+		}
+	}
+	return res
+}
+
+func meanStddev(values []float32) (mean, stddev float32) {
+	var sum, sqSum float64
+	for _, x := range values {
+		sum += float64(x)
+		sqSum += float64(x) * float64(x)
+	}
+	n := float64(len(values))
+	m := sum / n
+	return float32(m), float32(math.Sqrt(math.Max(0, sqSum/n-m*m)))
+}
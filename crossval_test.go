@@ -0,0 +1,136 @@
+package seqtree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSplitFolds(t *testing.T) {
+	seqs := successorTestSequences(nil, &Model{BaseFeatures: 5}, 11)
+	folds := SplitFolds(seqs, 3)
+	if len(folds) != 3 {
+		t.Fatalf("expected 3 folds but got %d", len(folds))
+	}
+	seen := map[*Timestep]bool{}
+	for i, fold := range folds {
+		if len(fold) < 3 || len(fold) > 4 {
+			t.Errorf("fold %d: unexpected size %d", i, len(fold))
+		}
+		for _, seq := range fold {
+			if seen[seq[0]] {
+				t.Errorf("fold %d: duplicate sequence", i)
+			}
+			seen[seq[0]] = true
+		}
+	}
+	if len(seen) != len(seqs) {
+		t.Errorf("expected %d sequences but got %d", len(seqs), len(seen))
+	}
+}
+
+func TestCrossValidate(t *testing.T) {
+	seqs := successorTestSequences(nil, &Model{BaseFeatures: 5}, 30)
+	cv := &CrossValidator{
+		Builder:      Builder{Heuristic: GradientHeuristic{Loss: Softmax{}}, Horizons: []int{0, 1}},
+		Loss:         Softmax{},
+		Folds:        3,
+		NumTrees:     4,
+		BaseFeatures: 5,
+	}
+	initial := meanTimestepLoss(TimestepSamples(zeroedTestSequences(seqs)), Softmax{})
+	result := cv.CrossValidate(seqs, TrainParams{Depth: 2, MinSplitSamples: 5, Shrinkage: 0.5})
+	if len(result.FoldLosses) != 3 || result.NumTrees != 4 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	var sum, sqSum float64
+	for i, x := range result.FoldLosses {
+		if x >= initial {
+			t.Errorf("fold %d: loss %f did not improve on %f", i, x, initial)
+		}
+		sum += float64(x)
+		sqSum += float64(x) * float64(x)
+	}
+	mean := sum / 3
+	stddev := math.Sqrt(sqSum/3 - mean*mean)
+	if math.Abs(float64(result.Mean)-mean) > 1e-5 ||
+		math.Abs(float64(result.Stddev)-stddev) > 1e-4 {
+		t.Errorf("expected mean %f stddev %f but got %f %f", mean, stddev, result.Mean,
+			result.Stddev)
+	}
+
+	// The original sequences should not be modified.
+	for _, seq := range seqs {
+		for _, ts := range seq {
+			for _, x := range ts.Output {
+				if x != 0 {
+					t.Fatal("sequences were modified")
+				}
+			}
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	seqs := successorTestSequences(nil, &Model{BaseFeatures: 5}, 20)
+	selector := &HorizonSelector{Candidates: []int{0, 1}, NumSelected: 1, UsageWeight: 0.5}
+	cv := &CrossValidator{
+		Builder: Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			HorizonSelector: selector,
+		},
+		Loss:         Softmax{},
+		Folds:        2,
+		NumTrees:     4,
+		BaseFeatures: 5,
+		Parallelism:  2,
+	}
+	space := &SearchSpace{
+		Base:      TrainParams{MinSplitSamples: 5},
+		Depth:     IntRange{Min: 1, Max: 3},
+		Shrinkage: FloatRange{Min: 0.1, Max: 1, Log: true},
+	}
+
+	results := cv.RandomSearch(seqs, space, 5)
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results but got %d", len(results))
+	}
+	for i, r := range results {
+		if i > 0 && r.Mean < results[i-1].Mean {
+			t.Error("results are not sorted")
+		}
+		p := r.Params
+		if p.Depth < 1 || p.Depth > 3 || p.Shrinkage < 0.1 || p.Shrinkage > 1 ||
+			p.MinSplitSamples != 5 {
+			t.Errorf("unexpected params: %+v", p)
+		}
+	}
+
+	if selector.Usage != nil || selector.Selected != nil {
+		t.Error("the template horizon selector was modified")
+	}
+
+	rounds := cv.SuccessiveHalving(seqs, space, 8, 1, 2)
+	expectedSizes := []int{8, 4, 2}
+	expectedTrees := []int{1, 2, 4}
+	if len(rounds) != len(expectedSizes) {
+		t.Fatalf("expected %d rounds but got %d", len(expectedSizes), len(rounds))
+	}
+	for i, round := range rounds {
+		if len(round) != expectedSizes[i] || round[0].NumTrees != expectedTrees[i] {
+			t.Errorf("round %d: got %d results with %d trees", i, len(round), round[0].NumTrees)
+		}
+		if i > 0 {
+			for _, r := range round {
+				found := false
+				for _, prev := range rounds[i-1][:len(round)] {
+					if prev.Params == r.Params {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("round %d: params %+v were not kept from the last round", i, r.Params)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package seqtree
+
+import (
+	"math/rand"
+)
+
+// DARTNormalization specifies how DART rescales trees
+// after adding a new tree.
+type DARTNormalization int
+
+const (
+	// DARTTree weights the new tree as if it were one of
+	// the dropped trees, so that the new tree and the
+	// dropped trees together have the same scale as the
+	// dropped trees did before.
+	DARTTree DARTNormalization = iota
+
+	// DARTForest weights the new tree like the entire set
+	// of dropped trees.
+	DARTForest
+)
+
+// DART implements dropout for boosted ensembles.
+//
+// For every new tree, a random subset of the existing
+// trees is dropped when computing outputs, the new tree is
+// fit to the resulting residual, and then the new and
+// dropped trees are rescaled.
+//
+// Every iteration should call Drop(), evaluate the model
+// with EvaluateAllDropped(), build a tree on the result,
+// and then call Add() with the dropped trees.
+//
+// The scales of the trees are stored in Model.Weights.
+type DART struct {
+	// DropRate is the probability of dropping each tree.
+	DropRate float64
+
+	// MaxDrop, if non-zero, is the maximum number of trees
+	// to drop at once.
+	MaxDrop int
+
+	// SkipRate is the probability of not dropping any
+	// trees for an iteration.
+	SkipRate float64
+
+	// Normalization specifies how trees are rescaled.
+	Normalization DARTNormalization
+
+	// Rand, if non-nil, is used to choose the dropped
+	// trees. If nil, the global RNG is used.
+	Rand *rand.Rand
+}
+
+// Drop randomly selects the indices of trees to drop from
+// the model.
+//
+// If DropRate is non-zero and the model is not empty, at
+// least one tree is dropped (unless the iteration is
+// skipped).
+func (d *DART) Drop(m *Model) []int {
+	if len(m.Trees) == 0 || d.DropRate == 0 || randFloat64(d.Rand) < d.SkipRate {
+		return nil
+	}
+	var dropped []int
+	for i := range m.Trees {
+		if randFloat64(d.Rand) < d.DropRate {
+			dropped = append(dropped, i)
+		}
+	}
+	if len(dropped) == 0 {
+		dropped = []int{randIntn(d.Rand, len(m.Trees))}
+	}
+	if d.MaxDrop != 0 && len(dropped) > d.MaxDrop {
+		perm := randPerm(d.Rand, len(dropped))[:d.MaxDrop]
+		subset := make([]int, len(perm))
+		for i, j := range perm {
+			subset[i] = dropped[j]
+		}
+		dropped = subset
+	}
+	return dropped
+}
+
+// Add adds a new tree to the model and rescales the new
+// tree and the dropped trees.
+//
+// The stepSize is the step size that would be used for
+// the tree without DART, e.g. the shrinkage.
+func (d *DART) Add(m *Model, t *Tree, dropped []int, stepSize float32) {
+	k := float32(len(dropped))
+	if k == 0 {
+		m.Add(t, stepSize)
+		return
+	}
+	var newScale, droppedScale float32
+	switch d.Normalization {
+	case DARTTree:
+		newScale = stepSize / (k + stepSize)
+		droppedScale = k / (k + stepSize)
+	case DARTForest:
+		newScale = stepSize / (1 + stepSize)
+		droppedScale = 1 / (1 + stepSize)
+	default:
+		panic("unknown DART normalization")
+	}
+	for _, i := range dropped {
+		m.Reweight(i, droppedScale)
+	}
+	m.Add(t, newScale)
+}
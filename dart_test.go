@@ -0,0 +1,98 @@
+package seqtree
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestModelEvaluateDropped(t *testing.T) {
+	m := generateTestModel(5)
+	seqs := generateTestSequences(&Model{BaseFeatures: 5})
+	expectedSeqs := zeroedTestSequences(seqs)
+	m.EvaluateAllDropped(seqs, []int{1, 3})
+
+	expectedModel := &Model{BaseFeatures: 5, Trees: []*Tree{m.Trees[0], m.Trees[2]}}
+	expectedModel.EvaluateAll(expectedSeqs)
+
+	for i, seq := range seqs {
+		for j, ts := range seq {
+			expected := expectedSeqs[i][j].Output
+			for k, x := range expected {
+				if math.Abs(float64(x-ts.Output[k])) > 1e-5 {
+					t.Fatalf("expected output %v but got %v", expected, ts.Output)
+				}
+			}
+		}
+	}
+}
+
+func TestDARTAdd(t *testing.T) {
+	for _, norm := range []DARTNormalization{DARTTree, DARTForest} {
+		m := generateTestModel(5)
+		seqs := generateTestSequences(&Model{BaseFeatures: 5})
+		origSeqs := zeroedTestSequences(seqs)
+		m.EvaluateAll(seqs)
+		before := seqs[0][3].Output[2]
+
+		dart := &DART{DropRate: 1, MaxDrop: 2, Normalization: norm}
+		dropped := dart.Drop(m)
+		if len(dropped) != 2 {
+			t.Fatalf("expected 2 dropped trees but got %d", len(dropped))
+		}
+		tree := &Tree{Leaf: &Leaf{OutputDelta: make([]float32, 5)}}
+		dart.Add(m, tree, dropped, 0.5)
+
+		var expectedWeight float32
+		if norm == DARTTree {
+			expectedWeight = 2 / 2.5
+		} else {
+			expectedWeight = 1 / 1.5
+		}
+		for i, w := range m.Weights {
+			expected := float32(1)
+			if i == dropped[0] || i == dropped[1] {
+				expected = expectedWeight
+			}
+			if math.Abs(float64(w-expected)) > 1e-5 {
+				t.Errorf("norm %d: tree %d: expected weight %f but got %f", norm, i, expected, w)
+			}
+		}
+
+		// The new tree is zero, so restoring the weights
+		// should restore the original outputs.
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Model
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range dropped {
+			decoded.Weights[i] = 1
+		}
+		seqs = zeroedTestSequences(origSeqs)
+		decoded.EvaluateAll(seqs)
+		if math.Abs(float64(seqs[0][3].Output[2]-before)) > 1e-5 {
+			t.Errorf("norm %d: expected output %f but got %f", norm, before,
+				seqs[0][3].Output[2])
+		}
+	}
+}
+
+func zeroedTestSequences(seqs []Sequence) []Sequence {
+	var res []Sequence
+	for _, seq := range seqs {
+		var newSeq Sequence
+		for _, ts := range seq {
+			newSeq = append(newSeq, &Timestep{
+				Features: ts.Features,
+				Output:   make([]float32, len(ts.Output)),
+				Target:   ts.Target,
+			})
+		}
+		res = append(res, newSeq)
+	}
+	return res
+}
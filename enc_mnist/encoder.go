@@ -6,6 +6,7 @@ import (
 	"runtime"
 	"sync"
 
+	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/mnist"
 	"github.com/unixpickle/seqtree"
 )
@@ -14,19 +15,29 @@ const (
 	ImageSize = 28
 	BatchSize = 30000
 
+	// Each stage is clustered with mini-batch k-means on
+	// ClusterIters batches of ClusterBatch samples, and
+	// then fit to FitBatches batches (BatchSize samples).
+	ClusterBatch = 10000
+	ClusterIters = 100
+	FitBatches   = BatchSize / ClusterBatch
+
 	EncodingDim1    = 20
 	EncodingOptions = 16
 )
 
-func TrainEncoder(e *Encoder, ds, testDs mnist.DataSet) {
+// TrainEncoder trains the remaining stages of the encoder,
+// saving the first layer to path after every stage so that
+// training can be resumed.
+func TrainEncoder(e *Encoder, ds, testDs mnist.DataSet, path string) {
 	if len(e.Layer1.Stages) < EncodingDim1 {
-		trainEncoderLayer1(e, ds, testDs)
+		trainEncoderLayer1(e, ds, testDs, path)
 	}
 }
 
-func trainEncoderLayer1(e *Encoder, ds, testDs mnist.DataSet) {
-	sampleVecs := func(ds mnist.DataSet) [][]float32 {
-		return makeSampleVecs(ds, BatchSize, func(d mnist.Sample) []float32 {
+func trainEncoderLayer1(e *Encoder, ds, testDs mnist.DataSet, path string) {
+	sampleVecs := func(ds mnist.DataSet, n int) [][]float32 {
+		return makeSampleVecs(ds, n, func(d mnist.Sample) []float32 {
 			return encodeSigmoid(d.Intensities)
 		})
 	}
@@ -35,15 +46,16 @@ func trainEncoderLayer1(e *Encoder, ds, testDs mnist.DataSet) {
 		if len(e.Layer1.Stages) == 0 {
 			shrinkage = 1.0
 		}
-		vecs := sampleVecs(ds)
-		testVecs := sampleVecs(testDs)
-		loss := evaluateLoss(e.Layer1, vecs)
-		testLoss := evaluateLoss(e.Layer1, testVecs)
-		e.Layer1.AddStage(&seqtree.KMeans{
-			MaxIterations: 100,
-			NumClusters:   EncodingOptions,
-		}, vecs, shrinkage)
+		loss := evaluateLoss(e.Layer1, sampleVecs(ds, BatchSize))
+		testLoss := evaluateLoss(e.Layer1, sampleVecs(testDs, BatchSize))
+		e.Layer1.AddStage(&seqtree.MiniBatchKMeans{
+			NumClusters: EncodingOptions,
+			Iterations:  ClusterIters,
+		}, func() [][]float32 {
+			return sampleVecs(ds, ClusterBatch)
+		}, FitBatches, shrinkage)
 		log.Printf("layer 1: step %d: loss=%f test=%f", len(e.Layer1.Stages)-1, loss, testLoss)
+		essentials.Must(e.Layer1.Save(path))
 	}
 }
 
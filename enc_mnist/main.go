@@ -8,9 +8,11 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"time"
 
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/mnist"
+	"github.com/unixpickle/seqtree"
 )
 
 func main() {
@@ -18,27 +20,50 @@ func main() {
 	testDataset := mnist.LoadTestingDataSet()
 
 	encoder := NewEncoder()
-	encoder.Layer1.Load("encoder1.json")
+	essentials.Must(encoder.Layer1.Load("encoder1.json"))
 	encoder.Configure()
 	if encoder.NeedsTraining() {
 		log.Println("Training encoder...")
-		TrainEncoder(encoder, dataset, testDataset)
-		encoder.Layer1.Save("encoder1.json")
+		TrainEncoder(encoder, dataset, testDataset, "encoder1.json")
 	}
 	log.Println("Saving encoder reconstructions...")
 	GenerateReconstructions(testDataset, encoder)
 
 	seqModel := NewSequenceModel()
-	seqModel.Load("sequence_model.json")
-	log.Println("Training sequence model...")
+	essentials.Must(seqModel.Load("sequence_model.json"))
 	seqs := encoder.EncodeBatch(dataset, len(dataset.Samples))
 	testSeqs := encoder.EncodeBatch(testDataset, len(testDataset.Samples))
-	for i := 0; true; i++ {
-		testLoss := seqModel.MeanLoss(testSeqs)
-		loss, delta := seqModel.AddTree(seqs)
+	trainers := seqModel.Trainers("checkpoints", seqs, testSeqs)
+	for _, trainer := range trainers {
+		_, err := trainer.Resume()
+		essentials.Must(err)
+	}
+	metrics, err := seqtree.OpenMetricsFile("metrics.jsonl")
+	essentials.Must(err)
+	defer metrics.Close()
+
+	log.Println("Training sequence model...")
+	for {
+		start := time.Now()
+		var loss, delta, testLoss float32
+		for _, trainer := range trainers {
+			history, err := trainer.Run(trainer.Checkpoint().Iteration + 1)
+			essentials.Must(err)
+			m := history[len(history)-1]
+			loss += m.TrainLoss
+			delta += m.LossDelta
+			testLoss += *m.ValidLoss
+		}
 		log.Printf("tree %d: loss=%f delta=%f test=%f", seqModel.NumTrees()-1, loss, -delta,
 			testLoss)
-		seqModel.Save("sequence_model.json")
+		essentials.Must(metrics.WriteMetrics(&seqtree.IterationMetrics{
+			Iteration: seqModel.NumTrees() - 1,
+			TrainLoss: loss,
+			LossDelta: delta,
+			ValidLoss: &testLoss,
+			Seconds:   time.Since(start).Seconds(),
+		}))
+		essentials.Must(seqModel.Save("sequence_model.json"))
 		GenerateSamples(encoder, seqModel)
 	}
 }
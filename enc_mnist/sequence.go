@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 
 	"github.com/pkg/errors"
 	"github.com/unixpickle/seqtree"
@@ -29,7 +31,13 @@ func (s *SequenceModel) Save(path string) error {
 	if err != nil {
 		return errors.Wrap(err, "save model")
 	}
-	if err := ioutil.WriteFile(path, data, 0755); err != nil {
+	// Write to a temporary file first so that an
+	// interrupted save never corrupts the model.
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "save model")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
 		return errors.Wrap(err, "save model")
 	}
 	return nil
@@ -64,68 +72,66 @@ func (s *SequenceModel) Sample() []int {
 	return sample
 }
 
-func (s *SequenceModel) AddTree(intSeqs [][]int) (loss, delta float32) {
-	for _, model := range s.Models {
-		shrinkage := float32(0.1)
-		if len(model.Trees) == 0 {
-			// Take a big initial step.
-			shrinkage = 1.0
-		}
-
-		seqs := make([]seqtree.Sequence, len(intSeqs))
-		perm := rand.Perm(len(intSeqs))
-		for i, intSeq := range intSeqs {
-			seqs[perm[i]] = seqtree.Sequence{s.sampleTimestep(model, intSeq)}
+// Trainers creates a Trainer for every model, each of
+// which saves checkpoints to a subdirectory of dir.
+func (s *SequenceModel) Trainers(dir string, intSeqs, testSeqs [][]int) []*seqtree.Trainer {
+	var res []*seqtree.Trainer
+	for i, model := range s.Models {
+		model := model
+		heuristic := seqtree.HessianHeuristic{
+			Damping: 0.1,
+			Loss:    seqtree.Softmax{},
 		}
-		model.EvaluateAll(seqs)
-
-		trainSeqs := seqs[len(seqs)/2:]
-		validSeqs := seqs[:len(seqs)/2]
-
-		for _, seq := range seqs {
-			loss += seq.MeanLoss(seqtree.Softmax{})
-		}
-
-		builder := seqtree.Builder{
-			Heuristic: seqtree.HessianHeuristic{
-				Damping: 0.1,
-				Loss:    seqtree.Softmax{},
+		res = append(res, &seqtree.Trainer{
+			Model: model,
+			Builder: &seqtree.Builder{
+				Heuristic:       heuristic,
+				Depth:           5,
+				MinSplitSamples: 100,
+				Horizons:        []int{0},
+				MaxUnion:        5,
 			},
-			Depth:           5,
-			MinSplitSamples: 100,
-			Horizons:        []int{0},
-			MaxUnion:        5,
-		}
-		pruner := seqtree.Pruner{
-			Heuristic: builder.Heuristic,
-			MaxLeaves: 10,
-		}
-		tree := builder.Build(seqtree.TimestepSamples(trainSeqs))
-		tree = pruner.Prune(seqtree.TimestepSamples(validSeqs), tree)
-		seqtree.ScaleOptimalStep(seqtree.TimestepSamples(validSeqs), tree, seqtree.Softmax{},
-			40.0, 10, 30)
-		delta += seqtree.AvgLossDelta(seqtree.TimestepSamples(validSeqs), tree, seqtree.Softmax{},
-			shrinkage)
-		model.Add(tree, shrinkage)
+			Loss: seqtree.Softmax{},
+			Pruner: &seqtree.Pruner{
+				Heuristic: heuristic,
+				MaxLeaves: 10,
+			},
+			Shrinkage: func(iteration int) float32 {
+				if len(model.Trees) == 0 {
+					// Take a big initial step.
+					return 1.0
+				}
+				return 0.1
+			},
+			Train: func(m *seqtree.Model, gen *rand.Rand) []seqtree.Sequence {
+				// Every batch is a random half of the data.
+				var batch [][]int
+				for _, j := range gen.Perm(len(intSeqs))[:len(intSeqs)/2] {
+					batch = append(batch, intSeqs[j])
+				}
+				return s.sequences(m, batch)
+			},
+			Validation: func(m *seqtree.Model, gen *rand.Rand) []seqtree.Sequence {
+				return s.sequences(m, testSeqs)
+			},
+			MaxStep:        40.0,
+			MinLeafSamples: 10,
+			StepIters:      30,
+			Checkpointer: &seqtree.Checkpointer{
+				Dir: filepath.Join(dir, fmt.Sprintf("model_%02d", i)),
+			},
+			Seed: rand.Int63(),
+		})
 	}
-	loss /= float32(len(intSeqs))
-	return
+	return res
 }
 
-func (s *SequenceModel) MeanLoss(intSeqs [][]int) float32 {
-	var loss float32
-	for _, model := range s.Models {
-		seqs := make([]seqtree.Sequence, len(intSeqs))
-		for i, intSeq := range intSeqs {
-			seqs[i] = seqtree.Sequence{s.sampleTimestep(model, intSeq)}
-		}
-		model.EvaluateAll(seqs)
-
-		for _, seq := range seqs {
-			loss += seq.MeanLoss(seqtree.Softmax{})
-		}
+func (s *SequenceModel) sequences(model *seqtree.Model, intSeqs [][]int) []seqtree.Sequence {
+	seqs := make([]seqtree.Sequence, len(intSeqs))
+	for i, intSeq := range intSeqs {
+		seqs[i] = seqtree.Sequence{s.sampleTimestep(model, intSeq)}
 	}
-	return loss / float32(len(intSeqs))
+	return seqs
 }
 
 func (s *SequenceModel) sampleTimestep(model *seqtree.Model, seq []int) *seqtree.Timestep {
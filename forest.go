@@ -0,0 +1,156 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A Forest builds averaged ensembles of trees, where each
+// tree is trained on a bootstrap sample of the data with a
+// random subset of the features.
+//
+// Every tree is fit against the same initial outputs, so
+// a forest can be used as a first stage before boosting.
+type Forest struct {
+	// Builder is used to build each tree.
+	// Its FeatureMask is overridden for every tree.
+	Builder *Builder
+
+	// NumTrees is the number of trees in the forest.
+	NumTrees int
+
+	// SampleFrac is the size of each bootstrap sample,
+	// relative to the number of samples.
+	// If zero, it defaults to 1.
+	SampleFrac float64
+
+	// FeatureFrac is the fraction of features available
+	// to each tree.
+	// If zero, all of the features are used.
+	FeatureFrac float64
+
+	// Loss, if non-nil, is used to compute out-of-bag
+	// loss estimates.
+	Loss LossFunc
+
+	// Rand, if non-nil, is used to draw the bootstrap
+	// samples and feature subsets, and it overrides the
+	// Builder's Rand.
+	// If nil, the global RNG is used.
+	Rand *rand.Rand
+}
+
+// Build builds the trees of the forest.
+//
+// It also returns the out-of-bag loss: the mean loss on
+// each sample, using only the trees that were not trained
+// on it. Samples which every tree was trained on are not
+// included. If f.Loss is nil, the loss is zero.
+func (f *Forest) Build(samples []*TimestepSample) ([]*Tree, float32) {
+	if len(samples) == 0 {
+		panic("no data")
+	}
+	sampleFrac := f.SampleFrac
+	if sampleFrac == 0 {
+		sampleFrac = 1
+	}
+	numSamples := int(math.Round(sampleFrac * float64(len(samples))))
+	numFeatures := samples[0].Timestep().Features.Len()
+
+	var trees []*Tree
+	var inBag [][]bool
+	for i := 0; i < f.NumTrees; i++ {
+		bag := make([]bool, len(samples))
+		bootstrap := make([]*TimestepSample, numSamples)
+		for j := range bootstrap {
+			idx := randIntn(f.Rand, len(samples))
+			bag[idx] = true
+			bootstrap[j] = samples[idx]
+		}
+		b := *f.Builder
+		b.FeatureMask = f.featureMask(numFeatures)
+		if f.Rand != nil {
+			b.Rand = f.Rand
+		}
+		trees = append(trees, b.Build(bootstrap))
+		inBag = append(inBag, bag)
+	}
+
+	if f.Loss == nil {
+		return trees, 0
+	}
+	return trees, f.outOfBagLoss(samples, trees, inBag)
+}
+
+// Add adds the trees of a forest to a model, scaling them
+// so that their outputs are averaged.
+func (f *Forest) Add(m *Model, trees []*Tree) {
+	for _, t := range trees {
+		m.Add(t, 1/float32(len(trees)))
+	}
+}
+
+func (f *Forest) featureMask(numFeatures int) []bool {
+	if f.FeatureFrac == 0 {
+		return nil
+	}
+	num := int(math.Round(f.FeatureFrac * float64(numFeatures)))
+	// Every tree needs at least one feature to split on.
+	num = essentials.MinInt(essentials.MaxInt(num, 1), numFeatures)
+	mask := make([]bool, numFeatures)
+	for _, i := range randPerm(f.Rand, numFeatures)[:num] {
+		mask[i] = true
+	}
+	return mask
+}
+
+func (f *Forest) outOfBagLoss(samples []*TimestepSample, trees []*Tree,
+	inBag [][]bool) float32 {
+	var lock sync.Mutex
+	var totalLoss float64
+	var totalCount int
+
+	var wg sync.WaitGroup
+	numProcs := runtime.GOMAXPROCS(0)
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lossSum := newKahanSum(1)
+			var count int
+			for j := i; j < len(samples); j += numProcs {
+				sample := samples[j]
+				ts := sample.Timestep()
+				deltaSum := make([]float32, len(ts.Output))
+				var numTrees int
+				for k, t := range trees {
+					if inBag[k][j] {
+						continue
+					}
+					deltaSum = addDelta(deltaSum, t.Evaluate(sample).OutputDelta, 1)
+					numTrees++
+				}
+				if numTrees == 0 {
+					continue
+				}
+				output := addDelta(ts.Output, deltaSum, 1/float32(numTrees))
+				lossSum.Add([]float32{f.Loss.Loss(output, ts.Target)})
+				count++
+			}
+			lock.Lock()
+			totalLoss += float64(lossSum.Sum()[0])
+			totalCount += count
+			lock.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if totalCount == 0 {
+		return 0
+	}
+	return float32(totalLoss / float64(totalCount))
+}
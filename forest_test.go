@@ -0,0 +1,98 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestForest(t *testing.T) {
+	// Each token is usually one more than the previous.
+	m := &Model{BaseFeatures: 5}
+	var seqs []Sequence
+	for i := 0; i < 15; i++ {
+		seq := []int{rand.Intn(5)}
+		for j := 1; j < 20; j++ {
+			if rand.Intn(4) == 0 {
+				seq = append(seq, rand.Intn(5))
+			} else {
+				seq = append(seq, (seq[j-1]+1)%5)
+			}
+		}
+		seqs = append(seqs, MakeOneHotSequence(seq, 5, m.NumFeatures()))
+	}
+	samples := TimestepSamples(seqs)
+
+	forest := &Forest{
+		Builder: &Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			Depth:           3,
+			MinSplitSamples: 5,
+			Horizons:        []int{0, 1, 2},
+		},
+		NumTrees:    10,
+		FeatureFrac: 0.6,
+		Loss:        Softmax{},
+	}
+	trees, oobLoss := forest.Build(samples)
+	if len(trees) != forest.NumTrees {
+		t.Fatalf("expected %d trees but got %d", forest.NumTrees, len(trees))
+	}
+	initialLoss := seqs[0].MeanLoss(Softmax{})
+	if oobLoss <= 0 || oobLoss >= initialLoss {
+		t.Errorf("unexpected out-of-bag loss %f (initial loss %f)", oobLoss, initialLoss)
+	}
+
+	for _, tree := range trees {
+		checkFeatureMask(t, tree, 3)
+	}
+
+	// Adding the forest should average the trees.
+	sample := samples[7]
+	expected := make([]float32, 5)
+	for _, tree := range trees {
+		expected = addDelta(expected, tree.Evaluate(sample).OutputDelta, 0.1)
+	}
+	forest.Add(m, trees)
+	m.EvaluateAll(seqs)
+	for i, x := range expected {
+		if math.Abs(float64(x-sample.Timestep().Output[i])) > 1e-5 {
+			t.Fatalf("expected output %v but got %v", expected, sample.Timestep().Output)
+		}
+	}
+}
+
+func checkFeatureMask(t *testing.T, tree *Tree, maxFeatures int) {
+	features := map[int]bool{}
+	var addFeatures func(tree *Tree)
+	addFeatures = func(tree *Tree) {
+		if tree.Branch == nil {
+			return
+		}
+		for _, f := range tree.Branch.Feature {
+			if f.Feature != -1 {
+				features[f.Feature] = true
+			}
+		}
+		addFeatures(tree.Branch.FalseBranch)
+		addFeatures(tree.Branch.TrueBranch)
+	}
+	addFeatures(tree)
+	if len(features) > maxFeatures {
+		t.Errorf("expected at most %d features but got %d", maxFeatures, len(features))
+	}
+}
+
+func TestForestFeatureMaskMinimum(t *testing.T) {
+	forest := &Forest{FeatureFrac: 0.01}
+	mask := forest.featureMask(10)
+	var count int
+	for _, x := range mask {
+		if x {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected 1 feature but got %d", count)
+	}
+}
@@ -79,11 +79,15 @@ type HessianHeuristic struct {
 	// (e.g. 0.1) to prevent the inverse Hessian from
 	// being too large in any given direction.
 	Damping float32
+
+	// Solver, if non-nil, is used to invert the Hessian.
+	// By default, Hessian.ApplyInverse() is used.
+	Solver HessianSolver
 }
 
 func (h HessianHeuristic) SampleVector(sample *TimestepSample) []float32 {
 	ts := sample.Timestep()
-	grad := Softmax{}.LossGrad(ts.Output, ts.Target)
+	grad := h.Loss.LossGrad(ts.Output, ts.Target)
 	hess := h.Loss.LossHessian(ts.Output, ts.Target)
 	for i := 0; i < hess.Dim; i++ {
 		hess.Data[i+i*hess.Dim] += h.Damping
@@ -112,7 +116,12 @@ func (h HessianHeuristic) minimize(sum []float32) ([]float32, float32) {
 	for i, x := range grad {
 		negGrad[i] = -x
 	}
-	solution := hessian.ApplyInverse(negGrad)
+	var solution []float32
+	if h.Solver != nil {
+		solution = h.Solver.Solve(hessian, negGrad)
+	} else {
+		solution = hessian.ApplyInverse(negGrad)
+	}
 	value := vectorDot(grad, solution) + 0.5*vectorDot(solution, hessian.Apply(solution))
 	return solution, value
 }
@@ -127,6 +136,182 @@ func (h HessianHeuristic) inferDimension(vecSize int) int {
 	return x
 }
 
+// DiagonalHessianHeuristic is like HessianHeuristic, but
+// it only uses the diagonal of the Hessian.
+//
+// This uses much less memory and computation than the
+// full Hessian, at the cost of ignoring interactions
+// between outputs.
+type DiagonalHessianHeuristic struct {
+	Loss HessianLossFunc
+
+	// Damping is the L2 penalty applied to the output
+	// delta, as in HessianHeuristic.
+	Damping float32
+}
+
+func (d DiagonalHessianHeuristic) SampleVector(sample *TimestepSample) []float32 {
+	ts := sample.Timestep()
+	grad := d.Loss.LossGrad(ts.Output, ts.Target)
+	res := make([]float32, 0, len(grad)*2)
+	res = append(res, grad...)
+	if dl, ok := d.Loss.(DiagonalHessianLossFunc); ok {
+		for _, x := range dl.LossHessianDiagonal(ts.Output, ts.Target) {
+			res = append(res, x+d.Damping)
+		}
+	} else if bl, ok := d.Loss.(BlockHessianLossFunc); ok {
+		for _, block := range bl.LossHessianBlocks(ts.Output, ts.Target) {
+			for i := 0; i < block.Dim; i++ {
+				res = append(res, block.Data[i+i*block.Dim]+d.Damping)
+			}
+		}
+	} else {
+		hess := d.Loss.LossHessian(ts.Output, ts.Target)
+		for i := 0; i < hess.Dim; i++ {
+			res = append(res, hess.Data[i+i*hess.Dim]+d.Damping)
+		}
+	}
+	return res
+}
+
+func (d DiagonalHessianHeuristic) Quality(sum []float32) float32 {
+	_, v := d.minimize(sum)
+	return -v
+}
+
+func (d DiagonalHessianHeuristic) LeafOutput(sum []float32) []float32 {
+	v, _ := d.minimize(sum)
+	return v
+}
+
+func (d DiagonalHessianHeuristic) minimize(sum []float32) ([]float32, float32) {
+	if len(sum)%2 != 0 {
+		panic("invalid vector size")
+	}
+	dim := len(sum) / 2
+	grad, diag := sum[:dim], sum[dim:]
+	solution := make([]float32, dim)
+	var value float32
+	for i, g := range grad {
+		// Non-positive curvature happens for losses like
+		// Huber without damping, and there is no minimum.
+		if diag[i] > 0 {
+			solution[i] = -g / diag[i]
+			value -= 0.5 * g * g / diag[i]
+		}
+	}
+	return solution, value
+}
+
+// BlockHessianHeuristic is like HessianHeuristic, but it
+// only uses diagonal blocks of the Hessian, solving for
+// each block of outputs independently.
+//
+// For a *MultiSoftmax loss with matching Sizes, this is
+// exactly equivalent to HessianHeuristic.
+type BlockHessianHeuristic struct {
+	Loss HessianLossFunc
+
+	// Sizes is the size of each block of outputs.
+	//
+	// If nil, the loss must be a *MultiSoftmax, and its
+	// Sizes are used.
+	Sizes []int
+
+	// Damping is the L2 penalty applied to the output
+	// delta, as in HessianHeuristic.
+	Damping float32
+
+	// Solver, if non-nil, is used to invert each block,
+	// as in HessianHeuristic.
+	Solver HessianSolver
+}
+
+func (b BlockHessianHeuristic) SampleVector(sample *TimestepSample) []float32 {
+	ts := sample.Timestep()
+	sizes := b.sizes()
+	grad := b.Loss.LossGrad(ts.Output, ts.Target)
+	var blocks []*Hessian
+	if bl, ok := b.Loss.(BlockHessianLossFunc); ok && b.Sizes == nil {
+		blocks = bl.LossHessianBlocks(ts.Output, ts.Target)
+	} else {
+		blocks = extractHessianBlocks(b.Loss.LossHessian(ts.Output, ts.Target), sizes)
+	}
+	res := grad
+	for _, block := range blocks {
+		for i := 0; i < block.Dim; i++ {
+			block.Data[i+i*block.Dim] += b.Damping
+		}
+		res = append(res, block.Data...)
+	}
+	return res
+}
+
+func (b BlockHessianHeuristic) Quality(sum []float32) float32 {
+	_, v := b.minimize(sum)
+	return -v
+}
+
+func (b BlockHessianHeuristic) LeafOutput(sum []float32) []float32 {
+	v, _ := b.minimize(sum)
+	return v
+}
+
+func (b BlockHessianHeuristic) minimize(sum []float32) ([]float32, float32) {
+	sizes := b.sizes()
+	var dim, hessSize int
+	for _, size := range sizes {
+		dim += size
+		hessSize += size * size
+	}
+	if len(sum) != dim+hessSize {
+		panic("invalid vector size")
+	}
+	grad := sum[:dim]
+	hessData := sum[dim:]
+	solution := make([]float32, 0, dim)
+	var value float32
+	for _, size := range sizes {
+		blockSum := append(append([]float32{}, grad[:size]...), hessData[:size*size]...)
+		blockSolution, blockValue := HessianHeuristic{Solver: b.Solver}.minimize(blockSum)
+		solution = append(solution, blockSolution...)
+		value += blockValue
+		grad = grad[size:]
+		hessData = hessData[size*size:]
+	}
+	return solution, value
+}
+
+func (b BlockHessianHeuristic) sizes() []int {
+	if b.Sizes != nil {
+		return b.Sizes
+	}
+	if ms, ok := b.Loss.(*MultiSoftmax); ok {
+		return ms.Sizes
+	}
+	panic("Sizes must be specified for loss functions other than *MultiSoftmax")
+}
+
+// extractHessianBlocks gets the diagonal blocks of a
+// Hessian.
+func extractHessianBlocks(h *Hessian, sizes []int) []*Hessian {
+	var res []*Hessian
+	var offset int
+	for _, size := range sizes {
+		block := &Hessian{Dim: size, Data: make([]float32, size*size)}
+		for i := 0; i < size; i++ {
+			row := h.Data[offset+(offset+i)*h.Dim:]
+			copy(block.Data[i*size:(i+1)*size], row[:size])
+		}
+		res = append(res, block)
+		offset += size
+	}
+	if offset != h.Dim {
+		panic("block sizes do not match Hessian")
+	}
+	return res
+}
+
 // A PolynomialHeuristic approximates the loss function as
 // a bunch of polynomials and minimizes it exactly for
 // each split.
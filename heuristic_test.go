@@ -0,0 +1,363 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestBlockHessianHeuristic(t *testing.T) {
+	samples := heuristicTestSamples(100, 5, func(i int) []float32 {
+		return []float32{0, 0, 1, float32(i % 2), float32(1 - i%2)}
+	})
+
+	// A single block is the full Hessian.
+	testHeuristicsMatch(t, HessianHeuristic{Loss: Softmax{}, Damping: 0.1},
+		BlockHessianHeuristic{Loss: Softmax{}, Sizes: []int{5}, Damping: 0.1}, samples)
+
+	loss := &MultiSoftmax{Sizes: []int{3, 2}, Weights: []float32{1, 0.5}}
+	for _, h := range []Heuristic{
+		BlockHessianHeuristic{Loss: loss, Damping: 0.1},
+		BlockHessianHeuristic{Loss: loss, Sizes: []int{3, 2}, Damping: 0.1},
+	} {
+		sum := heuristicVectorSum(h, samples)
+		if len(sum) != 5+3*3+2*2 {
+			t.Fatalf("unexpected vector size: %d", len(sum))
+		}
+		actual := h.LeafOutput(sum)
+
+		// Each block should be solved independently, with
+		// the weight of the softmax scaling the Newton step
+		// away.
+		var offset int
+		for i, size := range loss.Sizes {
+			var blockSamples []*TimestepSample
+			for _, s := range samples {
+				ts := s.Timestep()
+				blockSamples = append(blockSamples, heuristicTestSample(
+					ts.Output[offset:offset+size],
+					ts.Target[offset:offset+size],
+				))
+			}
+			damping := 0.1 / loss.Weights[i]
+			blockHeuristic := HessianHeuristic{Loss: Softmax{}, Damping: damping}
+			expected := blockHeuristic.LeafOutput(heuristicVectorSum(blockHeuristic, blockSamples))
+			for j, x := range expected {
+				if math.Abs(float64(actual[offset+j]-x)) > 1e-3 {
+					t.Errorf("output %d: expected %f but got %f", offset+j, x, actual[offset+j])
+				}
+			}
+			offset += size
+		}
+	}
+}
+
+func TestDiagonalHessianHeuristic(t *testing.T) {
+	samples := heuristicTestSamples(100, 4, func(i int) []float32 {
+		return []float32{1, 0, float32(i % 2), 0.3}
+	})
+	h := DiagonalHessianHeuristic{Loss: Sigmoid{}, Damping: 0.1}
+	sum := heuristicVectorSum(h, samples)
+	if len(sum) != 8 {
+		t.Fatalf("unexpected vector size: %d", len(sum))
+	}
+
+	// The sigmoid Hessian is diagonal, so each output
+	// should get an exact Newton step.
+	gradSum := make([]float64, 4)
+	hessSum := make([]float64, 4)
+	for _, s := range samples {
+		ts := s.Timestep()
+		grad := Sigmoid{}.LossGrad(ts.Output, ts.Target)
+		hess := Sigmoid{}.LossHessian(ts.Output, ts.Target)
+		for i, g := range grad {
+			gradSum[i] += float64(g)
+			hessSum[i] += float64(hess.Data[i+i*hess.Dim]) + 0.1
+		}
+	}
+	actual := h.LeafOutput(sum)
+	var expectedQuality float64
+	for i, g := range gradSum {
+		expected := -g / hessSum[i]
+		expectedQuality += 0.5 * g * g / hessSum[i]
+		if math.Abs(float64(actual[i])-expected) > 1e-3 {
+			t.Errorf("output %d: expected %f but got %f", i, expected, actual[i])
+		}
+	}
+	if quality := h.Quality(sum); math.Abs(float64(quality)-expectedQuality) > 1e-3 {
+		t.Errorf("expected quality %f but got %f", expectedQuality, quality)
+	}
+
+	// With a softmax, the diagonal Hessian should still
+	// give a descent direction.
+	samples = heuristicTestSamples(100, 4, func(i int) []float32 {
+		return []float32{0, 0, 1, 0}
+	})
+	h = DiagonalHessianHeuristic{Loss: Softmax{}, Damping: 0.1}
+	output := h.LeafOutput(heuristicVectorSum(h, samples))
+	if h.Quality(heuristicVectorSum(h, samples)) <= 0 {
+		t.Error("expected positive quality")
+	}
+	var before, after float32
+	for _, s := range samples {
+		ts := s.Timestep()
+		before += Softmax{}.Loss(ts.Output, ts.Target)
+		after += Softmax{}.Loss(addDelta(ts.Output, output, 1), ts.Target)
+	}
+	if after >= before {
+		t.Errorf("loss did not decrease: %f -> %f", before, after)
+	}
+}
+
+func heuristicTestSample(output, target []float32) *TimestepSample {
+	seq := Sequence{&Timestep{Output: output, Target: target}}
+	return TimestepSamples([]Sequence{seq})[0]
+}
+
+func heuristicTestSamples(n, dim int, target func(i int) []float32) []*TimestepSample {
+	var seq Sequence
+	for i := 0; i < n; i++ {
+		output := make([]float32, dim)
+		for j := range output {
+			output[j] = float32(rand.NormFloat64())
+		}
+		seq = append(seq, &Timestep{Output: output, Target: target(i)})
+	}
+	return TimestepSamples([]Sequence{seq})
+}
+
+func heuristicVectorSum(h Heuristic, samples []*TimestepSample) []float32 {
+	sum := newKahanSum(len(h.SampleVector(samples[0])))
+	for _, s := range samples {
+		sum.Add(h.SampleVector(s))
+	}
+	return append([]float32{}, sum.Sum()...)
+}
+
+func testHeuristicsMatch(t *testing.T, expected, actual Heuristic, samples []*TimestepSample) {
+	expectedSum := heuristicVectorSum(expected, samples)
+	actualSum := heuristicVectorSum(actual, samples)
+	expectedQuality := expected.Quality(expectedSum)
+	actualQuality := actual.Quality(actualSum)
+	if math.Abs(float64(expectedQuality-actualQuality)) > 1e-3*math.Abs(float64(expectedQuality)) {
+		t.Errorf("%T: expected quality %f but got %f", actual, expectedQuality, actualQuality)
+	}
+	expectedOutput := expected.LeafOutput(expectedSum)
+	actualOutput := actual.LeafOutput(actualSum)
+	for i, x := range expectedOutput {
+		if math.Abs(float64(actualOutput[i]-x)) > 1e-3 {
+			t.Errorf("%T: output %d: expected %f but got %f", actual, i, x, actualOutput[i])
+		}
+	}
+}
+
+func TestHeuristicConformance(t *testing.T) {
+	for _, lossCase := range heuristicTestLosses() {
+		samples := make([]*TimestepSample, 200)
+		for i := range samples {
+			output, target := lossCase.Sample(i)
+			samples[i] = heuristicTestSample(output, target)
+		}
+		for _, h := range heuristicTestHeuristics(lossCase.Loss, len(samples[0].Timestep().Output)) {
+			testHeuristicConformance(t, lossCase.Name, lossCase.Loss, h, samples)
+		}
+	}
+}
+
+func testHeuristicConformance(t *testing.T, name string, loss LossFunc, h Heuristic,
+	samples []*TimestepSample) {
+	outputSize := len(samples[0].Timestep().Output)
+	vecSize := len(h.SampleVector(samples[0]))
+	for _, s := range samples {
+		if n := len(h.SampleVector(s)); n != vecSize {
+			t.Fatalf("%s: %T: inconsistent vector sizes %d and %d", name, h, vecSize, n)
+		}
+	}
+
+	sum := heuristicVectorSum(h, samples)
+	quality := h.Quality(sum)
+	output := h.LeafOutput(sum)
+	if len(output) != outputSize {
+		t.Fatalf("%s: %T: expected output size %d but got %d", name, h, outputSize, len(output))
+	}
+
+	// Duplicating every sample should double the quality
+	// without changing the output.
+	doubled := make([]float32, len(sum))
+	for i, x := range sum {
+		doubled[i] = x * 2
+	}
+	doubledQuality := h.Quality(doubled)
+	if math.Abs(float64(doubledQuality-2*quality)) > 1e-3*math.Abs(float64(quality))+1e-4 {
+		t.Errorf("%s: %T: expected doubled quality %f but got %f", name, h, 2*quality,
+			doubledQuality)
+	}
+	doubledOutput := h.LeafOutput(doubled)
+	for i, x := range output {
+		if math.Abs(float64(doubledOutput[i]-x)) > 1e-3*math.Max(1, math.Abs(float64(x))) {
+			t.Errorf("%s: %T: output %d changed from %f to %f when duplicating", name, h, i,
+				x, doubledOutput[i])
+		}
+	}
+
+	if quality <= 0 {
+		t.Errorf("%s: %T: expected positive quality but got %f", name, h, quality)
+	}
+
+	// Gradient boosting relies on a step size, so only the
+	// direction of the gradient heuristic is checked.
+	scale := float32(1)
+	if _, ok := h.(GradientHeuristic); ok {
+		scale = 0.1
+	}
+	var before, after float64
+	for _, s := range samples {
+		ts := s.Timestep()
+		before += float64(loss.Loss(ts.Output, ts.Target))
+		after += float64(loss.Loss(addDelta(ts.Output, output, scale), ts.Target))
+	}
+	if after >= before {
+		t.Errorf("%s: %T: leaf output did not lower loss: %f -> %f", name, h, before, after)
+	}
+}
+
+type heuristicTestLoss struct {
+	Name   string
+	Loss   LossFunc
+	Sample func(i int) (output, target []float32)
+}
+
+func heuristicTestLosses() []heuristicTestLoss {
+	normal := func(n int, mean float32) []float32 {
+		res := make([]float32, n)
+		for i := range res {
+			res[i] = float32(rand.NormFloat64()) + mean
+		}
+		return res
+	}
+	oneHot := func(sizes ...int) []float32 {
+		var res []float32
+		for _, size := range sizes {
+			vec := make([]float32, size)
+			if rand.Intn(2) == 0 {
+				vec[0] = 1
+			} else {
+				vec[rand.Intn(size)] = 1
+			}
+			res = append(res, vec...)
+		}
+		return res
+	}
+	bits := func(n int) []float32 {
+		res := make([]float32, n)
+		for i := range res {
+			if rand.Intn(3) != 0 {
+				res[i] = 1
+			}
+		}
+		return res
+	}
+	classification := func(name string, l LossFunc, target func() []float32) heuristicTestLoss {
+		return heuristicTestLoss{
+			Name: name,
+			Loss: l,
+			Sample: func(i int) ([]float32, []float32) {
+				t := target()
+				return normal(len(t), 0), t
+			},
+		}
+	}
+	multi := &MultiSoftmax{Sizes: []int{3, 2}, Weights: []float32{1, 0.5}}
+	return []heuristicTestLoss{
+		classification("softmax", Softmax{}, func() []float32 { return oneHot(4) }),
+		classification("multi_softmax", multi, func() []float32 { return oneHot(3, 2) }),
+		classification("sigmoid", Sigmoid{}, func() []float32 { return bits(3) }),
+		classification("label_smoothing", &LabelSmoothing{Base: Softmax{}, Epsilon: 0.1},
+			func() []float32 { return oneHot(4) }),
+		classification("class_weights", &ClassWeights{Base: multi,
+			Weights: []float32{2, 1, 1, 0.5, 1}}, func() []float32 { return oneHot(3, 2) }),
+		classification("focal", &Focal{Base: Sigmoid{}, Gamma: 2},
+			func() []float32 { return bits(3) }),
+		{
+			Name: "mse",
+			Loss: MSE{},
+			Sample: func(i int) ([]float32, []float32) {
+				return normal(2, 0), normal(2, 1)
+			},
+		},
+		{
+			Name: "gaussian",
+			Loss: Gaussian{},
+			Sample: func(i int) ([]float32, []float32) {
+				return append(normal(2, 0), 0.5, -0.5), normal(2, 1)
+			},
+		},
+		{
+			Name: "pseudo_huber",
+			Loss: PseudoHuber{Delta: 1},
+			Sample: func(i int) ([]float32, []float32) {
+				return normal(2, 0), normal(2, 1)
+			},
+		},
+		{
+			Name: "huber",
+			Loss: Huber{Delta: 1},
+			Sample: func(i int) ([]float32, []float32) {
+				return normal(2, 0), normal(2, 1)
+			},
+		},
+		{
+			Name: "pinball",
+			Loss: Pinball{Quantile: 0.8},
+			Sample: func(i int) ([]float32, []float32) {
+				return normal(2, 0), normal(2, 1)
+			},
+		},
+		{
+			Name: "multi_quantile",
+			Loss: &MultiQuantile{Quantiles: []float32{0.1, 0.5, 0.9}},
+			Sample: func(i int) ([]float32, []float32) {
+				return normal(6, 0), normal(2, 1)
+			},
+		},
+		{
+			Name: "logistic_mixture",
+			Loss: &LogisticMixture{NumComponents: 2},
+			Sample: func(i int) ([]float32, []float32) {
+				return normal(6, 0), []float32{rand.Float32()}
+			},
+		},
+		{
+			Name: "numerical",
+			Loss: &NumericalLoss{Base: lossOnly{MSE{}}},
+			Sample: func(i int) ([]float32, []float32) {
+				return normal(2, 0), normal(2, 1)
+			},
+		},
+	}
+}
+
+// heuristicTestHeuristics creates every heuristic which is
+// compatible with the loss.
+func heuristicTestHeuristics(l LossFunc, outputSize int) []Heuristic {
+	var res []Heuristic
+	if gl, ok := l.(GradLossFunc); ok {
+		res = append(res, GradientHeuristic{Loss: gl})
+	}
+	if hl, ok := l.(HessianLossFunc); ok {
+		sizes := []int{outputSize / 2, outputSize - outputSize/2}
+		if _, ok := l.(*MultiSoftmax); ok {
+			sizes = nil
+		}
+		res = append(res,
+			HessianHeuristic{Loss: hl, Damping: 0.1},
+			HessianHeuristic{Loss: hl, Damping: 0.1, Solver: CholeskySolver{}},
+			DiagonalHessianHeuristic{Loss: hl, Damping: 0.1},
+			BlockHessianHeuristic{Loss: hl, Sizes: sizes, Damping: 0.1},
+		)
+	}
+	if pl, ok := l.(PolynomialLossFunc); ok {
+		res = append(res, PolynomialHeuristic{Loss: pl})
+	}
+	return res
+}
@@ -0,0 +1,198 @@
+package seqtree
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A HorizonSelector chooses which horizons a Builder
+// should use for each tree.
+//
+// Every candidate horizon is scored by the quality of the
+// best split it offers at the root of the tree, and the
+// highest scoring horizons are kept.
+// Optionally, horizons which were actually used by
+// previous trees can be favored.
+type HorizonSelector struct {
+	// Candidates is the set of horizons to choose from.
+	Candidates []int
+
+	// NumSelected is the number of horizons to use for
+	// each tree.
+	NumSelected int
+
+	// MaxSamples is the maximum number of samples to use
+	// when scoring candidates. If it is zero, all of the
+	// samples are used.
+	//
+	// Builder.BuildSource requires a non-zero MaxSamples,
+	// since it cannot keep every sample in memory.
+	MaxSamples int
+
+	// UsageWeight, if non-zero, adapts the selection
+	// across trees. It is the weight of a horizon's usage
+	// statistic relative to its normalized split quality,
+	// which is between 0 and 1.
+	UsageWeight float32
+
+	// UsageDecay is the factor by which usage statistics
+	// decay with every new tree.
+	// If zero, it defaults to 0.9.
+	UsageDecay float32
+
+	// Usage maps horizons to a running average of the
+	// fraction of branch features which used them.
+	Usage map[int]float32
+
+	// Selected is the set of horizons chosen for the most
+	// recently built tree, sorted in ascending order.
+	Selected []int
+
+	// Scores maps every candidate horizon to its score
+	// from the most recent selection.
+	Scores map[int]float32
+
+	lock sync.Mutex
+}
+
+// RecordUsage updates the usage statistics of the horizons
+// based on the branches of a tree.
+//
+// This is called automatically by Builder.
+func (h *HorizonSelector) RecordUsage(t *Tree) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	counts := map[int]int{}
+	var total int
+	var countBranches func(t *Tree)
+	countBranches = func(t *Tree) {
+		if t.Leaf != nil {
+			return
+		}
+		features := t.Branch.Feature
+		if t.Branch.Formula != nil {
+			features = t.Branch.Formula.Features()
+		}
+		for _, f := range features {
+			if !f.Is2D() {
+				counts[f.StepsInPast]++
+			}
+			total++
+		}
+		countBranches(t.Branch.FalseBranch)
+		countBranches(t.Branch.TrueBranch)
+	}
+	countBranches(t)
+
+	decay := h.UsageDecay
+	if decay == 0 {
+		decay = 0.9
+	}
+	if h.Usage == nil {
+		h.Usage = map[int]float32{}
+	}
+	for _, horizon := range h.Candidates {
+		var frac float32
+		if total > 0 {
+			frac = float32(counts[horizon]) / float32(total)
+		}
+		h.Usage[horizon] = decay*h.Usage[horizon] + (1-decay)*frac
+	}
+}
+
+// usageCopy copies the usage statistics.
+func (h *HorizonSelector) usageCopy() map[int]float32 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return copyHorizonMap(h.Usage)
+}
+
+// setUsage replaces the usage statistics.
+func (h *HorizonSelector) setUsage(usage map[int]float32) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.Usage = usage
+}
+
+// clone creates a deep copy of the selector, so that the
+// copy can be used by a separate Builder.
+func (h *HorizonSelector) clone() *HorizonSelector {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return &HorizonSelector{
+		Candidates:  append([]int(nil), h.Candidates...),
+		NumSelected: h.NumSelected,
+		MaxSamples:  h.MaxSamples,
+		UsageWeight: h.UsageWeight,
+		UsageDecay:  h.UsageDecay,
+		Usage:       copyHorizonMap(h.Usage),
+		Selected:    append([]int(nil), h.Selected...),
+		Scores:      copyHorizonMap(h.Scores),
+	}
+}
+
+// selectHorizons scores the candidates on the samples and
+// picks the best ones.
+func (h *HorizonSelector) selectHorizons(b *Builder, samples []vecSample) []int {
+	if len(h.Candidates) == 0 {
+		panic("no candidate horizons")
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	splitSamples, _ := subsampleLimit(b.Rand, samples, h.MaxSamples)
+
+	b1 := *b
+	b1.Horizons = h.Candidates
+	b1.Offsets = nil
+	b1.HorizonSelector = nil
+	features, qualities := b1.sortFeatures(splitSamples, nil, 1)
+
+	// Features are sorted, so the first occurrence of each
+	// horizon is its best split.
+	bestQualities := map[int]float32{}
+	var maxQuality float32
+	for i, f := range features {
+		if _, ok := bestQualities[f.StepsInPast]; !ok {
+			bestQualities[f.StepsInPast] = qualities[i]
+			if qualities[i] > maxQuality {
+				maxQuality = qualities[i]
+			}
+		}
+	}
+
+	h.Scores = map[int]float32{}
+	candidates := append([]int{}, h.Candidates...)
+	scores := make([]float32, len(candidates))
+	for i, horizon := range candidates {
+		var score float32
+		if maxQuality > 0 {
+			score = bestQualities[horizon] / maxQuality
+		}
+		score += h.UsageWeight * h.Usage[horizon]
+		scores[i] = score
+		h.Scores[horizon] = score
+	}
+	essentials.VoodooSort(scores, func(i, j int) bool {
+		return scores[i] > scores[j]
+	}, candidates)
+
+	num := essentials.MinInt(essentials.MaxInt(h.NumSelected, 1), len(candidates))
+	h.Selected = append([]int{}, candidates[:num]...)
+	sort.Ints(h.Selected)
+	return h.Selected
+}
+
+func copyHorizonMap(m map[int]float32) map[int]float32 {
+	if m == nil {
+		return nil
+	}
+	res := make(map[int]float32, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
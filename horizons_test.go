@@ -0,0 +1,75 @@
+package seqtree
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestHorizonSelector(t *testing.T) {
+	seqs := horizonTestSequences()
+	selector := &HorizonSelector{
+		Candidates:  []int{0, 1, 2, 3, 4, 5},
+		NumSelected: 1,
+		UsageWeight: 0.5,
+	}
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           2,
+		MinSplitSamples: 10,
+		HorizonSelector: selector,
+	}
+	for i := 0; i < 3; i++ {
+		b.Build(TimestepSamples(seqs))
+		if !reflect.DeepEqual(selector.Selected, []int{2}) {
+			t.Fatalf("unexpected selection: %v", selector.Selected)
+		}
+	}
+	if selector.Usage[2] <= selector.Usage[0] {
+		t.Errorf("unexpected usage statistics: %v", selector.Usage)
+	}
+}
+
+func TestHorizonSelectorSource(t *testing.T) {
+	seqs := horizonTestSequences()
+	src := SequenceChunks{seqs[:20], seqs[20:35], seqs[35:]}
+	selector := &HorizonSelector{
+		Candidates:  []int{0, 1, 2, 3, 4, 5},
+		NumSelected: 1,
+	}
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           2,
+		MinSplitSamples: 10,
+		HorizonSelector: selector,
+	}
+	if _, err := b.BuildSource(src); err == nil {
+		t.Fatal("expected error without MaxSamples")
+	}
+	selector.MaxSamples = 300
+	if _, err := b.BuildSource(src); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(selector.Selected, []int{2}) {
+		t.Errorf("unexpected selection: %v", selector.Selected)
+	}
+}
+
+func horizonTestSequences() []Sequence {
+	m := &Model{BaseFeatures: 2}
+	var seqs []Sequence
+	for i := 0; i < 50; i++ {
+		// Every value is a copy of the value three steps
+		// before it, which is at horizon 2.
+		seq := make([]int, 20)
+		for j := range seq {
+			if j < 3 {
+				seq[j] = rand.Intn(2)
+			} else {
+				seq[j] = seq[j-3]
+			}
+		}
+		seqs = append(seqs, MakeOneHotSequence(seq, 2, m.NumFeatures()))
+	}
+	return seqs
+}
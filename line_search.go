@@ -0,0 +1,570 @@
+package seqtree
+
+import (
+	"math"
+	"runtime"
+	"sync"
+)
+
+const (
+	defaultLineTolerance = 1e-4
+	defaultLineIters     = 100
+	maxBracketExpansions = 50
+	lineFiniteDiffEps    = 1e-3
+)
+
+// A LineFunc is a function of a step size, which is to be
+// minimized by a LineSearch.
+type LineFunc interface {
+	Loss(step float32) float32
+}
+
+// A LineDerivFunc is a LineFunc that can compute its own
+// derivatives with respect to the step size.
+type LineDerivFunc interface {
+	LineFunc
+
+	// Derivs computes the first and second derivatives of
+	// the loss at the given step size.
+	Derivs(step float32) (float32, float32)
+}
+
+// A LineSlopeFunc is a LineFunc that can compute its own
+// first derivative with respect to the step size, which
+// may be much cheaper than computing both derivatives.
+type LineSlopeFunc interface {
+	LineFunc
+
+	// Slope computes the first derivative of the loss at
+	// the given step size.
+	Slope(step float32) float32
+}
+
+// A LineSearch finds a step size which minimizes a
+// LineFunc.
+type LineSearch interface {
+	Minimize(f LineFunc) float32
+}
+
+// GoldenSection is a LineSearch that uses golden-section
+// search, after expanding the initial bracket until it
+// contains a minimum.
+type GoldenSection struct {
+	// Min and Max are the initial bracket.
+	// If both are 0, the bracket [0, 1] is used.
+	Min float32
+	Max float32
+
+	// FixedBracket, if true, prevents the bracket from
+	// being expanded beyond [Min, Max].
+	FixedBracket bool
+
+	// Tolerance is the bracket size at which to stop,
+	// relative to the magnitude of the step.
+	// If 0, a default is used.
+	Tolerance float32
+
+	// MaxIters is the maximum number of iterations after
+	// bracketing. If 0, a default is used.
+	MaxIters int
+}
+
+func (g *GoldenSection) Minimize(f LineFunc) float32 {
+	a, b, c, fb := lineBracket(f, g.Min, g.Max, g.FixedBracket)
+	tol := lineTolerance(g.Tolerance)
+	iters := lineIters(g.MaxIters)
+
+	invPhi := 1 / math.Phi
+	x, fx := b, fb
+	for i := 0; i < iters && c-a > tol*(1+math.Abs(x)); i++ {
+		// Probe the larger of the two sub-intervals.
+		var probe float64
+		if c-x > x-a {
+			probe = x + (1-invPhi)*(c-x)
+		} else {
+			probe = x - (1-invPhi)*(x-a)
+		}
+		fp := float64(f.Loss(float32(probe)))
+		if fp < fx {
+			if probe > x {
+				a = x
+			} else {
+				c = x
+			}
+			x, fx = probe, fp
+		} else {
+			if probe > x {
+				c = probe
+			} else {
+				a = probe
+			}
+		}
+	}
+	return float32(x)
+}
+
+// Brent is a LineSearch that uses Brent's method, which
+// combines parabolic interpolation with golden-section
+// steps, after expanding the initial bracket until it
+// contains a minimum.
+//
+// For smooth losses, this typically converges in far
+// fewer evaluations than GoldenSection.
+type Brent struct {
+	// Min and Max are the initial bracket.
+	// If both are 0, the bracket [0, 1] is used.
+	Min float32
+	Max float32
+
+	// FixedBracket, if true, prevents the bracket from
+	// being expanded beyond [Min, Max].
+	FixedBracket bool
+
+	// Tolerance is the bracket size at which to stop,
+	// relative to the magnitude of the step.
+	// If 0, a default is used.
+	Tolerance float32
+
+	// MaxIters is the maximum number of iterations after
+	// bracketing. If 0, a default is used.
+	MaxIters int
+}
+
+func (b *Brent) Minimize(f LineFunc) float32 {
+	// Based on the algorithm in Numerical Recipes.
+	lo, x, hi, fx := lineBracket(f, b.Min, b.Max, b.FixedBracket)
+	tol := lineTolerance(b.Tolerance)
+	iters := lineIters(b.MaxIters)
+
+	const goldenRatio = 0.3819660
+	w, v := x, x
+	fw, fv := fx, fx
+	var d, e float64
+	for i := 0; i < iters; i++ {
+		mid := (lo + hi) / 2
+		tol1 := tol*math.Abs(x) + 1e-10
+		tol2 := 2 * tol1
+		if math.Abs(x-mid) <= tol2-(hi-lo)/2 {
+			break
+		}
+		useGolden := true
+		if math.Abs(e) > tol1 {
+			// Try a parabolic fit through x, v, and w.
+			r := (x - w) * (fx - fv)
+			q := (x - v) * (fx - fw)
+			p := (x-v)*q - (x-w)*r
+			q = 2 * (q - r)
+			if q > 0 {
+				p = -p
+			}
+			q = math.Abs(q)
+			oldE := e
+			e = d
+			if math.Abs(p) < math.Abs(q*oldE/2) && p > q*(lo-x) && p < q*(hi-x) {
+				d = p / q
+				u := x + d
+				if u-lo < tol2 || hi-u < tol2 {
+					d = math.Copysign(tol1, mid-x)
+				}
+				useGolden = false
+			}
+		}
+		if useGolden {
+			if x >= mid {
+				e = lo - x
+			} else {
+				e = hi - x
+			}
+			d = goldenRatio * e
+		}
+		var u float64
+		if math.Abs(d) >= tol1 {
+			u = x + d
+		} else {
+			u = x + math.Copysign(tol1, d)
+		}
+		fu := float64(f.Loss(float32(u)))
+		if fu <= fx {
+			if u >= x {
+				lo = x
+			} else {
+				hi = x
+			}
+			v, w, x = w, x, u
+			fv, fw, fx = fw, fx, fu
+		} else {
+			if u < x {
+				lo = u
+			} else {
+				hi = u
+			}
+			if fu <= fw || w == x {
+				v, w = w, u
+				fv, fw = fw, fu
+			} else if fu <= fv || v == x || v == w {
+				v, fv = u, fu
+			}
+		}
+	}
+	return float32(x)
+}
+
+// Newton is a LineSearch that uses Newton's method, with
+// backtracking to guarantee that each step decreases the
+// loss.
+//
+// If the LineFunc does not implement LineDerivFunc, the
+// derivatives are approximated with finite differences.
+type Newton struct {
+	// Init is the initial step size.
+	Init float32
+
+	// Tolerance is the change in step size at which to
+	// stop, relative to the magnitude of the step.
+	// If 0, a default is used.
+	Tolerance float32
+
+	// MaxIters is the maximum number of Newton steps.
+	// If 0, 20 is used.
+	MaxIters int
+}
+
+func (n *Newton) Minimize(f LineFunc) float32 {
+	tol := lineTolerance(n.Tolerance)
+	iters := n.MaxIters
+	if iters == 0 {
+		iters = 20
+	}
+	x := float64(n.Init)
+	fx := float64(f.Loss(float32(x)))
+	for i := 0; i < iters; i++ {
+		d1, d2 := lineDerivs(f, float32(x))
+		var delta float64
+		if d2 > 0 {
+			delta = -float64(d1) / float64(d2)
+		} else {
+			// Without positive curvature, the Newton step
+			// is meaningless, so use a gradient step.
+			delta = -float64(d1)
+		}
+		if delta == 0 || math.IsNaN(delta) {
+			break
+		}
+		accepted := false
+		for j := 0; j < 30; j++ {
+			fNew := float64(f.Loss(float32(x + delta)))
+			if fNew <= fx {
+				x += delta
+				fx = fNew
+				accepted = true
+				break
+			}
+			delta /= 2
+		}
+		if !accepted || math.Abs(delta) <= tol*(1+math.Abs(x)) {
+			break
+		}
+	}
+	return float32(x)
+}
+
+// FixedGoldenSection is a LineSearch that runs a fixed
+// number of golden-section iterations within [Min, Max],
+// without ever expanding the bracket.
+//
+// This is the search used by OptimalStep and
+// ScaleOptimalStep.
+type FixedGoldenSection struct {
+	Min   float32
+	Max   float32
+	Iters int
+}
+
+func (g *FixedGoldenSection) Minimize(f LineFunc) float32 {
+	return minimizeUnary(g.Min, g.Max, g.Iters, f.Loss)
+}
+
+// Armijo is a LineSearch that uses backtracking until the
+// Armijo sufficient decrease condition is satisfied.
+//
+// If the initial step is accepted, the step is expanded
+// for as long as the condition holds and the loss keeps
+// decreasing.
+// If the loss increases in the positive direction, the
+// search is performed in the negative direction.
+//
+// If the LineFunc does not implement LineSlopeFunc, the
+// slope is approximated with finite differences.
+type Armijo struct {
+	// Init is the initial step size.
+	// If 0, 1 is used.
+	Init float32
+
+	// Shrink is the factor by which to shrink the step
+	// after every failed attempt.
+	// If 0, 0.5 is used.
+	Shrink float32
+
+	// Decrease is the fraction of the linear decrease
+	// predicted by the slope which must be achieved.
+	// If 0, 1e-4 is used.
+	Decrease float32
+
+	// MaxIters is the maximum number of shrinking or
+	// expanding steps. If 0, 30 is used.
+	MaxIters int
+}
+
+func (a *Armijo) Minimize(f LineFunc) float32 {
+	step := float64(a.Init)
+	if step == 0 {
+		step = 1
+	}
+	shrink := float64(a.Shrink)
+	if shrink == 0 {
+		shrink = 0.5
+	}
+	decrease := float64(a.Decrease)
+	if decrease == 0 {
+		decrease = 1e-4
+	}
+	iters := a.MaxIters
+	if iters == 0 {
+		iters = 30
+	}
+
+	f0 := float64(f.Loss(0))
+	slope := lineSlope(f, 0)
+	if slope == 0 {
+		return 0
+	}
+	if slope > 0 {
+		step = -step
+	}
+	accept := func(s float64) (bool, float64) {
+		fs := float64(f.Loss(float32(s)))
+		return fs <= f0+decrease*s*float64(slope), fs
+	}
+
+	ok, fs := accept(step)
+	if !ok {
+		for i := 0; i < iters; i++ {
+			step *= shrink
+			if ok, _ = accept(step); ok {
+				return float32(step)
+			}
+		}
+		return 0
+	}
+	for i := 0; i < iters; i++ {
+		next := step / shrink
+		nextOk, fNext := accept(next)
+		if !nextOk || fNext >= fs {
+			break
+		}
+		step, fs = next, fNext
+	}
+	return float32(step)
+}
+
+// lineBracket finds a triple a < b < c such that f(b) is
+// no greater than f(a) or f(c), expanding [minX, maxX] in
+// the downhill direction if necessary.
+func lineBracket(f LineFunc, minX, maxX float32, fixed bool) (a, b, c, fb float64) {
+	a, c = float64(minX), float64(maxX)
+	if a == 0 && c == 0 {
+		c = 1
+	}
+	b = (a + c) / 2
+	fa := float64(f.Loss(float32(a)))
+	fb = float64(f.Loss(float32(b)))
+	fc := float64(f.Loss(float32(c)))
+	if fixed {
+		// Start from the best point, which is not always
+		// the middle.
+		if fa < fb && fa <= fc {
+			return a, a, c, fa
+		} else if fc < fb {
+			return a, c, c, fc
+		}
+		return a, b, c, fb
+	}
+	for i := 0; i < maxBracketExpansions && (fa < fb || fc < fb); i++ {
+		if fc < fb {
+			// Move the bracket towards larger steps.
+			a, fa = b, fb
+			b, fb = c, fc
+			c = b + math.Phi*(b-a)
+			fc = float64(f.Loss(float32(c)))
+		} else {
+			c, fc = b, fb
+			b, fb = a, fa
+			a = b - math.Phi*(c-b)
+			fa = float64(f.Loss(float32(a)))
+		}
+	}
+	return
+}
+
+// lineDerivs computes the derivatives of f, using finite
+// differences if f is not a LineDerivFunc.
+func lineDerivs(f LineFunc, x float32) (float32, float32) {
+	if df, ok := f.(LineDerivFunc); ok {
+		return df.Derivs(x)
+	}
+	h := float32(lineFiniteDiffEps) * (1 + float32(math.Abs(float64(x))))
+	fMinus := float64(f.Loss(x - h))
+	f0 := float64(f.Loss(x))
+	fPlus := float64(f.Loss(x + h))
+	hh := float64(h)
+	return float32((fPlus - fMinus) / (2 * hh)), float32((fPlus - 2*f0 + fMinus) / (hh * hh))
+}
+
+// lineSlope computes the first derivative of f, using
+// finite differences if f is not a LineSlopeFunc.
+func lineSlope(f LineFunc, x float32) float32 {
+	if sf, ok := f.(LineSlopeFunc); ok {
+		return sf.Slope(x)
+	}
+	h := float32(lineFiniteDiffEps) * (1 + float32(math.Abs(float64(x))))
+	fMinus := float64(f.Loss(x - h))
+	fPlus := float64(f.Loss(x + h))
+	return float32((fPlus - fMinus) / (2 * float64(h)))
+}
+
+func lineTolerance(tol float32) float64 {
+	if tol == 0 {
+		return defaultLineTolerance
+	}
+	return float64(tol)
+}
+
+func lineIters(iters int) int {
+	if iters == 0 {
+		return defaultLineIters
+	}
+	return iters
+}
+
+// OptimalStepSearch is like OptimalStep, but it uses an
+// arbitrary LineSearch, allowing for negative steps and
+// steps of any size.
+func OptimalStepSearch(timesteps []*TimestepSample, t *Tree, l LossFunc,
+	search LineSearch) float32 {
+	f := &stepLineFunc{LossFunc: l}
+	for _, ts := range timesteps {
+		timestep := ts.Timestep()
+		f.Outputs = append(f.Outputs, timestep.Output)
+		f.Targets = append(f.Targets, timestep.Target)
+		f.Deltas = append(f.Deltas, t.Evaluate(ts).OutputDelta)
+	}
+	return search.Minimize(f.lineFunc())
+}
+
+// ScaleOptimalStepSearch is like ScaleOptimalStep, but it
+// uses an arbitrary LineSearch to scale each leaf.
+func ScaleOptimalStepSearch(timesteps []*TimestepSample, t *Tree, l LossFunc,
+	search LineSearch, minLeafSamples int) {
+	leafToFunc := map[*Leaf]*stepLineFunc{}
+	for _, ts := range timesteps {
+		leaf := t.Evaluate(ts)
+		f, ok := leafToFunc[leaf]
+		if !ok {
+			f = &stepLineFunc{LossFunc: l}
+			leafToFunc[leaf] = f
+		}
+		timestep := ts.Timestep()
+		f.Outputs = append(f.Outputs, timestep.Output)
+		f.Targets = append(f.Targets, timestep.Target)
+		f.Deltas = append(f.Deltas, leaf.OutputDelta)
+	}
+	for leaf, f := range leafToFunc {
+		if len(f.Outputs) < minLeafSamples {
+			continue
+		}
+		scale := search.Minimize(f.lineFunc())
+		for i, x := range leaf.OutputDelta {
+			leaf.OutputDelta[i] = x * scale
+		}
+	}
+}
+
+// stepLineFunc is a LineFunc for the total loss after
+// adding scaled deltas to outputs.
+type stepLineFunc struct {
+	LossFunc LossFunc
+	Outputs  [][]float32
+	Targets  [][]float32
+	Deltas   [][]float32
+}
+
+// lineFunc wraps the function in a LineDerivFunc if the
+// loss supports gradients.
+func (s *stepLineFunc) lineFunc() LineFunc {
+	if _, ok := s.LossFunc.(GradLossFunc); ok {
+		return stepLineDerivFunc{s}
+	}
+	return s
+}
+
+func (s *stepLineFunc) Loss(step float32) float32 {
+	return float32(s.sum(func(output, target, delta []float32) float64 {
+		return float64(s.LossFunc.Loss(addDelta(output, delta, step), target))
+	}))
+}
+
+func (s *stepLineFunc) sum(f func(output, target, delta []float32) float64) float64 {
+	var lock sync.Mutex
+	var result float64
+
+	var wg sync.WaitGroup
+	numProcs := runtime.GOMAXPROCS(0)
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var total float64
+			for j := i; j < len(s.Outputs); j += numProcs {
+				total += f(s.Outputs[j], s.Targets[j], s.Deltas[j])
+			}
+			lock.Lock()
+			result += total
+			lock.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	return result
+}
+
+type stepLineDerivFunc struct {
+	*stepLineFunc
+}
+
+// Slope computes the exact first derivative.
+func (s stepLineDerivFunc) Slope(step float32) float32 {
+	return float32(s.slope(step))
+}
+
+// Derivs computes the exact first derivative, and the
+// exact second derivative if the loss is a
+// HessianLossFunc.
+func (s stepLineDerivFunc) Derivs(step float32) (float32, float32) {
+	hl, hasHessian := s.LossFunc.(HessianLossFunc)
+	d1 := s.slope(step)
+	if hasHessian {
+		d2 := s.sum(func(output, target, delta []float32) float64 {
+			h := hl.LossHessian(addDelta(output, delta, step), target)
+			return float64(vectorDot(delta, h.Apply(delta)))
+		})
+		return float32(d1), float32(d2)
+	}
+	eps := float32(lineFiniteDiffEps) * (1 + float32(math.Abs(float64(step))))
+	return float32(d1), float32((s.slope(step+eps) - d1) / float64(eps))
+}
+
+func (s stepLineDerivFunc) slope(step float32) float64 {
+	gl := s.LossFunc.(GradLossFunc)
+	return s.sum(func(output, target, delta []float32) float64 {
+		return float64(vectorDot(gl.LossGrad(addDelta(output, delta, step), target), delta))
+	})
+}
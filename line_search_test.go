@@ -0,0 +1,157 @@
+package seqtree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLineSearches(t *testing.T) {
+	funcs := []struct {
+		Name    string
+		F       LineFunc
+		Minimum float32
+	}{
+		{"Inside", &testLineFunc{Center: 0.3}, 0.3},
+		{"Beyond", &testLineFunc{Center: 7.5}, 7.5},
+		{"Negative", &testLineFunc{Center: -2}, -2},
+		{"Derivs", testLineDerivFunc{&testLineFunc{Center: 3}}, 3},
+	}
+	for _, f := range funcs {
+		for _, search := range testLineSearches() {
+			actual := search.Minimize(f.F)
+			tolerance := 1e-2
+			if _, ok := search.(*Armijo); ok {
+				// Armijo only guarantees sufficient decrease.
+				tolerance = math.Abs(float64(f.Minimum))/2 + 0.5
+			}
+			if math.Abs(float64(actual-f.Minimum)) > tolerance {
+				t.Errorf("%s: %T: expected %f but got %f", f.Name, search, f.Minimum, actual)
+			}
+		}
+	}
+}
+
+func TestLineSearchFixedBracket(t *testing.T) {
+	f := &testLineFunc{Center: 7.5}
+	for _, search := range []LineSearch{
+		&GoldenSection{Max: 2, FixedBracket: true},
+		&Brent{Max: 2, FixedBracket: true},
+	} {
+		if actual := search.Minimize(f); math.Abs(float64(actual-2)) > 1e-2 {
+			t.Errorf("%T: expected 2 but got %f", search, actual)
+		}
+	}
+}
+
+func TestLineSearchEvaluations(t *testing.T) {
+	golden := &testLineFunc{Center: 0.7}
+	(&GoldenSection{}).Minimize(golden)
+	brent := &testLineFunc{Center: 0.7}
+	(&Brent{}).Minimize(brent)
+	newton := &testLineFunc{Center: 0.7}
+	(&Newton{}).Minimize(testLineDerivFunc{newton})
+	if brent.Evals >= golden.Evals {
+		t.Errorf("expected Brent (%d evals) to beat golden section (%d evals)",
+			brent.Evals, golden.Evals)
+	}
+	if newton.Evals > 10 {
+		t.Errorf("expected Newton to use few evaluations but got %d", newton.Evals)
+	}
+}
+
+func TestArmijoSlope(t *testing.T) {
+	f := testLineSlopeFunc{&testLineFunc{Center: 3}}
+	if actual := (&Armijo{}).Minimize(f); actual <= 0 || actual > 6 {
+		t.Errorf("unexpected step %f", actual)
+	}
+}
+
+func TestOptimalStepSearch(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		m := generateTestModel(5)
+		b := &Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			Depth:           3,
+			MinSplitSamples: 10,
+			Horizons:        []int{0, 1, 2},
+		}
+		ts := TimestepSamples(generateTestSequences(m))
+		tree := b.Build(ts)
+		expected := OptimalStep(ts, tree, Softmax{}, 40.0, 100)
+		expectedLoss := AvgLossDelta(ts, tree, Softmax{}, expected)
+		for _, search := range testLineSearches() {
+			actual := OptimalStepSearch(ts, tree, Softmax{}, search)
+			actualLoss := AvgLossDelta(ts, tree, Softmax{}, actual)
+			tolerance := 1e-4
+			if _, ok := search.(*Armijo); ok {
+				tolerance = 0.5 * math.Abs(float64(expectedLoss))
+			}
+			if float64(actualLoss-expectedLoss) > tolerance {
+				t.Errorf("%T: step %f (loss=%f) is worse than %f (loss=%f)", search, actual,
+					actualLoss, expected, expectedLoss)
+			}
+		}
+	}
+}
+
+func TestScaleOptimalStepSearch(t *testing.T) {
+	m := generateTestModel(5)
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           2,
+		MinSplitSamples: 10,
+		Horizons:        []int{0, 1},
+	}
+	ts := TimestepSamples(generateTestSequences(m))
+	tree := b.Build(ts)
+	expected := tree.Copy()
+	ScaleOptimalStep(ts, expected, Softmax{}, 40.0, 0, 100)
+	expectedLoss := AvgLossDelta(ts, expected, Softmax{}, 1)
+
+	actual := tree.Copy()
+	ScaleOptimalStepSearch(ts, actual, Softmax{}, &Newton{}, 0)
+	actualLoss := AvgLossDelta(ts, actual, Softmax{}, 1)
+	if actualLoss > expectedLoss+1e-4 {
+		t.Errorf("expected loss delta %f but got %f", expectedLoss, actualLoss)
+	}
+}
+
+func testLineSearches() []LineSearch {
+	return []LineSearch{&GoldenSection{}, &Brent{}, &Newton{}, &Armijo{}}
+}
+
+// testLineFunc is a smooth, non-quadratic function with a
+// minimum at Center.
+type testLineFunc struct {
+	Center float32
+	Evals  int
+}
+
+func (t *testLineFunc) Loss(step float32) float32 {
+	t.Evals++
+	return float32(math.Log(math.Cosh(float64(step - t.Center))))
+}
+
+type testLineDerivFunc struct {
+	*testLineFunc
+}
+
+func (t testLineDerivFunc) Derivs(step float32) (float32, float32) {
+	x := float64(step - t.Center)
+	c := math.Cosh(x)
+	return float32(math.Tanh(x)), float32(1 / (c * c))
+}
+
+// testLineSlopeFunc only supports first derivatives, and
+// fails if second derivatives are requested.
+type testLineSlopeFunc struct {
+	*testLineFunc
+}
+
+func (t testLineSlopeFunc) Slope(step float32) float32 {
+	return float32(math.Tanh(float64(step - t.Center)))
+}
+
+func (t testLineSlopeFunc) Derivs(step float32) (float32, float32) {
+	panic("second derivative should not be needed")
+}
@@ -19,6 +19,20 @@ type HessianLossFunc interface {
 	LossHessian(outputs, targets []float32) *Hessian
 }
 
+// A BlockHessianLossFunc has a block-diagonal Hessian,
+// and can compute the diagonal blocks directly.
+type BlockHessianLossFunc interface {
+	HessianLossFunc
+	LossHessianBlocks(outputs, targets []float32) []*Hessian
+}
+
+// A DiagonalHessianLossFunc can compute the diagonal of
+// its Hessian without computing the entire matrix.
+type DiagonalHessianLossFunc interface {
+	HessianLossFunc
+	LossHessianDiagonal(outputs, targets []float32) []float32
+}
+
 type PolynomialLossFunc interface {
 	LossFunc
 	LossPolynomialSize() int
@@ -140,6 +154,84 @@ func (s Softmax) LossHessian(outputs, targets []float32) *Hessian {
 	return res
 }
 
+// LossHessianDiagonal computes the diagonal of the
+// Hessian from LossHessian().
+func (s Softmax) LossHessianDiagonal(outputs, targets []float32) []float32 {
+	max := outputs[0]
+	for _, x := range outputs[1:] {
+		if x > max {
+			max = x
+		}
+	}
+
+	exps := make([]float32, len(outputs))
+	expSum := float32(0)
+	for i, x := range outputs {
+		exps[i] = float32(math.Exp(float64(x - max)))
+		expSum += exps[i]
+	}
+
+	targetSum := float32(0)
+	for _, x := range targets {
+		targetSum += x
+	}
+
+	for i, x := range exps {
+		prob := x / expSum
+		exps[i] = targetSum * prob * (1 - prob)
+	}
+	return exps
+}
+
+func (s Softmax) LossPolynomialSize() int {
+	return 10
+}
+
+// LossPolynomials approximates the loss as a polynomial
+// along each logit, holding the other logits fixed.
+//
+// Along logit i, the log-sum-exp can be written as
+// logsumexp(others) + log(1+exp(x+a)), where x is the
+// logit minus the log-sum-exp of the other logits, so the
+// same expansion as Sigmoid applies.
+func (s Softmax) LossPolynomials(outputs, targets []float32) []Polynomial {
+	if len(outputs) < 2 {
+		panic("softmax polynomials require at least two logits")
+	}
+	var targetSum, dot float32
+	for i, t := range targets {
+		targetSum += t
+		dot += t * outputs[i]
+	}
+	res := make([]Polynomial, len(outputs))
+	for i, x := range outputs {
+		others := s.logSumExpExcept(outputs, i)
+		p := newPolynomialLogSigmoid(others - x).FlipX().Scale(-targetSum)
+		p[0] += targetSum*others - dot
+		p[1] -= targets[i]
+		res[i] = p
+	}
+	return res
+}
+
+// logSumExpExcept computes the log-sum-exp of all the
+// logits except for the one at index i.
+func (s Softmax) logSumExpExcept(logits []float32, i int) float32 {
+	max := float32(math.Inf(-1))
+	for j, x := range logits {
+		if j != i && x > max {
+			max = x
+		}
+	}
+	var sumOfExp float64
+	for j, x := range logits {
+		if j != i {
+			sumOfExp += math.Exp(float64(x - max))
+		}
+	}
+	return max + float32(math.Log(sumOfExp))
+}
+
 func (s Softmax) logSoftmax(logits []float32) []float32 {
 	max := logits[0]
 	for _, x := range logits[1:] {
@@ -240,19 +332,69 @@ func (m *MultiSoftmax) LossHessian(outputs, targets []float32) *Hessian {
 		Data: make([]float32, size*size),
 	}
 	offset := 0
+	for _, h := range m.LossHessianBlocks(outputs, targets) {
+		for i := 0; i < h.Dim; i++ {
+			for j := 0; j < h.Dim; j++ {
+				res.Data[j+offset+(i+offset)*res.Dim] = h.Data[j+i*h.Dim]
+			}
+		}
+		offset += h.Dim
+	}
+	return res
+}
+
+// LossHessianBlocks computes the Hessian of each softmax.
+func (m *MultiSoftmax) LossHessianBlocks(outputs, targets []float32) []*Hessian {
+	res := make([]*Hessian, len(m.Sizes))
 	for i, size := range m.Sizes {
 		h := Softmax{}.LossHessian(outputs[:size], targets[:size])
-		w := float32(1)
 		if m.Weights != nil {
-			w = m.Weights[i]
+			w := m.Weights[i]
+			for j, x := range h.Data {
+				h.Data[j] = x * w
+			}
+		}
+		res[i] = h
+		outputs = outputs[size:]
+		targets = targets[size:]
+	}
+	return res
+}
+
+// LossHessianDiagonal computes the diagonal of the
+// Hessian of each softmax.
+func (m *MultiSoftmax) LossHessianDiagonal(outputs, targets []float32) []float32 {
+	var res []float32
+	for i, size := range m.Sizes {
+		diag := Softmax{}.LossHessianDiagonal(outputs[:size], targets[:size])
+		if m.Weights != nil {
+			for j, x := range diag {
+				diag[j] = x * m.Weights[i]
+			}
 		}
-		for i := 0; i < size; i++ {
-			for j := 0; j < size; j++ {
-				x := h.Data[j+i*h.Dim]
-				res.Data[j+offset+(i+offset)*res.Dim] = x * w
+		res = append(res, diag...)
+		outputs = outputs[size:]
+		targets = targets[size:]
+	}
+	return res
+}
+
+func (m *MultiSoftmax) LossPolynomialSize() int {
+	return Softmax{}.LossPolynomialSize()
+}
+
+// LossPolynomials approximates each softmax loss using
+// Softmax.LossPolynomials().
+func (m *MultiSoftmax) LossPolynomials(outputs, targets []float32) []Polynomial {
+	var res []Polynomial
+	for i, size := range m.Sizes {
+		polys := Softmax{}.LossPolynomials(outputs[:size], targets[:size])
+		if m.Weights != nil {
+			for j, p := range polys {
+				polys[j] = p.Scale(m.Weights[i])
 			}
 		}
-		offset += size
+		res = append(res, polys...)
 		outputs = outputs[size:]
 		targets = targets[size:]
 	}
@@ -307,6 +449,18 @@ func (s Sigmoid) LossHessian(outputs, targets []float32) *Hessian {
 	return res
 }
 
+// LossHessianDiagonal computes the diagonal of the
+// Hessian, which is the entire Hessian since the outputs
+// are independent.
+func (s Sigmoid) LossHessianDiagonal(outputs, targets []float32) []float32 {
+	res := make([]float32, len(outputs))
+	for i, x := range outputs {
+		t := targets[i]
+		res[i] = Softmax{}.LossHessianDiagonal([]float32{x, 0}, []float32{t, 1 - t})[0]
+	}
+	return res
+}
+
 func (s Sigmoid) LossPolynomialSize() int {
 	return 10
 }
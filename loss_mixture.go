@@ -0,0 +1,182 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+)
+
+const (
+	logisticMixtureLevels   = 256
+	logisticMixtureMinScale = -7
+)
+
+// LogisticMixture is a discretized mixture of logistics,
+// as used in PixelCNN++, over 256 evenly spaced levels
+// between 0 and 1.
+//
+// Each target is an intensity between 0 and 1, and has a
+// block of 3*NumComponents outputs: first the mixture
+// logits, then the means, and then the log-scales.
+// Means are in the range [-1, 1], which corresponds to
+// intensities in the range [0, 1].
+type LogisticMixture struct {
+	NumComponents int
+}
+
+// Sample samples intensities from the mixtures.
+func (l *LogisticMixture) Sample(outputs []float32) []float32 {
+	blocks := l.blocks(outputs)
+	res := make([]float32, len(blocks))
+	for i, block := range blocks {
+		logits, means, logScales := l.split(block)
+		k := Softmax{}.Sample(logits)
+		u := rand.Float64()*(1-2e-5) + 1e-5
+		scale := math.Exp(math.Max(float64(logScales[k]), logisticMixtureMinScale))
+		x := float64(means[k]) + scale*(math.Log(u)-math.Log(1-u))
+		level := math.Round((x + 1) / 2 * (logisticMixtureLevels - 1))
+		level = math.Max(0, math.Min(logisticMixtureLevels-1, level))
+		res[i] = float32(level / (logisticMixtureLevels - 1))
+	}
+	return res
+}
+
+// Loss computes the negative log-likelihood of the
+// discretized targets, in nats.
+func (l *LogisticMixture) Loss(outputs, targets []float32) float32 {
+	var total float64
+	for i, block := range l.blocks(outputs) {
+		loss, _ := l.lossGrad(block, targets[i], false)
+		total += loss
+	}
+	return float32(total)
+}
+
+// LossGrad computes the gradient of the loss with respect
+// to the outputs.
+func (l *LogisticMixture) LossGrad(outputs, targets []float32) []float32 {
+	res := make([]float32, 0, len(outputs))
+	for i, block := range l.blocks(outputs) {
+		_, grad := l.lossGrad(block, targets[i], true)
+		res = append(res, grad...)
+	}
+	return res
+}
+
+// BitsPerDim converts the mean loss per target into bits
+// per dimension, the measure typically reported for image
+// models.
+func (l *LogisticMixture) BitsPerDim(meanLoss float32) float32 {
+	return meanLoss / math.Ln2
+}
+
+func (l *LogisticMixture) lossGrad(block []float32, target float32,
+	computeGrad bool) (float64, []float32) {
+	logits, means, logScales := l.split(block)
+	logProbs := Softmax{}.logSoftmax(logits)
+
+	x := 2*float64(target) - 1
+	halfBin := 1.0 / (logisticMixtureLevels - 1)
+
+	// Joint log-likelihood of the target and each
+	// component, and its derivatives with respect to the
+	// mean and log-scale of the component.
+	joint := make([]float64, l.NumComponents)
+	meanGrads := make([]float64, l.NumComponents)
+	scaleGrads := make([]float64, l.NumComponents)
+	for k := range joint {
+		logScale := float64(logScales[k])
+		clipped := logScale < logisticMixtureMinScale
+		if clipped {
+			logScale = logisticMixtureMinScale
+		}
+		invScale := math.Exp(-logScale)
+		centered := x - float64(means[k])
+		plusIn := invScale * (centered + halfBin)
+		minIn := invScale * (centered - halfBin)
+
+		// Derivatives with respect to plusIn and minIn.
+		var logProb, dPlus, dMin float64
+		if x < -0.999 {
+			logProb = -softplus(-plusIn)
+			dPlus = sigmoid(-plusIn)
+		} else if x > 0.999 {
+			logProb = -softplus(minIn)
+			dMin = -sigmoid(minIn)
+		} else {
+			cdfDelta := sigmoid(plusIn) - sigmoid(minIn)
+			if cdfDelta > 1e-5 {
+				logProb = math.Log(cdfDelta)
+				dPlus = sigmoid(plusIn) * sigmoid(-plusIn) / cdfDelta
+				dMin = -sigmoid(minIn) * sigmoid(-minIn) / cdfDelta
+			} else {
+				// Approximate the probability with the density
+				// at the center of the bin.
+				midIn := invScale * centered
+				logProb = midIn - logScale - 2*softplus(midIn) + math.Log(2*halfBin)
+				dMid := 1 - 2*sigmoid(midIn)
+				meanGrads[k] = -dMid * invScale
+				if !clipped {
+					scaleGrads[k] = -dMid*midIn - 1
+				}
+				joint[k] = float64(logProbs[k]) + logProb
+				continue
+			}
+		}
+		joint[k] = float64(logProbs[k]) + logProb
+		meanGrads[k] = -(dPlus + dMin) * invScale
+		if !clipped {
+			scaleGrads[k] = -(dPlus*plusIn + dMin*minIn)
+		}
+	}
+
+	max := joint[0]
+	for _, x := range joint[1:] {
+		max = math.Max(max, x)
+	}
+	var sumOfExp float64
+	for _, x := range joint {
+		sumOfExp += math.Exp(x - max)
+	}
+	logLikelihood := max + math.Log(sumOfExp)
+	if !computeGrad {
+		return -logLikelihood, nil
+	}
+
+	n := l.NumComponents
+	grad := make([]float32, 3*n)
+	for k, x := range joint {
+		resp := math.Exp(x - logLikelihood)
+		grad[k] = float32(math.Exp(float64(logProbs[k])) - resp)
+		grad[k+n] = float32(-resp * meanGrads[k])
+		grad[k+2*n] = float32(-resp * scaleGrads[k])
+	}
+	return -logLikelihood, grad
+}
+
+func (l *LogisticMixture) blocks(outputs []float32) [][]float32 {
+	size := 3 * l.NumComponents
+	if len(outputs)%size != 0 {
+		panic("incorrect output size")
+	}
+	res := make([][]float32, len(outputs)/size)
+	for i := range res {
+		res[i] = outputs[i*size : (i+1)*size]
+	}
+	return res
+}
+
+func (l *LogisticMixture) split(block []float32) (logits, means, logScales []float32) {
+	n := l.NumComponents
+	return block[:n], block[n : 2*n], block[2*n:]
+}
+
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+func softplus(x float64) float64 {
+	if x > 20 {
+		return x
+	}
+	return math.Log1p(math.Exp(x))
+}
@@ -0,0 +1,67 @@
+package seqtree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLogisticMixtureNormalized(t *testing.T) {
+	l := &LogisticMixture{NumComponents: 3}
+	outputs := []float32{0.5, -1, 0.2, -0.5, 0.1, 0.9, -2, -3, -1}
+	var total float64
+	var mean float64
+	for i := 0; i < 256; i++ {
+		target := float32(i) / 255
+		prob := math.Exp(-float64(l.Loss(outputs, []float32{target})))
+		total += prob
+		mean += prob * float64(target)
+	}
+	if math.Abs(total-1) > 1e-3 {
+		t.Errorf("expected total probability 1 but got %f", total)
+	}
+
+	var sampleMean float64
+	const numSamples = 20000
+	for i := 0; i < numSamples; i++ {
+		sampleMean += float64(l.Sample(outputs)[0]) / numSamples
+	}
+	if math.Abs(sampleMean-mean) > 0.01 {
+		t.Errorf("expected sample mean %f but got %f", mean, sampleMean)
+	}
+}
+
+func TestLogisticMixtureGrad(t *testing.T) {
+	l := &LogisticMixture{NumComponents: 2}
+	outputs := []float32{0.5, -1, 0.2, -0.5, -2, -3, 0.3, -0.1, 0.8, -0.7, -2.5, -1.5}
+	for _, target := range []float32{0, 0.3, 0.6, 1} {
+		testLogisticMixtureGrad(t, l, outputs, []float32{target, 1 - target})
+	}
+
+	// Check the approximation for tiny bin probabilities.
+	testLogisticMixtureGrad(t, l, []float32{0, 0, 0.5, 0.6, -4, -4}, []float32{0.1})
+}
+
+func testLogisticMixtureGrad(t *testing.T, l *LogisticMixture, outputs, targets []float32) {
+	// The loss is very sharp for small scales, so we use a
+	// small epsilon and a relative tolerance.
+	const epsilon = 1e-3
+	actual := l.LossGrad(outputs, targets)
+	for i := range outputs {
+		expected := finiteDiff(outputs, i, epsilon, func(o []float32) float64 {
+			return float64(l.Loss(o, targets))
+		})
+		tol := 1e-2 * math.Max(1, math.Abs(float64(expected)))
+		if math.Abs(float64(actual[i]-expected)) > tol {
+			t.Errorf("target %v: grad %d: expected %f but got %f", targets, i, expected,
+				actual[i])
+		}
+	}
+}
+
+func TestLogisticMixtureBitsPerDim(t *testing.T) {
+	l := &LogisticMixture{NumComponents: 1}
+	actual := l.BitsPerDim(float32(8 * math.Ln2))
+	if math.Abs(float64(actual-8)) > 1e-5 {
+		t.Errorf("expected 8 bits but got %f", actual)
+	}
+}
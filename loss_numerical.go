@@ -0,0 +1,329 @@
+package seqtree
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultNumericalEpsilon    = 1e-2
+	defaultNumericalPolySize   = 3
+	defaultNumericalPolyRadius = 1
+	complexStepSize            = 1e-20
+)
+
+// A ComplexLossFunc is a LossFunc which can be evaluated
+// on complex outputs, allowing NumericalLoss to use
+// complex-step differentiation.
+//
+// ComplexLoss should be the analytic continuation of Loss,
+// so it must not use abs(), comparisons on the imaginary
+// part, or other non-analytic operations.
+type ComplexLossFunc interface {
+	LossFunc
+	ComplexLoss(outputs []complex128, targets []float32) complex128
+}
+
+// NumericalLoss wraps a LossFunc and implements
+// HessianLossFunc and PolynomialLossFunc using numerical
+// differentiation.
+//
+// If Base implements ComplexLossFunc, gradients are
+// computed with complex-step differentiation, which does
+// not suffer from cancellation error. Otherwise, central
+// finite differences are used.
+type NumericalLoss struct {
+	Base LossFunc
+
+	// Epsilon is the step size for finite differences.
+	// If 0, a default is used.
+	Epsilon float32
+
+	// PolynomialSize is the size of the polynomials
+	// returned by LossPolynomials.
+	// If 0, a default is used.
+	PolynomialSize int
+
+	// PolynomialRadius is the range of output changes, in
+	// both directions, over which polynomials are fit.
+	// If 0, a default is used.
+	PolynomialRadius float32
+}
+
+func (n *NumericalLoss) Loss(outputs, targets []float32) float32 {
+	return n.Base.Loss(outputs, targets)
+}
+
+// LossGrad approximates the gradient of the loss.
+func (n *NumericalLoss) LossGrad(outputs, targets []float32) []float32 {
+	res := make([]float32, len(outputs))
+	if cl, ok := n.Base.(ComplexLossFunc); ok {
+		input := make([]complex128, len(outputs))
+		for i, x := range outputs {
+			input[i] = complex(float64(x), 0)
+		}
+		for i := range outputs {
+			input[i] += complex(0, complexStepSize)
+			res[i] = float32(imag(cl.ComplexLoss(input, targets)) / complexStepSize)
+			input[i] -= complex(0, complexStepSize)
+		}
+		return res
+	}
+	eps := n.epsilon()
+	for i := range outputs {
+		res[i] = finiteDiff(outputs, i, eps, func(o []float32) float64 {
+			return float64(n.Base.Loss(o, targets))
+		})
+	}
+	return res
+}
+
+// LossHessian approximates the Hessian of the loss using
+// central differences of the gradient.
+//
+// The result is symmetrized to reduce numerical error.
+func (n *NumericalLoss) LossHessian(outputs, targets []float32) *Hessian {
+	res := &Hessian{
+		Dim:  len(outputs),
+		Data: make([]float32, len(outputs)*len(outputs)),
+	}
+	eps := n.epsilon()
+	o := append([]float32{}, outputs...)
+	for j := range outputs {
+		o[j] = outputs[j] + eps
+		plus := n.LossGrad(o, targets)
+		o[j] = outputs[j] - eps
+		minus := n.LossGrad(o, targets)
+		o[j] = outputs[j]
+		for i := range outputs {
+			res.Data[j+i*res.Dim] = (plus[i] - minus[i]) / (2 * eps)
+		}
+	}
+	for i := 0; i < res.Dim; i++ {
+		for j := 0; j < i; j++ {
+			mean := (res.Data[j+i*res.Dim] + res.Data[i+j*res.Dim]) / 2
+			res.Data[j+i*res.Dim] = mean
+			res.Data[i+j*res.Dim] = mean
+		}
+	}
+	return res
+}
+
+func (n *NumericalLoss) LossPolynomialSize() int {
+	if n.PolynomialSize == 0 {
+		return defaultNumericalPolySize
+	}
+	return n.PolynomialSize
+}
+
+// LossPolynomials fits a polynomial to the loss along each
+// output, holding the other outputs fixed.
+//
+// The polynomials are least-squares fits over the range
+// [-PolynomialRadius, PolynomialRadius], with the constant
+// term fixed to the current loss. This is only an accurate
+// description of the loss if it is separable across
+// outputs.
+func (n *NumericalLoss) LossPolynomials(outputs, targets []float32) []Polynomial {
+	size := n.LossPolynomialSize()
+	radius := float64(n.PolynomialRadius)
+	if radius == 0 {
+		radius = defaultNumericalPolyRadius
+	}
+
+	// Chebyshev nodes avoid oscillation near the ends of
+	// the range.
+	numPoints := 2 * size
+	points := make([]float64, numPoints)
+	for i := range points {
+		points[i] = radius * math.Cos(math.Pi*(float64(i)+0.5)/float64(numPoints))
+	}
+
+	baseLoss := n.Base.Loss(outputs, targets)
+	res := make([]Polynomial, len(outputs))
+	o := append([]float32{}, outputs...)
+	for i := range outputs {
+		values := make([]float64, numPoints)
+		for j, p := range points {
+			o[i] = outputs[i] + float32(p)
+			values[j] = float64(n.Base.Loss(o, targets) - baseLoss)
+		}
+		o[i] = outputs[i]
+		coeffs := fitPolynomial(points, values, size-1)
+		poly := make(Polynomial, size)
+		poly[0] = baseLoss
+		for k, c := range coeffs {
+			poly[k+1] = float32(c)
+		}
+		res[i] = poly
+	}
+	return res
+}
+
+func (n *NumericalLoss) epsilon() float32 {
+	if n.Epsilon == 0 {
+		return defaultNumericalEpsilon
+	}
+	return n.Epsilon
+}
+
+// CheckLossGrad compares the gradient of a loss to a
+// numerical approximation, returning an error describing
+// the first mismatch, if there is one.
+func CheckLossGrad(l GradLossFunc, outputs, targets []float32, tol float32) error {
+	numerical := &NumericalLoss{Base: lossOnly{l}}
+	expected := numerical.LossGrad(outputs, targets)
+	actual := l.LossGrad(outputs, targets)
+	if len(actual) != len(expected) {
+		return errors.Errorf("gradient size: expected %d but got %d", len(expected),
+			len(actual))
+	}
+	for i, x := range expected {
+		if !closeEnough(actual[i], x, tol) {
+			return errors.Errorf("gradient %d: expected %f but got %f", i, x, actual[i])
+		}
+	}
+	return nil
+}
+
+// CheckLossHessian compares the Hessian of a loss to a
+// numerical approximation based on LossGrad, returning an
+// error describing the first mismatch, if there is one.
+func CheckLossHessian(l HessianLossFunc, outputs, targets []float32, tol float32) error {
+	numerical := &NumericalLoss{Base: l}
+	eps := numerical.epsilon()
+	actual := l.LossHessian(outputs, targets)
+	if actual.Dim != len(outputs) {
+		return errors.Errorf("hessian size: expected %d but got %d", len(outputs),
+			actual.Dim)
+	}
+	o := append([]float32{}, outputs...)
+	for j := range outputs {
+		o[j] = outputs[j] + eps
+		plus := l.LossGrad(o, targets)
+		o[j] = outputs[j] - eps
+		minus := l.LossGrad(o, targets)
+		o[j] = outputs[j]
+		for i := range outputs {
+			expected := (plus[i] - minus[i]) / (2 * eps)
+			if !closeEnough(actual.Data[j+i*actual.Dim], expected, tol) {
+				return errors.Errorf("hessian %d,%d: expected %f but got %f", i, j, expected,
+					actual.Data[j+i*actual.Dim])
+			}
+		}
+	}
+	return nil
+}
+
+// CheckLossPolynomials checks that the polynomials from a
+// loss predict the change in loss for small changes to
+// each output, returning an error describing the first
+// mismatch, if there is one.
+func CheckLossPolynomials(l PolynomialLossFunc, outputs, targets []float32, tol float32) error {
+	polys := l.LossPolynomials(outputs, targets)
+	if len(polys) != len(outputs) {
+		return errors.Errorf("expected %d polynomials but got %d", len(outputs), len(polys))
+	}
+	baseLoss := l.Loss(outputs, targets)
+	o := append([]float32{}, outputs...)
+	for i, p := range polys {
+		if len(p) != l.LossPolynomialSize() {
+			return errors.Errorf("polynomial %d: expected size %d but got %d", i,
+				l.LossPolynomialSize(), len(p))
+		}
+		for _, delta := range []float32{-0.5, -0.1, 0.2, 0.7} {
+			o[i] = outputs[i] + delta
+			expected := l.Loss(o, targets) - baseLoss
+			o[i] = outputs[i]
+			actual := p.Apply(delta) - p.Apply(0)
+			if !closeEnough(actual, expected, tol) {
+				return errors.Errorf("polynomial %d: delta %f: expected %f but got %f", i,
+					delta, expected, actual)
+			}
+		}
+	}
+	return nil
+}
+
+// lossOnly hides every method of a loss except Loss().
+type lossOnly struct {
+	l LossFunc
+}
+
+func (l lossOnly) Loss(outputs, targets []float32) float32 {
+	return l.l.Loss(outputs, targets)
+}
+
+// finiteDiff computes a central difference of f along
+// coordinate i of x.
+func finiteDiff(x []float32, i int, eps float32, f func(x []float32) float64) float32 {
+	x1 := append([]float32{}, x...)
+	x1[i] += eps
+	plus := f(x1)
+	x1[i] = x[i] - eps
+	minus := f(x1)
+	return float32((plus - minus) / float64(2*eps))
+}
+
+// fitPolynomial finds the least-squares coefficients c such
+// that sum_k c[k]*x^(k+1) approximates y.
+func fitPolynomial(x, y []float64, degree int) []float64 {
+	// Solve the normal equations with Gaussian elimination,
+	// which is fine for the tiny systems used here.
+	n := degree
+	matrix := make([][]float64, n)
+	for i := range matrix {
+		matrix[i] = make([]float64, n+1)
+	}
+	for j, xj := range x {
+		powers := make([]float64, n)
+		p := xj
+		for k := range powers {
+			powers[k] = p
+			p *= xj
+		}
+		for a := 0; a < n; a++ {
+			for b := 0; b < n; b++ {
+				matrix[a][b] += powers[a] * powers[b]
+			}
+			matrix[a][n] += powers[a] * y[j]
+		}
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(matrix[row][col]) > math.Abs(matrix[pivot][col]) {
+				pivot = row
+			}
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		if matrix[col][col] == 0 {
+			continue
+		}
+		for row := 0; row < n; row++ {
+			if row == col {
+				continue
+			}
+			scale := matrix[row][col] / matrix[col][col]
+			for k := col; k <= n; k++ {
+				matrix[row][k] -= scale * matrix[col][k]
+			}
+		}
+	}
+	res := make([]float64, n)
+	for i := range res {
+		if matrix[i][i] != 0 {
+			res[i] = matrix[i][n] / matrix[i][i]
+		}
+	}
+	return res
+}
+
+// closeEnough checks if actual is within tol of expected,
+// either absolutely or relative to the magnitude of
+// expected.
+func closeEnough(actual, expected, tol float32) bool {
+	diff := math.Abs(float64(actual - expected))
+	return diff <= float64(tol) || diff <= float64(tol)*math.Abs(float64(expected))
+}
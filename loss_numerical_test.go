@@ -0,0 +1,149 @@
+package seqtree
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+func TestNumericalLoss(t *testing.T) {
+	outputs := []float32{0.5, -1, 2, 0.3}
+	targets := []float32{0, 0.2, 0.8, 0}
+	for _, l := range []HessianLossFunc{Softmax{}, MSE{}, Sigmoid{}, testLogCosh{}} {
+		numerical := &NumericalLoss{Base: l}
+		expectedGrad := l.LossGrad(outputs, targets)
+		actualGrad := numerical.LossGrad(outputs, targets)
+		for i, x := range expectedGrad {
+			if math.Abs(float64(actualGrad[i]-x)) > 1e-3 {
+				t.Errorf("%T: grad %d: expected %f but got %f", l, i, x, actualGrad[i])
+			}
+		}
+		expectedHessian := l.LossHessian(outputs, targets)
+		actualHessian := numerical.LossHessian(outputs, targets)
+		for i, x := range expectedHessian.Data {
+			if math.Abs(float64(actualHessian.Data[i]-x)) > 1e-2 {
+				t.Errorf("%T: hessian %d: expected %f but got %f", l, i, x,
+					actualHessian.Data[i])
+			}
+		}
+	}
+}
+
+func TestNumericalLossComplexStep(t *testing.T) {
+	outputs := []float32{0.5, -1, 2, 0.3}
+	targets := []float32{0, 0.2, 0.8, 0}
+	l := testLogCosh{}
+	numerical := &NumericalLoss{Base: l}
+	expected := l.LossGrad(outputs, targets)
+	actual := numerical.LossGrad(outputs, targets)
+	for i, x := range expected {
+		if math.Abs(float64(actual[i]-x)) > 1e-6 {
+			t.Errorf("grad %d: expected %f but got %f", i, x, actual[i])
+		}
+	}
+}
+
+func TestNumericalLossPolynomials(t *testing.T) {
+	outputs := []float32{0.5, -1, 2, 0.3}
+	targets := []float32{0, 0.2, 0.8, 0}
+
+	mse := &NumericalLoss{Base: MSE{}}
+	if err := CheckLossPolynomials(mse, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+	polys := mse.LossPolynomials(outputs, targets)
+	expected := MSE{}.LossPolynomials(outputs, targets)
+	for i, p := range polys {
+		// Constant terms are arbitrary, since only changes in
+		// the loss are meaningful.
+		for j := 1; j < len(p); j++ {
+			x := expected[i][j]
+			if math.Abs(float64(p[j]-x)) > 1e-3 {
+				t.Errorf("output %d: coefficient %d: expected %f but got %f", i, j, x, p[j])
+			}
+		}
+	}
+
+	gaussian := &NumericalLoss{Base: Gaussian{}, PolynomialSize: 8, PolynomialRadius: 0.7}
+	if err := CheckLossPolynomials(gaussian, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckLoss(t *testing.T) {
+	outputs := []float32{0.5, -1, 2}
+	targets := []float32{0, 0.2, 0.8}
+	for _, l := range []HessianLossFunc{Softmax{}, MSE{}, &Focal{Base: Softmax{}, Gamma: 2}} {
+		if err := CheckLossGrad(l, outputs, targets, 1e-3); err != nil {
+			t.Errorf("%T: %s", l, err)
+		}
+		if err := CheckLossHessian(l, outputs, targets, 1e-3); err != nil {
+			t.Errorf("%T: %s", l, err)
+		}
+	}
+	if err := CheckLossPolynomials(Softmax{}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+
+	broken := testBrokenLoss{}
+	if CheckLossGrad(broken, outputs, targets, 1e-3) == nil {
+		t.Error("expected gradient error")
+	}
+	if CheckLossHessian(broken, outputs, targets, 1e-3) == nil {
+		t.Error("expected hessian error")
+	}
+}
+
+// testLogCosh is a regression loss with a complex-step
+// implementation.
+type testLogCosh struct{}
+
+func (t testLogCosh) Loss(outputs, targets []float32) float32 {
+	var total float64
+	for i, x := range outputs {
+		total += math.Log(math.Cosh(float64(x - targets[i])))
+	}
+	return float32(total)
+}
+
+func (t testLogCosh) ComplexLoss(outputs []complex128, targets []float32) complex128 {
+	var total complex128
+	for i, x := range outputs {
+		total += cmplx.Log(cmplx.Cosh(x - complex(float64(targets[i]), 0)))
+	}
+	return total
+}
+
+func (t testLogCosh) LossGrad(outputs, targets []float32) []float32 {
+	res := make([]float32, len(outputs))
+	for i, x := range outputs {
+		res[i] = float32(math.Tanh(float64(x - targets[i])))
+	}
+	return res
+}
+
+func (t testLogCosh) LossHessian(outputs, targets []float32) *Hessian {
+	res := &Hessian{Dim: len(outputs), Data: make([]float32, len(outputs)*len(outputs))}
+	for i, x := range outputs {
+		c := math.Cosh(float64(x - targets[i]))
+		res.Data[i+i*res.Dim] = float32(1 / (c * c))
+	}
+	return res
+}
+
+// testBrokenLoss is MSE with incorrect derivatives.
+type testBrokenLoss struct {
+	MSE
+}
+
+func (t testBrokenLoss) LossGrad(outputs, targets []float32) []float32 {
+	res := t.MSE.LossGrad(outputs, targets)
+	res[0] *= 2
+	return res
+}
+
+func (t testBrokenLoss) LossHessian(outputs, targets []float32) *Hessian {
+	res := t.MSE.LossHessian(outputs, targets)
+	res.Data[1] = 0.5
+	return res
+}
@@ -0,0 +1,178 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+)
+
+// MSE is a squared error loss for real-valued targets.
+//
+// The loss is half the squared error, so that it is the
+// negative log-likelihood of a unit-variance Gaussian (up
+// to a constant).
+type MSE struct{}
+
+// Sample samples from a unit-variance Gaussian with the
+// outputs as the mean.
+func (m MSE) Sample(outputs []float32) []float32 {
+	res := make([]float32, len(outputs))
+	for i, x := range outputs {
+		res[i] = x + float32(rand.NormFloat64())
+	}
+	return res
+}
+
+// Loss computes half the squared error.
+func (m MSE) Loss(outputs, targets []float32) float32 {
+	var total float32
+	for i, x := range outputs {
+		d := x - targets[i]
+		total += d * d
+	}
+	return total / 2
+}
+
+// LossGrad computes the gradient of the loss with respect
+// to the outputs.
+func (m MSE) LossGrad(outputs, targets []float32) []float32 {
+	return vectorDifference(outputs, targets)
+}
+
+// LossHessian computes the Hessian of the loss, which is
+// the identity matrix.
+func (m MSE) LossHessian(outputs, targets []float32) *Hessian {
+	res := &Hessian{
+		Dim:  len(outputs),
+		Data: make([]float32, len(outputs)*len(outputs)),
+	}
+	for i := range outputs {
+		res.Data[i+i*res.Dim] = 1
+	}
+	return res
+}
+
+func (m MSE) LossPolynomialSize() int {
+	return 3
+}
+
+// LossPolynomials computes the loss for each output,
+// which is exactly a quadratic.
+func (m MSE) LossPolynomials(outputs, targets []float32) []Polynomial {
+	res := make([]Polynomial, len(outputs))
+	for i, x := range outputs {
+		d := x - targets[i]
+		res[i] = Polynomial{d * d / 2, d, 0.5}
+	}
+	return res
+}
+
+// Gaussian is a negative log-likelihood loss for real
+// valued targets, where both the mean and the variance are
+// predicted.
+//
+// For N targets, there are 2*N outputs: first the N means,
+// and then the N log-variances.
+type Gaussian struct{}
+
+// Sample samples from the Gaussian distributions.
+func (g Gaussian) Sample(outputs []float32) []float32 {
+	means, logVars := g.split(outputs)
+	res := make([]float32, len(means))
+	for i, mean := range means {
+		std := math.Exp(float64(logVars[i]) / 2)
+		res[i] = mean + float32(rand.NormFloat64()*std)
+	}
+	return res
+}
+
+// Loss computes the negative log-likelihood of the
+// targets.
+func (g Gaussian) Loss(outputs, targets []float32) float32 {
+	means, logVars := g.split(outputs)
+	var total float64
+	for i, mean := range means {
+		d := float64(targets[i] - mean)
+		logVar := float64(logVars[i])
+		total += 0.5 * (math.Log(2*math.Pi) + logVar + d*d*math.Exp(-logVar))
+	}
+	return float32(total)
+}
+
+// LossGrad computes the gradient of the loss with respect
+// to the outputs.
+func (g Gaussian) LossGrad(outputs, targets []float32) []float32 {
+	means, logVars := g.split(outputs)
+	res := make([]float32, len(outputs))
+	for i, mean := range means {
+		d := float64(mean - targets[i])
+		invVar := math.Exp(-float64(logVars[i]))
+		res[i] = float32(d * invVar)
+		res[i+len(means)] = float32(0.5 - 0.5*d*d*invVar)
+	}
+	return res
+}
+
+// LossHessian computes the Fisher information matrix,
+// which is used in place of the Hessian since the true
+// Hessian is not always positive definite.
+func (g Gaussian) LossHessian(outputs, targets []float32) *Hessian {
+	means, logVars := g.split(outputs)
+	res := &Hessian{
+		Dim:  len(outputs),
+		Data: make([]float32, len(outputs)*len(outputs)),
+	}
+	for i := range means {
+		res.Data[i+i*res.Dim] = float32(math.Exp(-float64(logVars[i])))
+		j := i + len(means)
+		res.Data[j+j*res.Dim] = 0.5
+	}
+	return res
+}
+
+func (g Gaussian) LossPolynomialSize() int {
+	return 10
+}
+
+// LossPolynomials approximates the loss separately for
+// each output, holding the other outputs fixed.
+//
+// The loss is exactly quadratic in each mean, and the
+// log-variances use a Taylor series of exp().
+// Interactions between the means and log-variances are
+// ignored.
+func (g Gaussian) LossPolynomials(outputs, targets []float32) []Polynomial {
+	means, logVars := g.split(outputs)
+	size := g.LossPolynomialSize()
+	res := make([]Polynomial, len(outputs))
+	for i, mean := range means {
+		d := float64(mean - targets[i])
+		logVar := float64(logVars[i])
+		invVar := math.Exp(-logVar)
+
+		meanPoly := make(Polynomial, size)
+		meanPoly[0] = float32(0.5 * (math.Log(2*math.Pi) + logVar + d*d*invVar))
+		meanPoly[1] = float32(d * invVar)
+		meanPoly[2] = float32(0.5 * invVar)
+		res[i] = meanPoly
+
+		// 0.5*(logVar+a) + 0.5*d^2*exp(-logVar)*exp(-a)
+		varPoly := make(Polynomial, size)
+		coeff := 0.5 * d * d * invVar
+		for k := range varPoly {
+			varPoly[k] = float32(coeff)
+			coeff *= -1 / float64(k+1)
+		}
+		varPoly[0] += float32(0.5 * (math.Log(2*math.Pi) + logVar))
+		varPoly[1] += 0.5
+		res[i+len(means)] = varPoly
+	}
+	return res
+}
+
+func (g Gaussian) split(outputs []float32) (means, logVars []float32) {
+	if len(outputs)%2 != 0 {
+		panic("incorrect output size")
+	}
+	n := len(outputs) / 2
+	return outputs[:n], outputs[n:]
+}
@@ -0,0 +1,67 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMSE(t *testing.T) {
+	outputs := []float32{0.5, -1.2, 2}
+	targets := []float32{0.3, 0.1, 2.5}
+	if err := CheckLossGrad(MSE{}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+	if err := CheckLossPolynomials(MSE{}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+	if err := CheckLossHessian(MSE{}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+
+	samples := make([]vecSample, 100)
+	for i := range samples {
+		ts := &Timestep{
+			Output: []float32{0},
+			Target: []float32{float32(rand.NormFloat64())},
+		}
+		samples[i] = vecSample{TimestepSample: TimestepSample{Sequence: Sequence{ts}}}
+	}
+	var mean float32
+	for _, s := range samples {
+		mean += s.Timestep().Target[0] / float32(len(samples))
+	}
+	for _, h := range []Heuristic{
+		GradientHeuristic{Loss: MSE{}},
+		HessianHeuristic{Loss: MSE{}},
+		PolynomialHeuristic{Loss: MSE{}, MaxDelta: 5},
+	} {
+		for i := range samples {
+			samples[i].Vector = h.SampleVector(&samples[i].TimestepSample)
+		}
+		actual := vecSamplesOutputDelta(h, samples)[0]
+		if math.Abs(float64(actual-mean)) > 1e-3 {
+			t.Errorf("%T: expected leaf output %f but got %f", h, mean, actual)
+		}
+	}
+}
+
+func TestGaussian(t *testing.T) {
+	outputs := []float32{0.5, -1.2, 0.3, -0.5}
+	targets := []float32{0.3, 0.1}
+	if err := CheckLossGrad(Gaussian{}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+	if err := CheckLossPolynomials(Gaussian{}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+
+	// The Fisher information is the expected Hessian, and
+	// the mean block of the Hessian is exact.
+	h := Gaussian{}.LossHessian(outputs, targets)
+	for i, expected := range []float32{float32(math.Exp(-0.3)), float32(math.Exp(0.5)), 0.5, 0.5} {
+		if math.Abs(float64(h.Data[i+i*h.Dim]-expected)) > 1e-4 {
+			t.Errorf("entry %d: expected %f but got %f", i, expected, h.Data[i+i*h.Dim])
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Huber is a regression loss which is quadratic for small
+// errors and linear for large errors.
+//
+// Huber does not implement PolynomialLossFunc, since it
+// is not smooth. PseudoHuber can be used instead.
+type Huber struct {
+	// Delta is the error magnitude at which the loss
+	// becomes linear.
+	// If 0, a default of 1 is used.
+	Delta float32
+}
+
+// Loss computes the total Huber loss.
+func (h Huber) Loss(outputs, targets []float32) float32 {
+	var total float32
+	delta := h.delta()
+	for i, x := range outputs {
+		d := x - targets[i]
+		if d < 0 {
+			d = -d
+		}
+		if d <= delta {
+			total += d * d / 2
+		} else {
+			total += delta * (d - delta/2)
+		}
+	}
+	return total
+}
+
+// LossGrad computes the gradient of the loss with respect
+// to the outputs, which is the clipped error.
+func (h Huber) LossGrad(outputs, targets []float32) []float32 {
+	res := make([]float32, len(outputs))
+	delta := h.delta()
+	for i, x := range outputs {
+		d := x - targets[i]
+		if d > delta {
+			d = delta
+		} else if d < -delta {
+			d = -delta
+		}
+		res[i] = d
+	}
+	return res
+}
+
+// LossHessian computes the Hessian of the loss, which is
+// zero for outputs in the linear region.
+//
+// Since the Hessian may be singular, HessianHeuristic
+// should be used with a non-zero Damping.
+func (h Huber) LossHessian(outputs, targets []float32) *Hessian {
+	res := &Hessian{
+		Dim:  len(outputs),
+		Data: make([]float32, len(outputs)*len(outputs)),
+	}
+	delta := h.delta()
+	for i, x := range outputs {
+		d := x - targets[i]
+		if d <= delta && d >= -delta {
+			res.Data[i+i*res.Dim] = 1
+		}
+	}
+	return res
+}
+
+func (h Huber) delta() float32 {
+	if h.Delta == 0 {
+		return 1
+	}
+	return h.Delta
+}
+
+// PseudoHuber is a smooth approximation of the Huber loss,
+// delta^2*(sqrt(1+(error/delta)^2)-1).
+type PseudoHuber struct {
+	// Delta is the error magnitude around which the loss
+	// transitions from quadratic to linear.
+	// If 0, a default of 1 is used.
+	Delta float32
+}
+
+// Loss computes the total pseudo-Huber loss.
+func (p PseudoHuber) Loss(outputs, targets []float32) float32 {
+	var total float64
+	delta := p.delta()
+	for i, x := range outputs {
+		d := float64(x-targets[i]) / delta
+		total += delta * delta * (math.Sqrt(1+d*d) - 1)
+	}
+	return float32(total)
+}
+
+// LossGrad computes the gradient of the loss with respect
+// to the outputs.
+func (p PseudoHuber) LossGrad(outputs, targets []float32) []float32 {
+	res := make([]float32, len(outputs))
+	delta := p.delta()
+	for i, x := range outputs {
+		d := float64(x - targets[i])
+		res[i] = float32(d / math.Sqrt(1+d*d/(delta*delta)))
+	}
+	return res
+}
+
+// LossHessian computes the Hessian of the loss, which is
+// diagonal.
+func (p PseudoHuber) LossHessian(outputs, targets []float32) *Hessian {
+	res := &Hessian{
+		Dim:  len(outputs),
+		Data: make([]float32, len(outputs)*len(outputs)),
+	}
+	delta := p.delta()
+	for i, x := range outputs {
+		d := float64(x-targets[i]) / delta
+		res.Data[i+i*res.Dim] = float32(math.Pow(1+d*d, -1.5))
+	}
+	return res
+}
+
+func (p PseudoHuber) delta() float64 {
+	if p.Delta == 0 {
+		return 1
+	}
+	return float64(p.Delta)
+}
+
+func (p PseudoHuber) LossPolynomialSize() int {
+	return 8
+}
+
+// LossPolynomials computes a Taylor series of the loss for
+// each output.
+//
+// The series is accurate for changes in the output which
+// are smaller than Delta.
+func (p PseudoHuber) LossPolynomials(outputs, targets []float32) []Polynomial {
+	res := make([]Polynomial, len(outputs))
+	delta := p.delta()
+	for i, x := range outputs {
+		// The loss is delta*sqrt(q(a))-delta^2, where
+		// q(a) = delta^2+(d+a)^2, and the series for the
+		// square root follows from sqrt(q)^2 = q.
+		d := float64(x - targets[i])
+		q := []float64{delta*delta + d*d, 2 * d, 1}
+		root := make([]float64, p.LossPolynomialSize())
+		root[0] = math.Sqrt(q[0])
+		for k := 1; k < len(root); k++ {
+			var qk float64
+			if k < len(q) {
+				qk = q[k]
+			}
+			for j := 1; j < k; j++ {
+				qk -= root[j] * root[k-j]
+			}
+			root[k] = qk / (2 * root[0])
+		}
+		poly := make(Polynomial, len(root))
+		for k, c := range root {
+			poly[k] = float32(delta * c)
+		}
+		poly[0] -= float32(delta * delta)
+		res[i] = poly
+	}
+	return res
+}
+
+// Pinball is the quantile regression loss, which is
+// minimized when the outputs are the given quantile of the
+// target distribution.
+//
+// The loss is piecewise linear, so it has no useful
+// Hessian. It should be used with GradientHeuristic, and
+// the leaves should be scaled with ScaleOptimalStep().
+type Pinball struct {
+	// Quantile is the quantile to predict, between 0 and
+	// 1. For example, 0.5 predicts the median.
+	Quantile float32
+}
+
+// Loss computes the total pinball loss.
+func (p Pinball) Loss(outputs, targets []float32) float32 {
+	var total float32
+	for i, x := range outputs {
+		d := targets[i] - x
+		if d >= 0 {
+			total += p.Quantile * d
+		} else {
+			total += (p.Quantile - 1) * d
+		}
+	}
+	return total
+}
+
+// LossGrad computes a subgradient of the loss with respect
+// to the outputs.
+func (p Pinball) LossGrad(outputs, targets []float32) []float32 {
+	res := make([]float32, len(outputs))
+	for i, x := range outputs {
+		if targets[i] > x {
+			res[i] = -p.Quantile
+		} else if targets[i] < x {
+			res[i] = 1 - p.Quantile
+		}
+	}
+	return res
+}
+
+// MultiQuantile is a pinball loss for predicting multiple
+// quantiles at once.
+//
+// The outputs contain one block for each quantile, and
+// each block contains one output per target.
+type MultiQuantile struct {
+	// Quantiles is the quantile for each block of outputs.
+	Quantiles []float32
+}
+
+// Sample samples from the distribution described by the
+// predicted quantiles, by linearly interpolating between
+// them.
+// Samples beyond the extreme quantiles are clipped to the
+// extreme quantiles.
+func (m *MultiQuantile) Sample(outputs []float32) []float32 {
+	blocks := m.blocks(outputs)
+	res := make([]float32, len(blocks[0]))
+	for i := range res {
+		quantiles := append([]float32{}, m.Quantiles...)
+		values := make([]float32, len(blocks))
+		for j, block := range blocks {
+			values[j] = block[i]
+		}
+		sortQuantiles(quantiles, values)
+
+		u := rand.Float32()
+		idx := sort.Search(len(quantiles), func(j int) bool {
+			return quantiles[j] >= u
+		})
+		if idx == 0 {
+			res[i] = values[0]
+		} else if idx == len(quantiles) {
+			res[i] = values[len(values)-1]
+		} else {
+			frac := (u - quantiles[idx-1]) / (quantiles[idx] - quantiles[idx-1])
+			res[i] = values[idx-1] + frac*(values[idx]-values[idx-1])
+		}
+	}
+	return res
+}
+
+// Loss computes the sum of the pinball losses.
+func (m *MultiQuantile) Loss(outputs, targets []float32) float32 {
+	var total float32
+	for i, block := range m.blocks(outputs) {
+		total += Pinball{Quantile: m.Quantiles[i]}.Loss(block, targets)
+	}
+	return total
+}
+
+// LossGrad computes a subgradient of the loss with respect
+// to the outputs.
+func (m *MultiQuantile) LossGrad(outputs, targets []float32) []float32 {
+	res := make([]float32, 0, len(outputs))
+	for i, block := range m.blocks(outputs) {
+		res = append(res, Pinball{Quantile: m.Quantiles[i]}.LossGrad(block, targets)...)
+	}
+	return res
+}
+
+func (m *MultiQuantile) blocks(outputs []float32) [][]float32 {
+	if len(outputs)%len(m.Quantiles) != 0 {
+		panic("incorrect output size")
+	}
+	size := len(outputs) / len(m.Quantiles)
+	res := make([][]float32, len(m.Quantiles))
+	for i := range res {
+		res[i] = outputs[i*size : (i+1)*size]
+	}
+	return res
+}
+
+// sortQuantiles sorts quantiles and their values.
+//
+// The values are sorted independently of the quantiles,
+// which fixes any crossing between predicted quantiles.
+func sortQuantiles(quantiles, values []float32) {
+	sort.Slice(quantiles, func(i, j int) bool {
+		return quantiles[i] < quantiles[j]
+	})
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+}
@@ -0,0 +1,109 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestHuber(t *testing.T) {
+	outputs := []float32{0.5, -1.2, 2, 0.1}
+	targets := []float32{0.3, 0.1, 4.5, -3}
+	if err := CheckLossGrad(Huber{Delta: 1}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+	if err := CheckLossHessian(Huber{Delta: 1}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+
+	// A zero delta should behave like the default.
+	actual := Huber{}.LossGrad(outputs, targets)
+	expected := Huber{Delta: 1}.LossGrad(outputs, targets)
+	for i, x := range expected {
+		if actual[i] != x {
+			t.Errorf("grad %d: expected default %f but got %f", i, x, actual[i])
+		}
+	}
+	actualLoss := Huber{}.Loss(outputs, targets)
+	expectedLoss := Huber{Delta: 1}.Loss(outputs, targets)
+	if actualLoss != expectedLoss {
+		t.Errorf("expected default loss %f but got %f", expectedLoss, actualLoss)
+	}
+}
+
+func TestPseudoHuber(t *testing.T) {
+	outputs := []float32{0.5, -1.2, 2, 0.1}
+	targets := []float32{0.3, 0.1, 4.5, -3}
+	for _, delta := range []float32{1, 2} {
+		l := PseudoHuber{Delta: delta}
+		if err := CheckLossGrad(l, outputs, targets, 1e-3); err != nil {
+			t.Errorf("delta %f: %s", delta, err)
+		}
+		if err := CheckLossHessian(l, outputs, targets, 1e-3); err != nil {
+			t.Errorf("delta %f: %s", delta, err)
+		}
+		if err := CheckLossPolynomials(l, outputs, targets, 1e-3); err != nil {
+			t.Errorf("delta %f: %s", delta, err)
+		}
+	}
+
+	// A zero delta should behave like the default.
+	actual := PseudoHuber{}.Loss(outputs, targets)
+	expected := PseudoHuber{Delta: 1}.Loss(outputs, targets)
+	if actual != expected {
+		t.Errorf("expected default loss %f but got %f", expected, actual)
+	}
+}
+
+func TestPinball(t *testing.T) {
+	outputs := []float32{0.5, -1.2, 2, 0.1}
+	targets := []float32{0.3, 0.1, 4.5, -3}
+	if err := CheckLossGrad(Pinball{Quantile: 0.8}, outputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+
+	mq := &MultiQuantile{Quantiles: []float32{0.1, 0.5, 0.9}}
+	mqOutputs := append(append(append([]float32{}, outputs...), outputs...), outputs...)
+	if err := CheckLossGrad(mq, mqOutputs, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPinballStep(t *testing.T) {
+	// Fitting a single leaf should find the quantile of
+	// the targets.
+	var seq Sequence
+	for i := 0; i < 1000; i++ {
+		seq = append(seq, &Timestep{
+			Output: []float32{0},
+			Target: []float32{float32(rand.NormFloat64())},
+		})
+	}
+	samples := TimestepSamples([]Sequence{seq})
+	loss := Pinball{Quantile: 0.9}
+	b := &Builder{Heuristic: GradientHeuristic{Loss: loss}}
+	tree := b.Build(samples)
+	ScaleOptimalStep(samples, tree, loss, 100, 1, 50)
+	actual := tree.Leaf.OutputDelta[0]
+	if math.Abs(float64(actual-1.28)) > 0.2 {
+		t.Errorf("expected quantile near 1.28 but got %f", actual)
+	}
+}
+
+func TestMultiQuantileSample(t *testing.T) {
+	mq := &MultiQuantile{Quantiles: []float32{0.9, 0.1, 0.5}}
+	outputs := []float32{10, 0, 5}
+	var below int
+	for i := 0; i < 10000; i++ {
+		x := mq.Sample(outputs)[0]
+		if x < 0 || x > 10 {
+			t.Fatalf("sample %f out of range", x)
+		}
+		if x < 5 {
+			below++
+		}
+	}
+	if below < 4500 || below > 5500 {
+		t.Errorf("unexpected number of samples below the median: %d", below)
+	}
+}
@@ -61,3 +61,57 @@ func BenchmarkSoftmaxLossGrad(b *testing.B) {
 		Softmax{}.LossGrad([]float32{1.5, -0.3}, []float32{1.0, 0})
 	}
 }
+
+func TestSoftmaxPolynomials(t *testing.T) {
+	for _, scale := range []float64{1, 5, 20} {
+		logits := make([]float32, 5)
+		targets := make([]float32, 5)
+		for i := range logits {
+			logits[i] = float32(rand.NormFloat64() * scale)
+		}
+		targets[rand.Intn(len(targets))] = 1
+		polys := Softmax{}.LossPolynomials(logits, targets)
+		for i, p := range polys {
+			for x := float32(-1.0); x <= 1.0; x += 0.1 {
+				l := append([]float32{}, logits...)
+				l[i] += x
+				expected := Softmax{}.Loss(l, targets)
+				actual := p.Apply(x)
+				if math.Abs(float64(actual-expected)) > 1e-4*math.Max(1, math.Abs(float64(expected))) {
+					t.Errorf("logit %d: delta %f: expected %f but got %f", i, x, expected, actual)
+				}
+			}
+		}
+	}
+}
+
+func TestLossHessianDiagonal(t *testing.T) {
+	for _, l := range []DiagonalHessianLossFunc{
+		Softmax{},
+		&MultiSoftmax{Sizes: []int{2, 3}, Weights: []float32{0.5, 2}},
+		Sigmoid{},
+	} {
+		logits := []float32{0.3, -0.2, 1.5, 0.1, -1}
+		targets := []float32{0, 1, 0, 0.5, 1}
+		hess := l.LossHessian(logits, targets)
+		diag := l.LossHessianDiagonal(logits, targets)
+		if len(diag) != hess.Dim {
+			t.Fatalf("%T: expected %d entries but got %d", l, hess.Dim, len(diag))
+		}
+		for i, x := range diag {
+			expected := hess.Data[i+i*hess.Dim]
+			if math.Abs(float64(x-expected)) > 1e-5 {
+				t.Errorf("%T: entry %d: expected %f but got %f", l, i, expected, x)
+			}
+		}
+	}
+}
+
+func TestMultiSoftmaxPolynomials(t *testing.T) {
+	m := &MultiSoftmax{Sizes: []int{2, 3}, Weights: []float32{0.5, 2}}
+	logits := []float32{0.3, -0.2, 1.5, 0.1, -1}
+	targets := []float32{0, 1, 0, 0, 1}
+	if err := CheckLossPolynomials(m, logits, targets, 1e-3); err != nil {
+		t.Error(err)
+	}
+}
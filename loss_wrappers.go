@@ -0,0 +1,388 @@
+package seqtree
+
+import (
+	"math"
+)
+
+// LabelSmoothing wraps a Softmax, *MultiSoftmax, or Sigmoid
+// loss and mixes the targets with a uniform distribution.
+type LabelSmoothing struct {
+	Base LossFunc
+
+	// Epsilon is the weight of the uniform distribution.
+	Epsilon float32
+}
+
+// Loss computes the loss with the smoothed targets.
+func (l *LabelSmoothing) Loss(outputs, targets []float32) float32 {
+	return blockLoss(l.Base, Softmax{}, l.transform, outputs, targets)
+}
+
+// LossGrad computes the gradient of the loss with respect
+// to the outputs.
+func (l *LabelSmoothing) LossGrad(outputs, targets []float32) []float32 {
+	return blockLossGrad(l.Base, Softmax{}, l.transform, outputs, targets)
+}
+
+// LossHessian computes the Hessian of the loss, which is
+// block-diagonal with one block per softmax.
+func (l *LabelSmoothing) LossHessian(outputs, targets []float32) *Hessian {
+	return blockLossHessian(l.Base, Softmax{}, l.transform, outputs, targets)
+}
+
+func (l *LabelSmoothing) LossPolynomialSize() int {
+	return Softmax{}.LossPolynomialSize()
+}
+
+func (l *LabelSmoothing) LossPolynomials(outputs, targets []float32) []Polynomial {
+	return blockLossPolynomials(l.Base, Softmax{}, l.transform, outputs, targets)
+}
+
+func (l *LabelSmoothing) transform(b classBlock, targets []float32) []float32 {
+	var sum float32
+	for _, t := range targets {
+		sum += t
+	}
+	uniform := l.Epsilon * sum / float32(len(targets))
+	res := make([]float32, len(targets))
+	for i, t := range targets {
+		res[i] = (1-l.Epsilon)*t + uniform
+	}
+	return res
+}
+
+// ClassWeights wraps a Softmax, *MultiSoftmax, or Sigmoid
+// loss and weights the loss for each class.
+type ClassWeights struct {
+	Base LossFunc
+
+	// Weights contains one weight per output.
+	//
+	// For softmax losses, this is the weight of the class
+	// corresponding to the output.
+	// For Sigmoid, this is the weight of positive targets
+	// for the output, relative to negative targets.
+	Weights []float32
+}
+
+// Loss computes the loss with each class weighted.
+func (c *ClassWeights) Loss(outputs, targets []float32) float32 {
+	return blockLoss(c.Base, Softmax{}, c.transform, outputs, targets)
+}
+
+// LossGrad computes the gradient of the loss with respect
+// to the outputs.
+func (c *ClassWeights) LossGrad(outputs, targets []float32) []float32 {
+	return blockLossGrad(c.Base, Softmax{}, c.transform, outputs, targets)
+}
+
+// LossHessian computes the Hessian of the loss, which is
+// block-diagonal with one block per softmax.
+func (c *ClassWeights) LossHessian(outputs, targets []float32) *Hessian {
+	return blockLossHessian(c.Base, Softmax{}, c.transform, outputs, targets)
+}
+
+func (c *ClassWeights) LossPolynomialSize() int {
+	return Softmax{}.LossPolynomialSize()
+}
+
+func (c *ClassWeights) LossPolynomials(outputs, targets []float32) []Polynomial {
+	return blockLossPolynomials(c.Base, Softmax{}, c.transform, outputs, targets)
+}
+
+func (c *ClassWeights) transform(b classBlock, targets []float32) []float32 {
+	return weightClasses(c.Weights, b, targets)
+}
+
+// Focal wraps a Softmax, *MultiSoftmax, or Sigmoid loss
+// and applies focal modulation, down-weighting the loss
+// for classes which are already predicted confidently.
+//
+// For each class, the loss is -(1-p)^Gamma*log(p).
+type Focal struct {
+	Base LossFunc
+
+	// Gamma is the focusing parameter. A value of 0 is
+	// equivalent to the base loss.
+	// Values between 0 and 1 may result in unbounded
+	// derivatives.
+	Gamma float32
+
+	// Weights, if non-nil, weights each class like the
+	// Weights in ClassWeights.
+	Weights []float32
+}
+
+// Loss computes the total focal loss.
+func (f *Focal) Loss(outputs, targets []float32) float32 {
+	return blockLoss(f.Base, focalSoftmax{f.Gamma}, f.transform, outputs, targets)
+}
+
+// LossGrad computes the gradient of the loss with respect
+// to the outputs.
+func (f *Focal) LossGrad(outputs, targets []float32) []float32 {
+	return blockLossGrad(f.Base, focalSoftmax{f.Gamma}, f.transform, outputs, targets)
+}
+
+// LossHessian computes the Hessian of the loss, which is
+// block-diagonal with one block per softmax.
+func (f *Focal) LossHessian(outputs, targets []float32) *Hessian {
+	return blockLossHessian(f.Base, focalSoftmax{f.Gamma}, f.transform, outputs, targets)
+}
+
+func (f *Focal) LossPolynomialSize() int {
+	return focalSoftmax{f.Gamma}.LossPolynomialSize()
+}
+
+// LossPolynomials approximates the loss along each output
+// with a second-order Taylor series.
+func (f *Focal) LossPolynomials(outputs, targets []float32) []Polynomial {
+	return blockLossPolynomials(f.Base, focalSoftmax{f.Gamma}, f.transform, outputs, targets)
+}
+
+func (f *Focal) transform(b classBlock, targets []float32) []float32 {
+	if f.Weights == nil {
+		return targets
+	}
+	return weightClasses(f.Weights, b, targets)
+}
+
+// focalSoftmax is the focal loss for a single softmax.
+type focalSoftmax struct {
+	Gamma float32
+}
+
+func (f focalSoftmax) Loss(outputs, targets []float32) float32 {
+	loss, _, _, _, _, _ := f.terms(outputs, targets)
+	return float32(loss)
+}
+
+func (f focalSoftmax) LossGrad(outputs, targets []float32) []float32 {
+	_, probs, tA, _, sumA, _ := f.terms(outputs, targets)
+	res := make([]float32, len(outputs))
+	for i, p := range probs {
+		res[i] = float32(tA[i] - p*sumA)
+	}
+	return res
+}
+
+func (f focalSoftmax) LossHessian(outputs, targets []float32) *Hessian {
+	_, p, tA, tB, sumA, sumB := f.terms(outputs, targets)
+	res := &Hessian{
+		Dim:  len(outputs),
+		Data: make([]float32, len(outputs)*len(outputs)),
+	}
+	for j := range p {
+		for k := range p {
+			val := -p[k]*(tA[j]+tB[j]) - p[j]*(tA[k]+tB[k]) + p[j]*p[k]*(2*sumA+sumB)
+			if j == k {
+				val += tA[j] + tB[j] - p[j]*sumA
+			}
+			res.Data[k+j*res.Dim] = float32(val)
+		}
+	}
+	return res
+}
+
+func (f focalSoftmax) LossPolynomialSize() int {
+	return 3
+}
+
+func (f focalSoftmax) LossPolynomials(outputs, targets []float32) []Polynomial {
+	loss := f.Loss(outputs, targets)
+	grad := f.LossGrad(outputs, targets)
+	hess := f.LossHessian(outputs, targets)
+	res := make([]Polynomial, len(outputs))
+	for i, g := range grad {
+		res[i] = Polynomial{loss, g, hess.Data[i+i*hess.Dim] / 2}
+	}
+	return res
+}
+
+// terms computes the loss, the probabilities, and the
+// terms t*A and t*B (along with their sums) where
+// A = p*phi'(p) and B = p^2*phi''(p), and phi(p) is the
+// per-class loss.
+func (f focalSoftmax) terms(outputs, targets []float32) (loss float64, probs, tA, tB []float64,
+	sumA, sumB float64) {
+	gamma := float64(f.Gamma)
+	logProbs := Softmax{}.logSoftmax(outputs)
+	probs = make([]float64, len(outputs))
+	tA = make([]float64, len(outputs))
+	tB = make([]float64, len(outputs))
+	for i, lp := range logProbs {
+		logP := float64(lp)
+		p := math.Exp(logP)
+		q := -math.Expm1(logP)
+		t := float64(targets[i])
+
+		// Powers of (1-p), where 0^x is treated as 0 for
+		// any non-zero x, since these terms are multiplied
+		// by log(p) or vanish as p approaches 1.
+		pow := func(e float64) float64 {
+			if e == 0 {
+				return 1
+			} else if q == 0 {
+				return 0
+			}
+			return math.Pow(q, e)
+		}
+
+		a := -pow(gamma)
+		b := pow(gamma)
+		if gamma != 0 {
+			a += gamma * p * pow(gamma-1) * logP
+			b += 2 * gamma * p * pow(gamma-1)
+			if gamma != 1 {
+				b -= gamma * (gamma - 1) * p * p * pow(gamma-2) * logP
+			}
+		}
+
+		loss -= t * pow(gamma) * logP
+		probs[i] = p
+		tA[i] = t * a
+		tB[i] = t * b
+		sumA += tA[i]
+		sumB += tB[i]
+	}
+	return
+}
+
+// A classBlock is a single softmax decision within the
+// outputs of a classification loss.
+type classBlock struct {
+	// Start is the index of the block's first output.
+	Start int
+
+	// Size is the number of outputs in the block.
+	Size int
+
+	// Weight is the weight of the block's loss.
+	Weight float32
+
+	// Sigmoid indicates that the block has a single
+	// output, which is a logit compared against a fixed
+	// logit of zero.
+	Sigmoid bool
+}
+
+// Split gets the logits and targets for the block's
+// softmax.
+func (c classBlock) Split(outputs, targets []float32) ([]float32, []float32) {
+	if c.Sigmoid {
+		t := targets[c.Start]
+		return []float32{outputs[c.Start], 0}, []float32{t, 1 - t}
+	}
+	end := c.Start + c.Size
+	return outputs[c.Start:end], targets[c.Start:end]
+}
+
+// classBlocks splits up the outputs of a classification
+// loss into independent softmax decisions.
+func classBlocks(l LossFunc, numOutputs int) []classBlock {
+	switch l := l.(type) {
+	case Softmax:
+		return []classBlock{{Size: numOutputs, Weight: 1}}
+	case *MultiSoftmax:
+		var res []classBlock
+		var start int
+		for i, size := range l.Sizes {
+			w := float32(1)
+			if l.Weights != nil {
+				w = l.Weights[i]
+			}
+			res = append(res, classBlock{Start: start, Size: size, Weight: w})
+			start += size
+		}
+		if start != numOutputs {
+			panic("incorrect input size")
+		}
+		return res
+	case Sigmoid:
+		res := make([]classBlock, numOutputs)
+		for i := range res {
+			res[i] = classBlock{Start: i, Size: 1, Weight: 1, Sigmoid: true}
+		}
+		return res
+	default:
+		panic("unsupported base loss")
+	}
+}
+
+// A blockTransform modifies the targets of a classBlock,
+// as returned by classBlock.Split().
+type blockTransform func(b classBlock, targets []float32) []float32
+
+// A blockLossFunc is the loss of a single classBlock.
+type blockLossFunc interface {
+	HessianLossFunc
+	PolynomialLossFunc
+}
+
+func blockLoss(base LossFunc, l blockLossFunc, f blockTransform,
+	outputs, targets []float32) float32 {
+	var total float32
+	for _, b := range classBlocks(base, len(outputs)) {
+		logits, blockTargets := b.Split(outputs, targets)
+		total += b.Weight * l.Loss(logits, f(b, blockTargets))
+	}
+	return total
+}
+
+func blockLossGrad(base LossFunc, l blockLossFunc, f blockTransform,
+	outputs, targets []float32) []float32 {
+	res := make([]float32, len(outputs))
+	for _, b := range classBlocks(base, len(outputs)) {
+		logits, blockTargets := b.Split(outputs, targets)
+		grad := l.LossGrad(logits, f(b, blockTargets))
+		for i := 0; i < b.Size; i++ {
+			res[b.Start+i] = b.Weight * grad[i]
+		}
+	}
+	return res
+}
+
+func blockLossHessian(base LossFunc, l blockLossFunc, f blockTransform,
+	outputs, targets []float32) *Hessian {
+	res := &Hessian{
+		Dim:  len(outputs),
+		Data: make([]float32, len(outputs)*len(outputs)),
+	}
+	for _, b := range classBlocks(base, len(outputs)) {
+		logits, blockTargets := b.Split(outputs, targets)
+		h := l.LossHessian(logits, f(b, blockTargets))
+		for i := 0; i < b.Size; i++ {
+			for j := 0; j < b.Size; j++ {
+				res.Data[b.Start+j+(b.Start+i)*res.Dim] = b.Weight * h.Data[j+i*h.Dim]
+			}
+		}
+	}
+	return res
+}
+
+func blockLossPolynomials(base LossFunc, l blockLossFunc, f blockTransform,
+	outputs, targets []float32) []Polynomial {
+	res := make([]Polynomial, len(outputs))
+	for _, b := range classBlocks(base, len(outputs)) {
+		logits, blockTargets := b.Split(outputs, targets)
+		polys := l.LossPolynomials(logits, f(b, blockTargets))
+		for i := 0; i < b.Size; i++ {
+			res[b.Start+i] = polys[i].Scale(b.Weight)
+		}
+	}
+	return res
+}
+
+// weightClasses applies ClassWeights-style weights to the
+// targets of a block.
+func weightClasses(weights []float32, b classBlock, targets []float32) []float32 {
+	res := append([]float32{}, targets...)
+	if b.Sigmoid {
+		res[0] *= weights[b.Start]
+	} else {
+		for i := range res {
+			res[i] *= weights[b.Start+i]
+		}
+	}
+	return res
+}
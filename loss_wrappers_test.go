@@ -0,0 +1,150 @@
+package seqtree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLossWrappers(t *testing.T) {
+	for _, base := range wrapperTestBases() {
+		outputs, targets := base.Outputs, base.Targets
+		weights := make([]float32, len(outputs))
+		for i := range weights {
+			weights[i] = 0.5 + float32(i)*0.3
+		}
+		losses := []HessianLossFunc{
+			&LabelSmoothing{Base: base.Loss, Epsilon: 0.1},
+			&ClassWeights{Base: base.Loss, Weights: weights},
+			&Focal{Base: base.Loss, Gamma: 2},
+			&Focal{Base: base.Loss, Gamma: 1, Weights: weights},
+			&Focal{Base: base.Loss, Gamma: 1.5},
+		}
+		for _, l := range losses {
+			if err := CheckLossGrad(l, outputs, targets, 1e-3); err != nil {
+				t.Errorf("%T: %s", l, err)
+			}
+			if err := CheckLossHessian(l, outputs, targets, 1e-3); err != nil {
+				t.Errorf("%T: %s", l, err)
+			}
+		}
+		for _, l := range losses[:2] {
+			if err := CheckLossPolynomials(l.(PolynomialLossFunc), outputs, targets, 1e-3); err != nil {
+				t.Errorf("%T: %s", l, err)
+			}
+		}
+	}
+}
+
+func TestFocalPolynomials(t *testing.T) {
+	// The polynomials are second-order Taylor series, so
+	// they are only checked for very small steps.
+	for _, base := range wrapperTestBases() {
+		outputs, targets := base.Outputs, base.Targets
+		weights := make([]float32, len(outputs))
+		for i := range weights {
+			weights[i] = 0.5 + float32(i)*0.3
+		}
+		for _, l := range []*Focal{
+			{Base: base.Loss, Gamma: 2},
+			{Base: base.Loss, Gamma: 1, Weights: weights},
+		} {
+			polys := l.LossPolynomials(outputs, targets)
+			if len(polys) != len(outputs) {
+				t.Fatalf("expected %d polynomials but got %d", len(outputs), len(polys))
+			}
+			baseLoss := l.Loss(outputs, targets)
+			o := append([]float32{}, outputs...)
+			for i, p := range polys {
+				if len(p) != l.LossPolynomialSize() {
+					t.Errorf("polynomial %d: expected size %d but got %d", i,
+						l.LossPolynomialSize(), len(p))
+				}
+				for _, delta := range []float32{-0.05, 0.05} {
+					o[i] = outputs[i] + delta
+					expected := l.Loss(o, targets) - baseLoss
+					o[i] = outputs[i]
+					actual := p.Apply(delta) - p.Apply(0)
+					if math.Abs(float64(actual-expected)) > 1e-4 {
+						t.Errorf("%T: polynomial %d: delta %f: expected %f but got %f",
+							base.Loss, i, delta, expected, actual)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestLossWrappersIdentity(t *testing.T) {
+	for _, base := range wrapperTestBases() {
+		outputs, targets := base.Outputs, base.Targets
+		ones := make([]float32, len(outputs))
+		for i := range ones {
+			ones[i] = 1
+		}
+		losses := []HessianLossFunc{
+			&LabelSmoothing{Base: base.Loss},
+			&ClassWeights{Base: base.Loss, Weights: ones},
+			&Focal{Base: base.Loss},
+		}
+		expectedLoss := base.Loss.Loss(outputs, targets)
+		expectedGrad := base.Loss.LossGrad(outputs, targets)
+		expectedHessian := base.Loss.LossHessian(outputs, targets)
+		for _, l := range losses {
+			if actual := l.Loss(outputs, targets); math.Abs(float64(actual-expectedLoss)) > 1e-4 {
+				t.Errorf("%T: expected loss %f but got %f", l, expectedLoss, actual)
+			}
+			actualGrad := l.LossGrad(outputs, targets)
+			for i, x := range expectedGrad {
+				if math.Abs(float64(actualGrad[i]-x)) > 1e-4 {
+					t.Errorf("%T: grad %d: expected %f but got %f", l, i, x, actualGrad[i])
+				}
+			}
+			actualHessian := l.LossHessian(outputs, targets)
+			for i, x := range expectedHessian.Data {
+				if math.Abs(float64(actualHessian.Data[i]-x)) > 1e-4 {
+					t.Errorf("%T: hessian %d: expected %f but got %f", l, i, x,
+						actualHessian.Data[i])
+				}
+			}
+		}
+	}
+}
+
+func TestFocalDownweights(t *testing.T) {
+	outputs := []float32{3, 0, -1}
+	confident := []float32{1, 0, 0}
+	wrong := []float32{0, 0, 1}
+	focal := &Focal{Base: Softmax{}, Gamma: 2}
+	ratioConfident := focal.Loss(outputs, confident) / Softmax{}.Loss(outputs, confident)
+	ratioWrong := focal.Loss(outputs, wrong) / Softmax{}.Loss(outputs, wrong)
+	if ratioConfident >= ratioWrong {
+		t.Errorf("confident ratio %f should be less than wrong ratio %f", ratioConfident,
+			ratioWrong)
+	}
+}
+
+type wrapperTestBase struct {
+	Loss    HessianLossFunc
+	Outputs []float32
+	Targets []float32
+}
+
+func wrapperTestBases() []wrapperTestBase {
+	return []wrapperTestBase{
+		{
+			Loss:    Softmax{},
+			Outputs: []float32{0.5, -1, 2, 0.3},
+			Targets: []float32{0, 0.2, 0.8, 0},
+		},
+		{
+			Loss:    &MultiSoftmax{Sizes: []int{2, 3}, Weights: []float32{0.5, 2}},
+			Outputs: []float32{0.5, -1, 2, 0.3, -0.7},
+			Targets: []float32{1, 0, 0, 0, 1},
+		},
+		{
+			Loss:    Sigmoid{},
+			Outputs: []float32{0.5, -1, 2},
+			Targets: []float32{1, 0, 0.3},
+		},
+	}
+}
@@ -29,39 +29,11 @@ func (h *Hessian) Apply(v []float32) []float32 {
 }
 
 // ApplyInverse solves the equation Hx = b for x.
+//
+// This uses the conjugate gradient method, with the
+// default settings of CGSolver.
 func (h *Hessian) ApplyInverse(b []float32) []float32 {
-	// Use the conjugate gradient method.
-	// See https://en.wikipedia.org/wiki/Conjugate_gradient_method.
-
-	earlyStopError := math.Sqrt(float64(vectorNormSquared(b))) * 1e-5
-
-	x := make([]float32, len(b))
-	r := vectorDifference(b, h.Apply(x))
-	p := r
-
-	// Hard-limit the number of iterations to avoid bad
-	// computation times for poorly conditioned problems.
-	for i := 0; i < h.Dim*2; i++ {
-		rMag := vectorNormSquared(r)
-		if math.Sqrt(float64(rMag)) <= earlyStopError {
-			break
-		}
-
-		hp := h.Apply(p)
-		a := rMag / vectorDot(p, hp)
-		nextX := addDelta(x, p, a)
-
-		// Use explicit update for r to avoid compounding
-		// error over many updates.
-		nextR := vectorDifference(b, h.Apply(nextX))
-		nextRMag := vectorNormSquared(nextR)
-
-		beta := nextRMag / rMag
-		nextP := addDelta(nextR, p, beta)
-		x, r, p = nextX, nextR, nextP
-	}
-
-	return x
+	return CGSolver{}.Solve(h, b)
 }
 
 // A Polynomial is a single-variable polynomial, where the
@@ -1,6 +1,9 @@
 package seqtree
 
-import "math"
+import (
+	"math"
+	"math/rand"
+)
 
 // minimizeUnary minimizes a function of one variable
 // along an interval.
@@ -70,3 +73,30 @@ func vectorDot(v1, v2 []float32) float32 {
 	}
 	return res
 }
+
+// randIntn is like rand.Intn, but uses gen if it is
+// non-nil.
+func randIntn(gen *rand.Rand, n int) int {
+	if gen == nil {
+		return rand.Intn(n)
+	}
+	return gen.Intn(n)
+}
+
+// randPerm is like rand.Perm, but uses gen if it is
+// non-nil.
+func randPerm(gen *rand.Rand, n int) []int {
+	if gen == nil {
+		return rand.Perm(n)
+	}
+	return gen.Perm(n)
+}
+
+// randFloat64 is like rand.Float64, but uses gen if it is
+// non-nil.
+func randFloat64(gen *rand.Rand) float64 {
+	if gen == nil {
+		return rand.Float64()
+	}
+	return gen.Float64()
+}
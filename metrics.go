@@ -0,0 +1,227 @@
+package seqtree
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var metricsCSVHeader = []string{
+	"iteration",
+	"train_loss",
+	"loss_delta",
+	"valid_loss",
+	"step_size",
+	"num_leaves",
+	"seconds",
+}
+
+// A MetricsSink records the metrics from training.
+type MetricsSink interface {
+	WriteMetrics(m *IterationMetrics) error
+}
+
+// JSONLSink is a MetricsSink which writes one JSON object
+// per line.
+type JSONLSink struct {
+	W io.Writer
+}
+
+func (j *JSONLSink) WriteMetrics(m *IterationMetrics) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "write metrics")
+	}
+	if _, err := j.W.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "write metrics")
+	}
+	return nil
+}
+
+// CSVSink is a MetricsSink which writes rows of a CSV
+// file.
+type CSVSink struct {
+	W io.Writer
+
+	// NoHeader, if true, prevents a header from being
+	// written before the first row, for example when
+	// appending to an existing file.
+	NoHeader bool
+
+	wroteHeader bool
+}
+
+func (c *CSVSink) WriteMetrics(m *IterationMetrics) error {
+	w := csv.NewWriter(c.W)
+	if !c.NoHeader && !c.wroteHeader {
+		w.Write(metricsCSVHeader)
+		c.wroteHeader = true
+	}
+	w.Write([]string{
+		strconv.Itoa(m.Iteration),
+		formatMetric(float64(m.TrainLoss)),
+		formatMetric(float64(m.LossDelta)),
+		formatOptionalMetric(m.ValidLoss),
+		formatMetric(float64(m.StepSize)),
+		strconv.Itoa(m.NumLeaves),
+		strconv.FormatFloat(m.Seconds, 'g', -1, 64),
+	})
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return errors.Wrap(err, "write metrics")
+	}
+	return nil
+}
+
+// A MetricsFile is a MetricsSink which appends to a file.
+//
+// Paths ending in ".csv" are written as CSV, and other
+// paths are written as JSONL.
+type MetricsFile struct {
+	f    *os.File
+	sink MetricsSink
+}
+
+// OpenMetricsFile opens a file for appending metrics,
+// creating it if necessary.
+func OpenMetricsFile(path string) (*MetricsFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open metrics")
+	}
+	res := &MetricsFile{f: f}
+	if isCSVPath(path) {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "open metrics")
+		}
+		res.sink = &CSVSink{W: f, NoHeader: info.Size() > 0}
+	} else {
+		res.sink = &JSONLSink{W: f}
+	}
+	return res, nil
+}
+
+func (m *MetricsFile) WriteMetrics(metrics *IterationMetrics) error {
+	return m.sink.WriteMetrics(metrics)
+}
+
+// Close closes the underlying file.
+func (m *MetricsFile) Close() error {
+	return m.f.Close()
+}
+
+// ReadMetrics reads metrics written to a CSV or JSONL
+// file.
+//
+// If an iteration appears more than once, as happens when
+// a run is resumed from a checkpoint, the last entry wins
+// and the result is truncated after it.
+func ReadMetrics(path string) ([]IterationMetrics, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read metrics")
+	}
+	defer f.Close()
+
+	var entries []IterationMetrics
+	if isCSVPath(path) {
+		entries, err = readCSVMetrics(f)
+	} else {
+		entries, err = readJSONLMetrics(f)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read metrics")
+	}
+
+	var res []IterationMetrics
+	for _, m := range entries {
+		for len(res) > 0 && res[len(res)-1].Iteration >= m.Iteration {
+			res = res[:len(res)-1]
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func readJSONLMetrics(r io.Reader) ([]IterationMetrics, error) {
+	var res []IterationMetrics
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var m IterationMetrics
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, scanner.Err()
+}
+
+func readCSVMetrics(r io.Reader) ([]IterationMetrics, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var res []IterationMetrics
+	for _, row := range rows {
+		if len(row) != len(metricsCSVHeader) {
+			return nil, errors.New("unexpected number of columns")
+		}
+		if row[0] == metricsCSVHeader[0] {
+			continue
+		}
+		values := make([]float64, len(row))
+		for i, x := range row {
+			if i == 3 && x == "" {
+				continue
+			}
+			values[i], err = strconv.ParseFloat(x, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+		m := IterationMetrics{
+			Iteration: int(values[0]),
+			TrainLoss: float32(values[1]),
+			LossDelta: float32(values[2]),
+			StepSize:  float32(values[4]),
+			NumLeaves: int(values[5]),
+			Seconds:   values[6],
+		}
+		if row[3] != "" {
+			validLoss := float32(values[3])
+			m.ValidLoss = &validLoss
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func formatMetric(x float64) string {
+	return strconv.FormatFloat(x, 'g', -1, 32)
+}
+
+// formatOptionalMetric formats a metric which may be
+// missing, in which case the cell is left empty.
+func formatOptionalMetric(x *float32) string {
+	if x == nil {
+		return ""
+	}
+	return formatMetric(float64(*x))
+}
+
+func isCSVPath(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".csv"
+}
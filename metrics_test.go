@@ -0,0 +1,124 @@
+package seqtree
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMetricsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	metrics := []IterationMetrics{
+		{Iteration: 0, TrainLoss: 2.5, LossDelta: -0.25, ValidLoss: testFloat32(2.75),
+			StepSize: 0.5, NumLeaves: 7, Seconds: 1.5},
+		{Iteration: 1, TrainLoss: 2.25, LossDelta: -0.125, ValidLoss: testFloat32(0),
+			StepSize: 0.5, NumLeaves: 8, Seconds: 1.25},
+		{Iteration: 2, TrainLoss: 2.125, LossDelta: -0.0625, ValidLoss: testFloat32(-0.5),
+			StepSize: 0.25, NumLeaves: 3, Seconds: 0.75},
+		{Iteration: 3, TrainLoss: 2, LossDelta: -0.0625, StepSize: 0.25, NumLeaves: 3,
+			Seconds: 0.5},
+	}
+
+	for _, name := range []string{"metrics.jsonl", "metrics.csv"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+
+			// Simulate a run which is interrupted after logging
+			// iteration 1 but before checkpointing it, and which
+			// is then resumed from iteration 1.
+			for _, part := range [][]IterationMetrics{metrics[:2], metrics[1:]} {
+				f, err := OpenMetricsFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, m := range part {
+					if err := f.WriteMetrics(&m); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			actual, err := ReadMetrics(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(actual) != len(metrics) {
+				t.Fatalf("expected %d entries but got %d", len(metrics), len(actual))
+			}
+			for i, x := range metrics {
+				if !reflect.DeepEqual(actual[i], x) {
+					t.Errorf("entry %d: expected %+v but got %+v", i, x, actual[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTrainerMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.csv")
+	f, err := OpenMetricsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trainer := &Trainer{
+		Model: &Model{BaseFeatures: 5},
+		Builder: &Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			Depth:           2,
+			MinSplitSamples: 5,
+			Horizons:        []int{0, 1},
+		},
+		Loss: Softmax{},
+		Train: func(m *Model, gen *rand.Rand) []Sequence {
+			return successorTestSequences(gen, m, 10)
+		},
+		Metrics: f,
+	}
+	expected, err := trainer.Run(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ReadMetrics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d entries but got %d", len(expected), len(actual))
+	}
+	for i, x := range expected {
+		if !reflect.DeepEqual(actual[i], x) {
+			t.Errorf("entry %d: expected %+v but got %+v", i, x, actual[i])
+		}
+		if x.ValidLoss != nil {
+			t.Errorf("entry %d: expected no validation loss", i)
+		}
+		if x.Seconds <= 0 {
+			t.Errorf("entry %d: expected positive wall time", i)
+		}
+	}
+}
+
+func testFloat32(x float32) *float32 {
+	return &x
+}
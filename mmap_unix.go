@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package seqtree
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile memory-maps an entire file.
+//
+// If writable is true, writes to the resulting buffer
+// are reflected in the file.
+func mapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+// unmapFile releases a buffer from mapFile.
+func unmapFile(f *os.File, data []byte, writable bool) error {
+	if data == nil {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,26 @@
+package seqtree
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads an entire file into memory, since memory
+// mapping is not supported on this platform.
+func mapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, int64(size)), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmapFile writes the buffer back to the file if it was
+// mapped as writable.
+func unmapFile(f *os.File, data []byte, writable bool) error {
+	if !writable || data == nil {
+		return nil
+	}
+	_, err := f.WriteAt(data, 0)
+	return err
+}
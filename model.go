@@ -25,6 +25,11 @@ type Model struct {
 	// This slice is ordered, and trees should be run from
 	// first to last.
 	Trees []*Tree
+
+	// Weights, if non-nil, scales the outputs of each tree
+	// in Trees. This is used for DART, which rescales
+	// trees after they have been added.
+	Weights []float32 `json:",omitempty"`
 }
 
 // NumFeatures gets the total number of features expected
@@ -43,12 +48,27 @@ func (m *Model) Evaluate(seq Sequence) {
 // EvaluateAt is like Evaluate(), but it starts at the
 // given index of the sequence.
 func (m *Model) EvaluateAt(seq Sequence, start int) {
-	for _, t := range m.Trees {
+	m.evaluateAt(seq, start, nil)
+}
+
+func (m *Model) evaluateAt(seq Sequence, start int, dropped map[int]bool) {
+	for j, t := range m.Trees {
+		weight := m.weight(j)
+		if dropped[j] {
+			// Dropped trees may still add features which
+			// later trees depend on.
+			if t.NumFeatures() == 0 {
+				continue
+			}
+			weight = 0
+		}
 		for i, ts := range seq[start:] {
 			leaf := t.Evaluate(&TimestepSample{Sequence: seq, Index: i + start})
-			v1 := blas32.Vector{Inc: 1, Data: leaf.OutputDelta}
-			v2 := blas32.Vector{Inc: 1, Data: ts.Output}
-			blas32.Axpy(len(ts.Output), 1.0, v1, v2)
+			if weight != 0 {
+				v1 := blas32.Vector{Inc: 1, Data: leaf.OutputDelta}
+				v2 := blas32.Vector{Inc: 1, Data: ts.Output}
+				blas32.Axpy(len(ts.Output), weight, v1, v2)
+			}
 			if leaf.Feature != 0 {
 				ts.Features.Set(leaf.Feature, true)
 			}
@@ -58,6 +78,20 @@ func (m *Model) EvaluateAt(seq Sequence, start int) {
 
 // EvaluateAll evaluates the model on a list of sequences.
 func (m *Model) EvaluateAll(seqs []Sequence) {
+	m.EvaluateAllDropped(seqs, nil)
+}
+
+// EvaluateAllDropped is like EvaluateAll(), but it skips
+// the outputs of the trees at the given indices.
+//
+// Features from dropped trees are still set, since later
+// trees may depend on them.
+func (m *Model) EvaluateAllDropped(seqs []Sequence, dropped []int) {
+	droppedSet := map[int]bool{}
+	for _, i := range dropped {
+		droppedSet[i] = true
+	}
+
 	ch := make(chan Sequence, len(seqs))
 	for _, x := range seqs {
 		ch <- x
@@ -70,7 +104,7 @@ func (m *Model) EvaluateAll(seqs []Sequence) {
 		go func() {
 			defer wg.Done()
 			for seq := range ch {
-				m.Evaluate(seq)
+				m.evaluateAt(seq, 0, droppedSet)
 			}
 		}()
 	}
@@ -78,21 +112,64 @@ func (m *Model) EvaluateAll(seqs []Sequence) {
 	wg.Wait()
 }
 
+// EvaluateSource evaluates the model on every sequence in
+// a SequenceSource, one chunk at a time.
+func (m *Model) EvaluateSource(src SequenceSource) error {
+	return src.IterateChunks(m.ExtraFeatures > 0, func(chunk []Sequence) {
+		m.EvaluateAll(chunk)
+	})
+}
+
 // Add adds a tree to the model, scaling it according to
 // the stepSize.
 func (m *Model) Add(t *Tree, stepSize float32) {
 	t.Scale(stepSize)
 	m.Trees = append(m.Trees, t)
+	if m.Weights != nil {
+		m.Weights = append(m.Weights, 1)
+	}
 	m.ExtraFeatures += t.NumFeatures()
 }
 
+// Truncate removes all but the first numTrees trees from
+// the model, along with the features they added.
+func (m *Model) Truncate(numTrees int) {
+	for _, t := range m.Trees[numTrees:] {
+		m.ExtraFeatures -= t.NumFeatures()
+	}
+	m.Trees = m.Trees[:numTrees]
+	if m.Weights != nil {
+		m.Weights = m.Weights[:numTrees]
+	}
+}
+
+// weight gets the output scale for the tree at the index.
+func (m *Model) weight(i int) float32 {
+	if m.Weights == nil {
+		return 1
+	}
+	return m.Weights[i]
+}
+
+// Reweight multiplies the output scale of the tree at the
+// index by the given factor.
+func (m *Model) Reweight(i int, scale float32) {
+	if m.Weights == nil {
+		m.Weights = make([]float32, len(m.Trees))
+		for j := range m.Weights {
+			m.Weights[j] = 1
+		}
+	}
+	m.Weights[i] *= scale
+}
+
 // Save saves the model to a JSON file.
 func (m *Model) Save(path string) error {
 	data, err := json.Marshal(m)
 	if err != nil {
 		return errors.Wrap(err, "save model")
 	}
-	if err := ioutil.WriteFile(path, data, 0755); err != nil {
+	if err := writeFileAtomic(path, data, 0644); err != nil {
 		return errors.Wrap(err, "save model")
 	}
 	return nil
@@ -135,6 +212,7 @@ func (t *Tree) Copy() *Tree {
 		return &Tree{
 			Branch: &Branch{
 				Feature:     append(BranchFeatureUnion{}, t.Branch.Feature...),
+				Formula:     t.Branch.Formula.Copy(),
 				FalseBranch: t.Branch.FalseBranch.Copy(),
 				TrueBranch:  t.Branch.TrueBranch.Copy(),
 			},
@@ -147,10 +225,8 @@ func (t *Tree) Evaluate(ts *TimestepSample) *Leaf {
 	if t.Leaf != nil {
 		return t.Leaf
 	}
-	for _, f := range t.Branch.Feature {
-		if ts.BranchFeature(f) {
-			return t.Branch.TrueBranch.Evaluate(ts)
-		}
+	if t.Branch.Evaluate(ts) {
+		return t.Branch.TrueBranch.Evaluate(ts)
 	}
 	return t.Branch.FalseBranch.Evaluate(ts)
 }
@@ -192,11 +268,35 @@ func (t *Tree) Scale(s float32) {
 // Branch represents tree nodes that split into two
 // sub-nodes.
 type Branch struct {
-	Feature     BranchFeatureUnion
+	Feature BranchFeatureUnion
+
+	// Formula, if non-nil, is used as the branch condition
+	// instead of Feature.
+	Formula BranchFormula `json:",omitempty"`
+
 	FalseBranch *Tree
 	TrueBranch  *Tree
 }
 
+// Evaluate checks if the branch condition is true for the
+// timestep.
+func (b *Branch) Evaluate(ts *TimestepSample) bool {
+	if b.Formula != nil {
+		for _, term := range b.Formula {
+			if ts.BranchTerm(term) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, f := range b.Feature {
+		if ts.BranchFeature(f) {
+			return true
+		}
+	}
+	return false
+}
+
 // Leaf represents terminal tree nodes.
 type Leaf struct {
 	// OutputDelta is the vector to add to the prediction
@@ -214,15 +314,90 @@ type Leaf struct {
 type BranchFeature struct {
 	// The feature index to split on.
 	// Can be -1 to indicate that StepsInPast goes beyond
-	// the beginning of the sequence.
+	// the beginning of the sequence, or that Offset goes
+	// outside of the grid.
 	Feature int
 
 	// StepsInPast indicates how many timesteps ago we
 	// will look at the feature. A value of 0 means the
 	// feature at the most recent timestep.
 	StepsInPast int
+
+	// GridWidth, if non-zero, indicates that this is a 2D
+	// feature for sequences which are row-major grids
+	// with GridWidth columns. In this case, Offset is used
+	// instead of StepsInPast.
+	GridWidth int `json:",omitempty"`
+
+	// Offset is the position of the feature relative to
+	// the current position in the grid.
+	// If nil, the offset is (0, 0).
+	Offset *Offset2D `json:",omitempty"`
+}
+
+// Is2D checks if the feature refers to a grid offset.
+func (b BranchFeature) Is2D() bool {
+	return b.GridWidth != 0
+}
+
+// offset gets the grid offset, treating nil as (0, 0).
+func (b BranchFeature) offset() Offset2D {
+	if b.Offset == nil {
+		return Offset2D{}
+	}
+	return *b.Offset
+}
+
+// An Offset2D is a relative position in a grid.
+//
+// An offset of (0, 0) refers to the current timestep,
+// and negative DY values refer to previous rows.
+type Offset2D struct {
+	DX int
+	DY int
 }
 
 // A BranchFeatureUnion is a logical OR of BranchFeatures.
 // An empty union is always false.
 type BranchFeatureUnion []BranchFeature
+
+// A BranchLiteral is a BranchFeature which may be negated.
+type BranchLiteral struct {
+	BranchFeature
+
+	// Negate, if true, indicates that the literal is true
+	// when the feature is false.
+	Negate bool `json:",omitempty"`
+}
+
+// A BranchTerm is a logical AND of BranchLiterals.
+// An empty term is always true.
+type BranchTerm []BranchLiteral
+
+// A BranchFormula is a logical OR of BranchTerms.
+// An empty formula is always false.
+type BranchFormula []BranchTerm
+
+// Copy creates a deep copy of the formula.
+func (b BranchFormula) Copy() BranchFormula {
+	if b == nil {
+		return nil
+	}
+	res := make(BranchFormula, len(b))
+	for i, term := range b {
+		res[i] = append(BranchTerm{}, term...)
+	}
+	return res
+}
+
+// Features gets all of the features referenced by the
+// formula, in order.
+func (b BranchFormula) Features() []BranchFeature {
+	var res []BranchFeature
+	for _, term := range b {
+		for _, l := range term {
+			res = append(res, l.BranchFeature)
+		}
+	}
+	return res
+}
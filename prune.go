@@ -1,12 +1,25 @@
 package seqtree
 
-import (
-	"math"
-	"runtime"
-	"sync"
+// A TreePruner simplifies trees to prevent overfitting.
+type TreePruner interface {
+	Prune(samples []*TimestepSample, t *Tree) *Tree
+}
+
+// A ValidationPruner is a TreePruner which can select a
+// subtree using separate validation samples.
+type ValidationPruner interface {
+	TreePruner
 
-	"github.com/unixpickle/essentials"
-)
+	// PruneValidation prunes the tree using the train
+	// samples, selecting among candidate subtrees with the
+	// validation samples.
+	//
+	// The scale function, if non-nil, is applied to every
+	// candidate before it is scored, and the outputs of
+	// the candidates are multiplied by stepSize.
+	PruneValidation(train, valid []*TimestepSample, t *Tree, scale func(t *Tree),
+		stepSize float32) *Tree
+}
 
 // A Pruner stores parameters for pruning trees to prevent
 // overfitting.
@@ -24,95 +37,42 @@ func (p *Pruner) Prune(samples []*TimestepSample, t *Tree) *Tree {
 	if p.MaxLeaves < 1 {
 		panic("cannot restrict to fewer than 1 leaves")
 	}
-	vecSamples := newVecSamples(p.Heuristic, samples)
-	result := t
-	for len(result.Leaves()) > p.MaxLeaves {
-		result = p.bestPrune(vecSamples, result)
-	}
-	if result != t {
-		result = result.Copy()
-		p.recomputeOutputDeltas(vecSamples, result)
+	if len(t.Leaves()) <= p.MaxLeaves {
+		return t
 	}
+	vecSamples := newVecSamples(p.Heuristic, samples)
+	engine := newPruneEngine(p.Heuristic, vecSamples, t)
+	engine.PruneTo(p.MaxLeaves)
+	result := engine.Tree().Copy()
+	p.recomputeOutputDeltas(vecSamples, result)
 	return result
 }
 
-func (p *Pruner) bestPrune(samples []vecSample, t *Tree) *Tree {
-	leaves := t.Leaves()
-
-	var lock sync.Mutex
-	var bestTree *Tree
-	bestQuality := float32(math.Inf(-1))
-
-	var wg sync.WaitGroup
-	numProcs := essentials.MinInt(runtime.GOMAXPROCS(0), len(leaves))
-	for i := 0; i < numProcs; i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			for j := i; j < len(leaves); j += numProcs {
-				t1 := pruneLeaf(t, leaves[j])
-				q := p.treeQuality(samples, t1)
-				lock.Lock()
-				if q > bestQuality {
-					bestQuality = q
-					bestTree = t1
-				}
-				lock.Unlock()
-			}
-		}(i)
+// PruneSource is like Prune, but it streams the samples
+// from a SequenceSource.
+//
+// The data is read in a single pass, and samples which
+// take the same branches are merged, so memory usage
+// depends on the number of distinct paths through the
+// tree rather than the number of samples.
+func (p *Pruner) PruneSource(src SequenceSource, t *Tree) (*Tree, error) {
+	if p.MaxLeaves < 1 {
+		panic("cannot restrict to fewer than 1 leaves")
 	}
-	wg.Wait()
-
-	return bestTree
-}
-
-func (p *Pruner) treeQuality(samples []vecSample, t *Tree) float32 {
-	sums := p.leafSums(samples, t)
-	quality := newKahanSum(1)
-	for _, s := range sums {
-		quality.Add([]float32{p.Heuristic.Quality(s.Sum())})
+	if len(t.Leaves()) <= p.MaxLeaves {
+		return t, nil
 	}
-	return quality.Sum()[0]
+	engine, err := newPruneEngineSource(p.Heuristic, src, t)
+	if err != nil {
+		return nil, err
+	}
+	engine.PruneTo(p.MaxLeaves)
+	return engine.OutputTree(), nil
 }
 
 func (p *Pruner) recomputeOutputDeltas(samples []vecSample, t *Tree) {
-	sums := p.leafSums(samples, t)
+	sums := leafVectorSums(samples, t)
 	for l, s := range sums {
 		l.OutputDelta = p.Heuristic.LeafOutput(s.Sum())
 	}
 }
-
-func (p *Pruner) leafSums(samples []vecSample, t *Tree) map[*Leaf]*kahanSum {
-	sums := map[*Leaf]*kahanSum{}
-	for _, s := range samples {
-		leaf := t.Evaluate(&s.TimestepSample)
-		if sum, ok := sums[leaf]; ok {
-			sum.Add(s.Vector)
-		} else {
-			sum = newKahanSum(len(s.Vector))
-			sum.Add(s.Vector)
-			sums[leaf] = sum
-		}
-	}
-	return sums
-}
-
-func pruneLeaf(t *Tree, l *Leaf) *Tree {
-	if t.Leaf == l {
-		panic("cannot prune root")
-	} else if t.Leaf != nil {
-		return t
-	} else if t.Branch.FalseBranch.Leaf == l {
-		return t.Branch.TrueBranch
-	} else if t.Branch.TrueBranch.Leaf == l {
-		return t.Branch.FalseBranch
-	} else {
-		return &Tree{
-			Branch: &Branch{
-				Feature:     t.Branch.Feature,
-				FalseBranch: pruneLeaf(t.Branch.FalseBranch, l),
-				TrueBranch:  pruneLeaf(t.Branch.TrueBranch, l),
-			},
-		}
-	}
-}
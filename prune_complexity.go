@@ -0,0 +1,400 @@
+package seqtree
+
+import (
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A CostComplexityPruner prunes trees with CART-style
+// minimal cost-complexity pruning.
+//
+// The cost of a subtree is the negative sum of the
+// heuristic quality of its leaves, plus alpha times the
+// number of leaves. As alpha grows, internal nodes are
+// collapsed into leaves in order of their gain per leaf,
+// producing a nested sequence of subtrees.
+type CostComplexityPruner struct {
+	// Heuristic is used to compute node qualities and
+	// leaf outputs.
+	Heuristic Heuristic
+
+	// Loss, if non-nil, is used to select the subtree in
+	// the pruning path with the lowest validation loss.
+	// If nil, the subtree for MinGain is used.
+	Loss LossFunc
+
+	// ValidFraction is the fraction of sequences which
+	// Prune holds out for selecting a subtree with Loss.
+	// If 0, a default of 0.2 is used.
+	//
+	// A Trainer with a Validation provider calls
+	// PruneValidation with its validation samples instead.
+	ValidFraction float32
+
+	// MinGain is the smallest increase in total quality
+	// per extra leaf for a node to be kept.
+	// This is the alpha of the smallest subtree which is
+	// considered.
+	MinGain float32
+
+	// MaxDepth, if non-zero, collapses every node below
+	// this depth.
+	MaxDepth int
+}
+
+// A PruningStep is a subtree in a cost-complexity
+// pruning path.
+type PruningStep struct {
+	// Alpha is the gain per leaf of the weakest node that
+	// was collapsed to produce this subtree.
+	// For the first step, this is negative infinity if no
+	// nodes had to be collapsed.
+	Alpha float32
+
+	Tree *Tree
+
+	// NumLeaves is the number of leaves in Tree.
+	NumLeaves int
+}
+
+// Path computes the cost-complexity pruning path of the
+// tree, starting with the subtree for MinGain and
+// MaxDepth and ending with a single leaf.
+//
+// Every tree in the path is a copy whose leaf outputs
+// are computed from the samples.
+func (c *CostComplexityPruner) Path(samples []*TimestepSample, t *Tree) []*PruningStep {
+	root := c.newNode(newVecSamples(c.Heuristic, samples), t)
+
+	var path []*PruningStep
+	addStep := func(alpha float32) {
+		path = append(path, &PruningStep{
+			Alpha:     alpha,
+			Tree:      c.subtree(root, t),
+			NumLeaves: root.leaves,
+		})
+	}
+
+	alpha := float32(math.Inf(-1))
+	if c.MaxDepth != 0 {
+		root.collapseBelow(c.MaxDepth)
+	}
+	for {
+		node, gain := root.weakestLink()
+		if node == nil || gain >= c.MinGain {
+			break
+		}
+		node.collapse()
+		alpha = gain
+	}
+	addStep(alpha)
+	for {
+		node, gain := root.weakestLink()
+		if node == nil {
+			break
+		}
+		node.collapse()
+		addStep(gain)
+	}
+	return path
+}
+
+// Prune prunes the tree.
+//
+// If c.Loss is set, the samples are split by sequence into
+// a set for computing the path and a set for selecting a
+// subtree. Otherwise, all of the samples are used to find
+// the subtree for MinGain.
+func (c *CostComplexityPruner) Prune(samples []*TimestepSample, t *Tree) *Tree {
+	if c.Loss == nil {
+		return c.Path(samples, t)[0].Tree
+	}
+	train, valid := c.splitSamples(samples)
+	if len(train) == 0 || len(valid) == 0 {
+		return c.Path(samples, t)[0].Tree
+	}
+	return c.PruneValidation(train, valid, t, nil, 1)
+}
+
+// PruneValidation computes the pruning path on the train
+// samples and selects the subtree with the lowest loss on
+// the validation samples.
+//
+// The validation samples' outputs should already include
+// the current model's predictions.
+//
+// The scale function, if non-nil, is applied to every
+// subtree in the path before it is scored, for example to
+// scale its leaves with ScaleOptimalStep. The returned
+// subtree has already been scaled.
+func (c *CostComplexityPruner) PruneValidation(train, valid []*TimestepSample, t *Tree,
+	scale func(t *Tree), stepSize float32) *Tree {
+	path := c.Path(train, t)
+	if scale != nil {
+		for _, step := range path {
+			scale(step.Tree)
+		}
+	}
+	return path[c.SelectStep(path, valid, stepSize)].Tree
+}
+
+// SelectStep finds the index of the subtree in the path
+// with the lowest mean loss on the validation samples,
+// after taking a step of the given size with the subtree.
+// Ties are broken in favor of smaller trees.
+func (c *CostComplexityPruner) SelectStep(path []*PruningStep, valid []*TimestepSample,
+	stepSize float32) int {
+	losses := make([]float32, len(path))
+
+	var wg sync.WaitGroup
+	numProcs := essentials.MinInt(runtime.GOMAXPROCS(0), len(path))
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(path); j += numProcs {
+				losses[j] = treeValidationLoss(c.Loss, path[j].Tree, valid, stepSize)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	bestIdx := len(path) - 1
+	for i := len(path) - 2; i >= 0; i-- {
+		if losses[i] < losses[bestIdx] {
+			bestIdx = i
+		}
+	}
+	return bestIdx
+}
+
+func (c *CostComplexityPruner) splitSamples(samples []*TimestepSample) (train,
+	valid []*TimestepSample) {
+	fraction := c.ValidFraction
+	if fraction == 0 {
+		fraction = 0.2
+	}
+	var seqIdx int
+	for i, s := range samples {
+		if i > 0 && !sameSequence(samples[i-1].Sequence, s.Sequence) {
+			seqIdx++
+		}
+		if int(float32(seqIdx+1)*fraction) > int(float32(seqIdx)*fraction) {
+			valid = append(valid, s)
+		} else {
+			train = append(train, s)
+		}
+	}
+	return
+}
+
+// subtree creates a copy of the tree with collapsed nodes
+// replaced by leaves, and with new leaf outputs.
+func (c *CostComplexityPruner) subtree(n *ccNode, t *Tree) *Tree {
+	if n.collapsed || t.Leaf != nil {
+		var output []float32
+		if n.count > 0 {
+			output = c.Heuristic.LeafOutput(n.sum)
+		} else if t.Leaf != nil {
+			output = append([]float32{}, t.Leaf.OutputDelta...)
+		} else {
+			output = make([]float32, len(t.Leaves()[0].OutputDelta))
+		}
+		leaf := &Leaf{OutputDelta: output}
+		if t.Leaf != nil {
+			leaf.Feature = t.Leaf.Feature
+		}
+		return &Tree{Leaf: leaf}
+	}
+	return &Tree{
+		Branch: &Branch{
+			Feature:     t.Branch.Feature,
+			Formula:     t.Branch.Formula,
+			FalseBranch: c.subtree(n.falseNode, t.Branch.FalseBranch),
+			TrueBranch:  c.subtree(n.trueNode, t.Branch.TrueBranch),
+		},
+	}
+}
+
+func (c *CostComplexityPruner) newNode(samples []vecSample, t *Tree) *ccNode {
+	if len(samples) == 0 {
+		// Without samples, there is no vector size, so every
+		// node has an empty sum.
+		return newEmptyCCNode(t, 0)
+	}
+	sums := map[*Leaf]*kahanSum{}
+	counts := map[*Leaf]int{}
+	for _, s := range samples {
+		leaf := t.Evaluate(&s.TimestepSample)
+		sum, ok := sums[leaf]
+		if !ok {
+			sum = newKahanSum(len(s.Vector))
+			sums[leaf] = sum
+		}
+		sum.Add(s.Vector)
+		counts[leaf]++
+	}
+	return c.buildNode(t, 0, sums, counts, len(samples[0].Vector))
+}
+
+func (c *CostComplexityPruner) buildNode(t *Tree, depth int, sums map[*Leaf]*kahanSum,
+	counts map[*Leaf]int, vecSize int) *ccNode {
+	if t.Leaf != nil {
+		n := &ccNode{depth: depth, sum: make([]float32, vecSize), count: counts[t.Leaf]}
+		if sum, ok := sums[t.Leaf]; ok {
+			copy(n.sum, sum.Sum())
+			n.quality = c.Heuristic.Quality(n.sum)
+		}
+		n.leaves = 1
+		n.leafQuality = float64(n.quality)
+		return n
+	}
+	n := &ccNode{
+		depth:     depth,
+		falseNode: c.buildNode(t.Branch.FalseBranch, depth+1, sums, counts, vecSize),
+		trueNode:  c.buildNode(t.Branch.TrueBranch, depth+1, sums, counts, vecSize),
+	}
+	sum := newKahanSum(vecSize)
+	sum.Add(n.falseNode.sum)
+	sum.Add(n.trueNode.sum)
+	n.sum = sum.Sum()
+	n.count = n.falseNode.count + n.trueNode.count
+	if n.count > 0 {
+		n.quality = c.Heuristic.Quality(n.sum)
+	}
+	n.setChildren()
+	return n
+}
+
+// A ccNode stores the statistics of a node in a tree for
+// cost-complexity pruning.
+type ccNode struct {
+	depth   int
+	sum     []float32
+	count   int
+	quality float32
+
+	// leaves and leafQuality are the number and the total
+	// quality of the current leaves under the node.
+	leaves      int
+	leafQuality float64
+
+	// parent is nil for the root.
+	parent *ccNode
+
+	// falseNode and trueNode are nil for leaves.
+	falseNode *ccNode
+	trueNode  *ccNode
+
+	collapsed bool
+}
+
+func newEmptyCCNode(t *Tree, depth int) *ccNode {
+	n := &ccNode{depth: depth, leaves: 1}
+	if t.Branch != nil {
+		n.falseNode = newEmptyCCNode(t.Branch.FalseBranch, depth+1)
+		n.trueNode = newEmptyCCNode(t.Branch.TrueBranch, depth+1)
+		n.setChildren()
+	}
+	return n
+}
+
+// setChildren links the children to the node and computes
+// the node's leaf statistics from theirs.
+func (n *ccNode) setChildren() {
+	n.falseNode.parent = n
+	n.trueNode.parent = n
+	n.leaves = n.falseNode.leaves + n.trueNode.leaves
+	n.leafQuality = n.falseNode.leafQuality + n.trueNode.leafQuality
+}
+
+func (n *ccNode) isLeaf() bool {
+	return n.collapsed || n.falseNode == nil
+}
+
+// collapse turns the node into a leaf and updates the leaf
+// statistics of it and its ancestors.
+func (n *ccNode) collapse() {
+	leavesDelta := 1 - n.leaves
+	qualityDelta := float64(n.quality) - n.leafQuality
+	n.collapsed = true
+	for node := n; node != nil; node = node.parent {
+		node.leaves += leavesDelta
+		node.leafQuality += qualityDelta
+	}
+}
+
+func (n *ccNode) collapseBelow(depth int) {
+	if n.isLeaf() {
+		return
+	}
+	if n.depth >= depth {
+		n.collapse()
+		return
+	}
+	n.falseNode.collapseBelow(depth)
+	n.trueNode.collapseBelow(depth)
+}
+
+// weakestLink finds the internal node with the smallest
+// gain in quality per extra leaf.
+//
+// Ties are broken in favor of the first node in pre-order.
+// If there are no internal nodes, nil is returned.
+func (n *ccNode) weakestLink() (*ccNode, float32) {
+	if n.isLeaf() {
+		return nil, 0
+	}
+	bestNode := n
+	bestGain := n.gain()
+	for _, child := range []*ccNode{n.falseNode, n.trueNode} {
+		if node, gain := child.weakestLink(); node != nil && gain < bestGain {
+			bestNode, bestGain = node, gain
+		}
+	}
+	return bestNode, bestGain
+}
+
+func (n *ccNode) gain() float32 {
+	return float32((n.leafQuality - float64(n.quality)) / float64(n.leaves-1))
+}
+
+// leafVectorSums computes the sum of the sample vectors
+// in each leaf of a tree.
+func leafVectorSums(samples []vecSample, t *Tree) map[*Leaf]*kahanSum {
+	sums := map[*Leaf]*kahanSum{}
+	for _, s := range samples {
+		leaf := t.Evaluate(&s.TimestepSample)
+		if sum, ok := sums[leaf]; ok {
+			sum.Add(s.Vector)
+		} else {
+			sum = newKahanSum(len(s.Vector))
+			sum.Add(s.Vector)
+			sums[leaf] = sum
+		}
+	}
+	return sums
+}
+
+// treeValidationLoss computes the mean loss of the samples
+// after taking a step with the tree.
+func treeValidationLoss(l LossFunc, t *Tree, samples []*TimestepSample,
+	stepSize float32) float32 {
+	if len(samples) == 0 {
+		return 0
+	}
+	total := newKahanSum(1)
+	for _, s := range samples {
+		ts := s.Timestep()
+		output := addDelta(ts.Output, t.Evaluate(s).OutputDelta, stepSize)
+		total.Add([]float32{l.Loss(output, ts.Target)})
+	}
+	return total.Sum()[0] / float32(len(samples))
+}
+
+func sameSequence(s1, s2 Sequence) bool {
+	return len(s1) == len(s2) && (len(s1) == 0 || s1[0] == s2[0])
+}
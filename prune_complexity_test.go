@@ -0,0 +1,177 @@
+package seqtree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCostComplexityPath(t *testing.T) {
+	m := generateTestModel(5)
+	samples := TimestepSamples(generateTestSequences(m))
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           4,
+		MinSplitSamples: 5,
+		Horizons:        []int{0, 1, 2},
+	}
+	tree := b.Build(samples)
+	p := &CostComplexityPruner{Heuristic: b.Heuristic, MinGain: float32(math.Inf(-1))}
+	path := p.Path(samples, tree)
+
+	if path[0].NumLeaves != len(tree.Leaves()) {
+		t.Fatalf("expected full tree first but got %d leaves", path[0].NumLeaves)
+	}
+	if path[len(path)-1].NumLeaves != 1 {
+		t.Fatalf("expected single leaf last but got %d leaves", path[len(path)-1].NumLeaves)
+	}
+
+	// Every subtree should be optimal for the alphas
+	// between its own alpha and the next one.
+	vecSamples := newVecSamples(b.Heuristic, samples)
+	candidates := testPrunings(b.Heuristic, vecSamples, tree)
+	for i, step := range path {
+		if len(step.Tree.Leaves()) != step.NumLeaves {
+			t.Errorf("step %d: expected %d leaves but got %d", i, step.NumLeaves,
+				len(step.Tree.Leaves()))
+		}
+		if i == 0 || i == len(path)-1 {
+			continue
+		}
+		if step.Alpha < path[i-1].Alpha {
+			t.Errorf("step %d: alpha decreased from %f to %f", i, path[i-1].Alpha, step.Alpha)
+		}
+		alpha := float64(step.Alpha+path[i+1].Alpha) / 2
+		actual := testTreeQuality(b.Heuristic, vecSamples, step.Tree) -
+			alpha*float64(step.NumLeaves)
+		best := math.Inf(-1)
+		for _, c := range candidates {
+			best = math.Max(best, c[0]-alpha*c[1])
+		}
+		if actual < best-1e-3*math.Abs(best) {
+			t.Errorf("step %d: expected objective %f but got %f", i, best, actual)
+		}
+	}
+
+	p.Loss = Softmax{}
+	expected := path[p.SelectStep(path, samples, 0.5)]
+	for i, step := range path {
+		actual := treeValidationLoss(Softmax{}, step.Tree, samples, 0.5)
+		bestLoss := treeValidationLoss(Softmax{}, expected.Tree, samples, 0.5)
+		if actual < bestLoss {
+			t.Errorf("step %d has loss %f but selected loss is %f", i, actual, bestLoss)
+		}
+	}
+}
+
+func TestCostComplexityLeafFeatures(t *testing.T) {
+	m := generateTestModel(5)
+	samples := TimestepSamples(generateTestSequences(m))
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           3,
+		MinSplitSamples: 5,
+		Horizons:        []int{0, 1},
+	}
+	tree := b.Build(samples)
+	for i, leaf := range tree.Leaves() {
+		leaf.Feature = m.NumFeatures() + i
+	}
+	p := &CostComplexityPruner{Heuristic: b.Heuristic, MinGain: float32(math.Inf(-1))}
+	path := p.Path(samples, tree)
+	expected := tree.Leaves()
+	for i, leaf := range path[0].Tree.Leaves() {
+		if leaf.Feature != expected[i].Feature {
+			t.Errorf("leaf %d: expected feature %d but got %d", i, expected[i].Feature,
+				leaf.Feature)
+		}
+	}
+}
+
+func TestCostComplexityLimits(t *testing.T) {
+	m := generateTestModel(5)
+	samples := TimestepSamples(generateTestSequences(m))
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           4,
+		MinSplitSamples: 5,
+		Horizons:        []int{0, 1, 2},
+	}
+	tree := b.Build(samples)
+
+	p := &CostComplexityPruner{Heuristic: b.Heuristic, MinGain: float32(math.Inf(-1)),
+		MaxDepth: 2}
+	if depth := testTreeDepth(p.Prune(samples, tree)); depth > 2 {
+		t.Errorf("expected depth at most 2 but got %d", depth)
+	}
+
+	full := (&CostComplexityPruner{Heuristic: b.Heuristic}).Path(samples, tree)
+	minGain := full[len(full)/2].Alpha
+	p = &CostComplexityPruner{Heuristic: b.Heuristic, MinGain: minGain}
+	pruned := p.Path(samples, tree)[0]
+	if pruned.Alpha >= minGain {
+		t.Errorf("expected alpha below %f but got %f", minGain, pruned.Alpha)
+	}
+	if pruned.NumLeaves != full[len(full)/2-1].NumLeaves {
+		t.Errorf("expected %d leaves but got %d", full[len(full)/2-1].NumLeaves,
+			pruned.NumLeaves)
+	}
+
+	p = &CostComplexityPruner{Heuristic: b.Heuristic, Loss: Softmax{}, ValidFraction: 0.5}
+	if n := len(p.Prune(samples, tree).Leaves()); n > len(tree.Leaves()) || n < 1 {
+		t.Errorf("unexpected number of leaves: %d", n)
+	}
+}
+
+// testPrunings enumerates every pruning of a tree as a
+// pair of total quality and number of leaves.
+func testPrunings(h Heuristic, samples []vecSample, t *Tree) [][2]float64 {
+	var sum []float32
+	for _, s := range samples {
+		if sum == nil {
+			sum = make([]float32, len(s.Vector))
+		}
+		sum = addDelta(sum, s.Vector, 1)
+	}
+	var collapsed float64
+	if len(samples) > 0 {
+		collapsed = float64(h.Quality(sum))
+	}
+	res := [][2]float64{{collapsed, 1}}
+	if t.Branch == nil {
+		return res
+	}
+	var falseSamples, trueSamples []vecSample
+	for _, s := range samples {
+		if t.Branch.Evaluate(&s.TimestepSample) {
+			trueSamples = append(trueSamples, s)
+		} else {
+			falseSamples = append(falseSamples, s)
+		}
+	}
+	for _, f := range testPrunings(h, falseSamples, t.Branch.FalseBranch) {
+		for _, t := range testPrunings(h, trueSamples, t.Branch.TrueBranch) {
+			res = append(res, [2]float64{f[0] + t[0], f[1] + t[1]})
+		}
+	}
+	return res
+}
+
+func testTreeQuality(h Heuristic, samples []vecSample, t *Tree) float64 {
+	var total float64
+	for _, sum := range leafVectorSums(samples, t) {
+		total += float64(h.Quality(sum.Sum()))
+	}
+	return total
+}
+
+func testTreeDepth(t *Tree) int {
+	if t.Leaf != nil {
+		return 0
+	}
+	d1 := testTreeDepth(t.Branch.FalseBranch)
+	d2 := testTreeDepth(t.Branch.TrueBranch)
+	if d1 > d2 {
+		return 1 + d1
+	}
+	return 1 + d2
+}
@@ -0,0 +1,434 @@
+package seqtree
+
+import (
+	"math"
+	"runtime"
+	"sync"
+)
+
+// A pruneEngine incrementally removes leaves from a tree
+// for a Pruner.
+//
+// Every branch is evaluated once per sample up front, and
+// every node stores the sum of the vectors which reach it.
+// Removing a leaf whose sibling is also a leaf is scored
+// from the parent's sum in O(vector size). Otherwise, the
+// leaf caches the sums of its samples for every leaf of
+// its sibling that they reach, so no samples are routed
+// while scoring.
+//
+// Sums and scores are only updated for the nodes which
+// are affected by a removal.
+type pruneEngine struct {
+	heuristic Heuristic
+	vectors   [][]float32
+	root      *pruneNode
+}
+
+// A pruneNode is a mutable copy of a tree node.
+type pruneNode struct {
+	parent *pruneNode
+
+	// The sum, count, and quality of the vectors which
+	// reach the node.
+	sum     *kahanSum
+	count   int
+	quality float32
+
+	// Fields for branches.
+	branch    *Branch
+	falseNode *pruneNode
+	trueNode  *pruneNode
+	outcomes  []bool
+
+	// Fields for leaves.
+	leaf    *Leaf
+	indices []int
+
+	// moved maps leaves under the sibling to the samples
+	// of this leaf which would reach them if this leaf
+	// were removed.
+	moved map[*pruneNode]*pruneMove
+
+	// Cached change in total quality from removing the
+	// leaf.
+	scored bool
+	delta  float64
+}
+
+// A pruneMove is a set of samples which would move from
+// one leaf to another.
+type pruneMove struct {
+	indices []int
+	sum     *kahanSum
+}
+
+func newPruneEngine(h Heuristic, samples []vecSample, t *Tree) *pruneEngine {
+	vectors := make([][]float32, len(samples))
+	for i, s := range samples {
+		vectors[i] = s.Vector
+	}
+	branches := treeBranches(t)
+	outcomes := make([][]bool, len(branches))
+	for i, b := range branches {
+		outcomes[i] = evaluateBranch(b, samples)
+	}
+	return newPruneEngineOutcomes(h, vectors, outcomes, t)
+}
+
+// newPruneEngineSource creates an engine from a single
+// pass over a SequenceSource.
+//
+// Samples which take the same branches are merged into a
+// single vector, since they always end up in the same
+// leaf.
+func newPruneEngineSource(h Heuristic, src SequenceSource, t *Tree) (*pruneEngine, error) {
+	branches := treeBranches(t)
+	outcomes := make([][]bool, len(branches))
+	groups := map[string]int{}
+	var sums []*kahanSum
+	key := make([]byte, len(branches))
+	err := src.IterateChunks(false, func(chunk []Sequence) {
+		for _, s := range newVecSamples(h, TimestepSamples(chunk)) {
+			for i, b := range branches {
+				key[i] = 0
+				if b.Evaluate(&s.TimestepSample) {
+					key[i] = 1
+				}
+			}
+			idx, ok := groups[string(key)]
+			if !ok {
+				idx = len(sums)
+				groups[string(key)] = idx
+				sums = append(sums, newKahanSum(len(s.Vector)))
+				for i, k := range key {
+					outcomes[i] = append(outcomes[i], k == 1)
+				}
+			}
+			sums[idx].Add(s.Vector)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	vectors := make([][]float32, len(sums))
+	for i, s := range sums {
+		vectors[i] = s.Sum()
+	}
+	return newPruneEngineOutcomes(h, vectors, outcomes, t), nil
+}
+
+// newPruneEngineOutcomes creates an engine from sample
+// vectors and branch outcomes, where outcomes[i][j] is the
+// outcome of the i-th branch of t (in pre-order) for the
+// j-th vector.
+func newPruneEngineOutcomes(h Heuristic, vectors [][]float32, outcomes [][]bool,
+	t *Tree) *pruneEngine {
+	e := &pruneEngine{heuristic: h, vectors: vectors}
+	var branchIdx int
+	e.root = e.newNode(t, nil, outcomes, &branchIdx)
+	for i := range vectors {
+		e.addSample(e.root, i)
+	}
+	e.updateQualities(e.root)
+
+	leaves := e.leaves()
+	var wg sync.WaitGroup
+	numProcs := runtime.GOMAXPROCS(0)
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(leaves); j += numProcs {
+				e.computeMoved(leaves[j])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return e
+}
+
+func (e *pruneEngine) newNode(t *Tree, parent *pruneNode, outcomes [][]bool,
+	branchIdx *int) *pruneNode {
+	n := &pruneNode{parent: parent}
+	if len(e.vectors) > 0 {
+		n.sum = newKahanSum(len(e.vectors[0]))
+	}
+	if t.Leaf != nil {
+		n.leaf = t.Leaf
+		return n
+	}
+	n.branch = t.Branch
+	n.outcomes = outcomes[*branchIdx]
+	*branchIdx++
+	n.falseNode = e.newNode(t.Branch.FalseBranch, n, outcomes, branchIdx)
+	n.trueNode = e.newNode(t.Branch.TrueBranch, n, outcomes, branchIdx)
+	return n
+}
+
+// PruneTo removes leaves until there are at most maxLeaves
+// leaves left.
+func (e *pruneEngine) PruneTo(maxLeaves int) {
+	leaves := e.leaves()
+	for len(leaves) > maxLeaves {
+		e.scoreLeaves(leaves)
+		var best *pruneNode
+		bestDelta := math.Inf(-1)
+		for _, leaf := range leaves {
+			if leaf.parent != nil && leaf.delta > bestDelta {
+				best = leaf
+				bestDelta = leaf.delta
+			}
+		}
+		e.removeLeaf(best)
+		leaves = e.leaves()
+	}
+}
+
+// Tree creates a tree from the current state, reusing the
+// branches and leaves of the original tree.
+func (e *pruneEngine) Tree() *Tree {
+	return e.root.tree(func(n *pruneNode) *Leaf {
+		return n.leaf
+	})
+}
+
+// OutputTree is like Tree, but it creates new leaves whose
+// outputs are computed from the samples which reach them.
+//
+// Leaves which no samples reach keep their old outputs.
+func (e *pruneEngine) OutputTree() *Tree {
+	return e.root.tree(func(n *pruneNode) *Leaf {
+		leaf := &Leaf{
+			OutputDelta: append([]float32{}, n.leaf.OutputDelta...),
+			Feature:     n.leaf.Feature,
+		}
+		if n.count > 0 {
+			leaf.OutputDelta = e.heuristic.LeafOutput(n.sum.Sum())
+		}
+		return leaf
+	})
+}
+
+func (e *pruneEngine) scoreLeaves(leaves []*pruneNode) {
+	var unscored []*pruneNode
+	for _, leaf := range leaves {
+		if !leaf.scored && leaf.parent != nil {
+			unscored = append(unscored, leaf)
+		}
+	}
+
+	var wg sync.WaitGroup
+	numProcs := runtime.GOMAXPROCS(0)
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(unscored); j += numProcs {
+				e.scoreLeaf(unscored[j])
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// scoreLeaf computes the change in total quality from
+// removing a leaf and moving its samples into its sibling.
+func (e *pruneEngine) scoreLeaf(leaf *pruneNode) {
+	leaf.scored = true
+	leaf.delta = -float64(leaf.quality)
+	if leaf.count == 0 {
+		return
+	}
+	sibling := leaf.sibling()
+	if sibling.leaf != nil {
+		// The merged leaf gets all of the parent's samples.
+		leaf.delta += float64(leaf.parent.quality) - float64(sibling.quality)
+		return
+	}
+	for _, dest := range sibling.leaves() {
+		if m, ok := leaf.moved[dest]; ok {
+			merged := addDelta(dest.sum.Sum(), m.sum.Sum(), 1)
+			leaf.delta += float64(e.heuristic.Quality(merged)) - float64(dest.quality)
+		}
+	}
+}
+
+// removeLeaf replaces the leaf's parent with its sibling,
+// moving the leaf's samples into the sibling.
+func (e *pruneEngine) removeLeaf(leaf *pruneNode) {
+	parent := leaf.parent
+	sibling := leaf.sibling()
+
+	added := map[*pruneNode][]int{}
+	for _, i := range leaf.indices {
+		dest := e.addSample(sibling, i)
+		added[dest] = append(added[dest], i)
+	}
+
+	sibling.parent = parent.parent
+	if parent.parent == nil {
+		e.root = sibling
+	} else if parent.parent.falseNode == parent {
+		parent.parent.falseNode = sibling
+	} else {
+		parent.parent.trueNode = sibling
+	}
+	e.updateQualities(sibling)
+
+	// The leaves of the sibling have new samples, and the
+	// sibling itself may have a new sibling.
+	if sibling.leaf != nil {
+		e.computeMoved(sibling)
+	} else {
+		for _, dest := range sibling.leaves() {
+			if indices, ok := added[dest]; ok {
+				e.addMoved(dest, dest.sibling(), indices)
+			}
+		}
+	}
+	for _, l := range sibling.leaves() {
+		l.scored = false
+	}
+
+	// Leaves whose sibling contained the removed leaf now
+	// send those samples into the leaf's sibling.
+	for n := sibling; n.parent != nil; n = n.parent {
+		other := n.sibling()
+		if other.leaf == nil {
+			continue
+		}
+		other.scored = false
+		if m, ok := other.moved[leaf]; ok {
+			delete(other.moved, leaf)
+			e.addMoved(other, sibling, m.indices)
+		}
+	}
+}
+
+// addSample adds a sample to every node on its path from
+// n, returning the leaf it reaches.
+func (e *pruneEngine) addSample(n *pruneNode, sampleIdx int) *pruneNode {
+	v := e.vectors[sampleIdx]
+	for {
+		n.sum.Add(v)
+		n.count++
+		if n.leaf != nil {
+			n.indices = append(n.indices, sampleIdx)
+			return n
+		}
+		n = n.child(n.outcomes[sampleIdx])
+	}
+}
+
+// computeMoved routes all of a leaf's samples through its
+// sibling.
+func (e *pruneEngine) computeMoved(leaf *pruneNode) {
+	leaf.moved = map[*pruneNode]*pruneMove{}
+	if leaf.parent != nil {
+		e.addMoved(leaf, leaf.sibling(), leaf.indices)
+	}
+}
+
+// addMoved routes some of a leaf's samples through n and
+// records where they end up.
+func (e *pruneEngine) addMoved(leaf, n *pruneNode, indices []int) {
+	for _, i := range indices {
+		dest := e.route(n, i)
+		m, ok := leaf.moved[dest]
+		if !ok {
+			m = &pruneMove{sum: newKahanSum(len(e.vectors[i]))}
+			leaf.moved[dest] = m
+		}
+		m.indices = append(m.indices, i)
+		m.sum.Add(e.vectors[i])
+	}
+}
+
+func (e *pruneEngine) updateQualities(n *pruneNode) {
+	if n.count == 0 {
+		n.quality = 0
+	} else {
+		n.quality = e.heuristic.Quality(n.sum.Sum())
+	}
+	if n.leaf == nil {
+		e.updateQualities(n.falseNode)
+		e.updateQualities(n.trueNode)
+	}
+}
+
+// route finds the leaf under a node that a sample reaches.
+func (e *pruneEngine) route(n *pruneNode, sampleIdx int) *pruneNode {
+	for n.leaf == nil {
+		n = n.child(n.outcomes[sampleIdx])
+	}
+	return n
+}
+
+func (e *pruneEngine) leaves() []*pruneNode {
+	return e.root.leaves()
+}
+
+func (n *pruneNode) tree(leafFn func(n *pruneNode) *Leaf) *Tree {
+	if n.leaf != nil {
+		return &Tree{Leaf: leafFn(n)}
+	}
+	return &Tree{
+		Branch: &Branch{
+			Feature:     n.branch.Feature,
+			Formula:     n.branch.Formula,
+			FalseBranch: n.falseNode.tree(leafFn),
+			TrueBranch:  n.trueNode.tree(leafFn),
+		},
+	}
+}
+
+func (n *pruneNode) leaves() []*pruneNode {
+	if n.leaf != nil {
+		return []*pruneNode{n}
+	}
+	return append(n.falseNode.leaves(), n.trueNode.leaves()...)
+}
+
+func (n *pruneNode) child(outcome bool) *pruneNode {
+	if outcome {
+		return n.trueNode
+	}
+	return n.falseNode
+}
+
+func (n *pruneNode) sibling() *pruneNode {
+	if n.parent.falseNode == n {
+		return n.parent.trueNode
+	}
+	return n.parent.falseNode
+}
+
+// treeBranches lists the branches of a tree in pre-order.
+func treeBranches(t *Tree) []*Branch {
+	if t.Leaf != nil {
+		return nil
+	}
+	res := []*Branch{t.Branch}
+	res = append(res, treeBranches(t.Branch.FalseBranch)...)
+	return append(res, treeBranches(t.Branch.TrueBranch)...)
+}
+
+// evaluateBranch evaluates a branch on every sample.
+func evaluateBranch(b *Branch, samples []vecSample) []bool {
+	res := make([]bool, len(samples))
+	var wg sync.WaitGroup
+	numProcs := runtime.GOMAXPROCS(0)
+	for i := 0; i < numProcs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(samples); j += numProcs {
+				res[j] = b.Evaluate(&samples[j].TimestepSample)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return res
+}
@@ -0,0 +1,115 @@
+package seqtree
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestPrunerMatchesReference(t *testing.T) {
+	for trial := 0; trial < 5; trial++ {
+		m := generateTestModel(5)
+		samples := TimestepSamples(generateTestSequences(m))
+		for _, h := range []Heuristic{
+			GradientHeuristic{Loss: Softmax{}},
+			HessianHeuristic{Loss: Softmax{}, Damping: 0.1},
+		} {
+			b := &Builder{
+				Heuristic:       h,
+				Depth:           5,
+				MinSplitSamples: 3,
+				Horizons:        []int{0, 1, 2},
+			}
+			tree := b.Build(samples)
+			for _, maxLeaves := range []int{1, 3, 8} {
+				p := &Pruner{Heuristic: h, MaxLeaves: maxLeaves}
+				expected := bestPruneReference(p, samples, tree)
+				actual := p.Prune(samples, tree)
+				expectedData, _ := json.Marshal(expected)
+				actualData, _ := json.Marshal(actual)
+				if string(expectedData) != string(actualData) {
+					t.Errorf("trial %d: mismatching trees for %T with %d leaves", trial, h,
+						maxLeaves)
+				}
+			}
+		}
+	}
+}
+
+// bestPruneReference prunes a tree one leaf at a time,
+// trying every leaf and recomputing the quality of the
+// entire tree for each one.
+func bestPruneReference(p *Pruner, samples []*TimestepSample, t *Tree) *Tree {
+	vecSamples := newVecSamples(p.Heuristic, samples)
+	result := t
+	for len(result.Leaves()) > p.MaxLeaves {
+		var bestTree *Tree
+		bestQuality := float32(math.Inf(-1))
+		for _, leaf := range result.Leaves() {
+			t1 := pruneLeaf(result, leaf)
+			if q := treeQualityReference(p, vecSamples, t1); q > bestQuality {
+				bestQuality = q
+				bestTree = t1
+			}
+		}
+		result = bestTree
+	}
+	if result != t {
+		result = result.Copy()
+		p.recomputeOutputDeltas(vecSamples, result)
+	}
+	return result
+}
+
+func treeQualityReference(p *Pruner, samples []vecSample, t *Tree) float32 {
+	sums := leafVectorSums(samples, t)
+	quality := newKahanSum(1)
+	for _, leaf := range t.Leaves() {
+		if s, ok := sums[leaf]; ok {
+			quality.Add([]float32{p.Heuristic.Quality(s.Sum())})
+		}
+	}
+	return quality.Sum()[0]
+}
+
+func pruneLeaf(t *Tree, l *Leaf) *Tree {
+	if t.Leaf == l {
+		panic("cannot prune root")
+	} else if t.Leaf != nil {
+		return t
+	} else if t.Branch.FalseBranch.Leaf == l {
+		return t.Branch.TrueBranch
+	} else if t.Branch.TrueBranch.Leaf == l {
+		return t.Branch.FalseBranch
+	} else {
+		return &Tree{
+			Branch: &Branch{
+				Feature:     t.Branch.Feature,
+				Formula:     t.Branch.Formula,
+				FalseBranch: pruneLeaf(t.Branch.FalseBranch, l),
+				TrueBranch:  pruneLeaf(t.Branch.TrueBranch, l),
+			},
+		}
+	}
+}
+
+func BenchmarkPrune(b *testing.B) {
+	seqInts := make([]int, 4096)
+	for i := range seqInts {
+		seqInts[i] = rand.Intn(4)
+	}
+	m := &Model{BaseFeatures: 4}
+	samples := TimestepSamples([]Sequence{MakeOneHotSequence(seqInts, 4, m.NumFeatures())})
+	builder := Builder{
+		Heuristic: GradientHeuristic{Loss: Softmax{}},
+		Depth:     5,
+		Horizons:  []int{0, 1, 2, 3},
+	}
+	tree := builder.Build(samples)
+	p := &Pruner{Heuristic: builder.Heuristic, MaxLeaves: 4}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Prune(samples, tree)
+	}
+}
@@ -22,6 +22,12 @@ const (
 	HorizontalReceptiveField = 5
 	VerticalReceptiveField   = 9
 
+	// Pixels are modeled as a mixture of logistics, and
+	// their intensities are given to the next pixel as a
+	// set of thresholded features.
+	NumComponents = 5
+	IntensityBits = 4
+
 	Batch    = 4000
 	Depth    = 4
 	MaxUnion = 10
@@ -37,35 +43,42 @@ const (
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	horizons := []int{}
+	offsets := []seqtree.Offset2D{}
 	for i := -HorizontalReceptiveField; i < HorizontalReceptiveField; i++ {
 		for j := 0; j < VerticalReceptiveField; j++ {
 			if j == 0 && i < 0 {
 				continue
 			}
-			horizons = append(horizons, i+j*ImageSize)
+			offsets = append(offsets, seqtree.Offset2D{DX: -i, DY: -j})
 		}
 	}
 	dataset := mnist.LoadTrainingDataSet()
-	model := &seqtree.Model{BaseFeatures: 2 + ImageSize*4}
+	model := &seqtree.Model{BaseFeatures: IntensityBits + ImageSize*4}
 	model.Load("model.json")
 
+	loss := &seqtree.LogisticMixture{NumComponents: NumComponents}
 	builder := seqtree.Builder{
-		Heuristic:       seqtree.PolynomialHeuristic{Loss: seqtree.Sigmoid{}},
+		Heuristic:       seqtree.GradientHeuristic{Loss: loss},
 		Depth:           Depth,
-		Horizons:        horizons,
+		Offsets:         offsets,
+		GridWidth:       ImageSize,
 		MaxSplitSamples: MaxSplitSamples,
 		MaxUnion:        MaxUnion,
 		CandidateSplits: CandidateSplits,
 	}
 
+	metrics, err := seqtree.OpenMetricsFile("metrics.jsonl")
+	essentials.Must(err)
+	defer metrics.Close()
+
 	for i := 0; true; i++ {
+		start := time.Now()
 		seqs := SampleSequences(dataset, model, Batch)
 		model.EvaluateAll(seqs)
 
 		totalLoss := float32(0)
 		for _, seq := range seqs {
-			totalLoss += seq.MeanLoss(seqtree.Sigmoid{})
+			totalLoss += seq.MeanLoss(loss)
 		}
 		totalLoss /= Batch
 
@@ -78,15 +91,23 @@ func main() {
 		seqs = SampleSequences(dataset, model, Batch)
 		model.EvaluateAll(seqs)
 
-		seqtree.ScaleOptimalStep(seqtree.TimestepSamples(seqs), tree, seqtree.Sigmoid{},
-			MaxStep, 10, 30)
-		delta := seqtree.AvgLossDelta(seqtree.TimestepSamples(seqs), tree, seqtree.Sigmoid{}, 1.0)
+		samples := seqtree.TimestepSamples(seqs)
+		seqtree.ScaleOptimalStep(samples, tree, loss, MaxStep, 10, 30)
+		delta := seqtree.AvgLossDelta(samples, tree, loss, 1.0)
 		model.Add(tree, 1.0)
 
-		log.Printf("step %d: loss=%f loss_delta=%f min_leaf=%d",
-			i, totalLoss, -delta, builder.MinSplitSamples)
-
-		GenerateSequence(model)
+		log.Printf("step %d: loss=%f bits/dim=%f loss_delta=%f min_leaf=%d",
+			i, totalLoss, loss.BitsPerDim(totalLoss), -delta, builder.MinSplitSamples)
+		essentials.Must(metrics.WriteMetrics(&seqtree.IterationMetrics{
+			Iteration: len(model.Trees) - 1,
+			TrainLoss: totalLoss,
+			LossDelta: delta,
+			StepSize:  1.0,
+			NumLeaves: len(tree.Leaves()),
+			Seconds:   time.Since(start).Seconds(),
+		}))
+
+		GenerateSequence(model, loss)
 		model.Save("model.json")
 	}
 }
@@ -106,23 +127,20 @@ func SampleSequences(ds mnist.DataSet, m *seqtree.Model, count int) []seqtree.Se
 				}
 				sample := ds.Samples[rand.Intn(len(ds.Samples))]
 				seq := seqtree.Sequence{}
-				prev := -1
+				var prev float32
 				for i, intensity := range sample.Intensities {
 					x := i % ImageSize
 					y := i / ImageSize
 					ts := &seqtree.Timestep{
-						Output:   make([]float32, 1),
+						Output:   make([]float32, NumComponents*3),
 						Features: seqtree.NewBitmap(m.NumFeatures()),
-						Target:   make([]float32, 2),
+						Target:   []float32{float32(intensity)},
 					}
-					ts.Features.Set(0, prev == 1)
+					// Each pixel's features include the value of
+					// the previous pixel.
+					SetIntensityFeatures(ts.Features, prev)
 					SetAxisFeatures(ts.Features, x, y)
-					if intensity > 0.5 {
-						prev = 1
-					} else {
-						prev = 0
-					}
-					ts.Target[0] = float32(prev)
+					prev = float32(intensity)
 					seq = append(seq, ts)
 				}
 				res[j] = seq
@@ -133,31 +151,25 @@ func SampleSequences(ds mnist.DataSet, m *seqtree.Model, count int) []seqtree.Se
 	return res
 }
 
-func GenerateSequence(m *seqtree.Model) {
+func GenerateSequence(m *seqtree.Model, loss *seqtree.LogisticMixture) {
 	img := image.NewGray(image.Rect(0, 0, ImageSize*4, ImageSize*4))
 	for row := 0; row < 4; row++ {
 		for col := 0; col < 4; col++ {
-			seq := seqtree.Sequence{
-				&seqtree.Timestep{
-					Output:   make([]float32, 1),
-					Features: seqtree.NewBitmap(m.NumFeatures()),
-				},
-			}
+			seq := seqtree.Sequence{}
+			var prev float32
 			for i := 0; i < ImageSize; i++ {
 				for j := 0; j < ImageSize; j++ {
-					ts := seq[len(seq)-1]
-					SetAxisFeatures(ts.Features, j, i)
-					m.EvaluateAt(seq, len(seq)-1)
-					pixel := seqtree.Sigmoid{}.Sample(ts.Output)[0]
-					if pixel {
-						img.SetGray(row*ImageSize+j, col*ImageSize+i, color.Gray{Y: 255})
-					}
-					ts = &seqtree.Timestep{
-						Output:   make([]float32, 1),
+					ts := &seqtree.Timestep{
+						Output:   make([]float32, NumComponents*3),
 						Features: seqtree.NewBitmap(m.NumFeatures()),
 					}
-					ts.Features.Set(0, pixel)
+					SetIntensityFeatures(ts.Features, prev)
+					SetAxisFeatures(ts.Features, j, i)
 					seq = append(seq, ts)
+					m.EvaluateAt(seq, len(seq)-1)
+					prev = loss.Sample(ts.Output)[0]
+					img.SetGray(row*ImageSize+j, col*ImageSize+i,
+						color.Gray{Y: uint8(prev*255 + 0.5)})
 				}
 			}
 		}
@@ -168,12 +180,19 @@ func GenerateSequence(m *seqtree.Model) {
 	essentials.Must(png.Encode(w, img))
 }
 
-func SetAxisFeatures(f *seqtree.Bitmap, x, y int) {
-	SetAxisFeature(f, 2, x)
-	SetAxisFeature(f, 2+ImageSize*2, y)
+func SetIntensityFeatures(f seqtree.FeatureMap, intensity float32) {
+	for i := 0; i < IntensityBits; i++ {
+		threshold := float32(i+1) / (IntensityBits + 1)
+		f.Set(i, intensity > threshold)
+	}
+}
+
+func SetAxisFeatures(f seqtree.FeatureMap, x, y int) {
+	SetAxisFeature(f, IntensityBits, x)
+	SetAxisFeature(f, IntensityBits+ImageSize*2, y)
 }
 
-func SetAxisFeature(f *seqtree.Bitmap, start, x int) {
+func SetAxisFeature(f seqtree.FeatureMap, start, x int) {
 	for i := 0; i < ImageSize; i++ {
 		if i < x {
 			f.Set(i+start, true)
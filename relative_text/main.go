@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"time"
 
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/seqtree"
@@ -24,7 +25,6 @@ var Horizons = []int{0, 1, 2, 3}
 
 func main() {
 	model := &seqtree.Model{BaseFeatures: 128}
-	model.Load("model.json")
 
 	textData, err := ioutil.ReadFile("/usr/share/dict/words")
 	essentials.Must(err)
@@ -42,37 +42,48 @@ func main() {
 		CandidateSplits: CandidateSplits,
 	}
 
-	for i := 0; true; i++ {
-		seqs := SampleSequences(textData, model, Batch, Length)
-		model.EvaluateAll(seqs)
-
-		var loss float32
-		for _, seq := range seqs {
-			loss += seq.MeanLoss(seqtree.Softmax{})
-		}
-
-		tree := builder.Build(seqtree.TimestepSamples(seqs))
-		// seqtree.AddLeafFeatures(tree, model.NumFeatures())
-
-		seqs = SampleSequences(textData, model, Batch, Length)
-		model.EvaluateAll(seqs)
-		seqtree.ScaleOptimalStep(seqtree.TimestepSamples(seqs), tree, seqtree.Softmax{},
-			MaxStep, 10, 30)
-		delta := seqtree.AvgLossDelta(seqtree.TimestepSamples(seqs), tree, seqtree.Softmax{}, 1.0)
-		model.Add(tree, 1.0)
+	metrics, err := seqtree.OpenMetricsFile("metrics.jsonl")
+	essentials.Must(err)
+	defer metrics.Close()
 
-		log.Printf("step %d: loss=%f loss_delta=%f", i, loss/Batch, -delta)
-		if i%10 == 0 {
-			GenerateSequence(model, Length)
-		}
-		model.Save("model.json")
+	trainer := &seqtree.Trainer{
+		Model:   model,
+		Builder: &builder,
+		Loss:    seqtree.Softmax{},
+		Train: func(m *seqtree.Model, gen *rand.Rand) []seqtree.Sequence {
+			return SampleSequences(gen, textData, m, Batch, Length)
+		},
+		MaxStep:        MaxStep,
+		MinLeafSamples: 10,
+		StepIters:      30,
+		Metrics:        metrics,
+		Checkpointer:   &seqtree.Checkpointer{Dir: "checkpoints"},
+		Seed:           time.Now().UnixNano(),
+		Callback: func(metrics seqtree.IterationMetrics) {
+			log.Printf("step %d: loss=%f loss_delta=%f", metrics.Iteration,
+				metrics.TrainLoss, -metrics.LossDelta)
+			essentials.Must(model.Save("model.json"))
+			if metrics.Iteration%10 == 0 {
+				GenerateSequence(model, Length)
+			}
+		},
 	}
+	resumed, err := trainer.Resume()
+	essentials.Must(err)
+	if resumed {
+		log.Printf("resumed from checkpoint with %d trees", len(model.Trees))
+	} else {
+		essentials.Must(model.Load("model.json"))
+	}
+	_, err = trainer.Run(0)
+	essentials.Must(err)
 }
 
-func SampleSequences(t []byte, m *seqtree.Model, count, length int) []seqtree.Sequence {
+func SampleSequences(gen *rand.Rand, t []byte, m *seqtree.Model, count,
+	length int) []seqtree.Sequence {
 	var res []seqtree.Sequence
 	for i := 0; i < count; i++ {
-		start := rand.Intn(len(t) - length)
+		start := gen.Intn(len(t) - length)
 		intSeq := make([]int, length)
 		for j := start; j < start+length; j++ {
 			intSeq[j-start] = essentials.MinInt(int(t[j]), 0x7f)
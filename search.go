@@ -0,0 +1,149 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// An IntRange is an inclusive range of integers.
+//
+// The zero value means the parameter is not searched.
+type IntRange struct {
+	Min int
+	Max int
+}
+
+func (i IntRange) sample(base int) int {
+	if i.Min == 0 && i.Max == 0 {
+		return base
+	}
+	return i.Min + rand.Intn(i.Max-i.Min+1)
+}
+
+// A FloatRange is a range of floats, sampled uniformly or
+// log-uniformly.
+//
+// The zero value means the parameter is not searched.
+type FloatRange struct {
+	Min float32
+	Max float32
+	Log bool
+}
+
+func (f FloatRange) sample(base float32) float32 {
+	if f.Min == 0 && f.Max == 0 {
+		return base
+	}
+	if f.Log {
+		logMin := math.Log(float64(f.Min))
+		logMax := math.Log(float64(f.Max))
+		return float32(math.Exp(logMin + rand.Float64()*(logMax-logMin)))
+	}
+	return f.Min + rand.Float32()*(f.Max-f.Min)
+}
+
+// A SearchSpace defines the distribution of
+// hyperparameters for a search.
+//
+// Parameters with a zero range are taken from Base.
+type SearchSpace struct {
+	Base TrainParams
+
+	Depth           IntRange
+	MinSplitSamples IntRange
+	MaxUnion        IntRange
+	MaxLeaves       IntRange
+	MaxStep         FloatRange
+	Shrinkage       FloatRange
+}
+
+// Sample draws a random set of hyperparameters.
+func (s *SearchSpace) Sample() TrainParams {
+	return TrainParams{
+		Depth:           s.Depth.sample(s.Base.Depth),
+		MinSplitSamples: s.MinSplitSamples.sample(s.Base.MinSplitSamples),
+		MaxUnion:        s.MaxUnion.sample(s.Base.MaxUnion),
+		MaxLeaves:       s.MaxLeaves.sample(s.Base.MaxLeaves),
+		MaxStep:         s.MaxStep.sample(s.Base.MaxStep),
+		Shrinkage:       s.Shrinkage.sample(s.Base.Shrinkage),
+	}
+}
+
+// RandomSearch cross-validates randomly sampled
+// hyperparameters.
+//
+// The results are sorted from best to worst mean loss.
+func (c *CrossValidator) RandomSearch(seqs []Sequence, space *SearchSpace,
+	trials int) []*CVResult {
+	if trials < 1 {
+		panic("random search requires at least 1 trial")
+	}
+	params := make([]TrainParams, trials)
+	for i := range params {
+		params[i] = space.Sample()
+	}
+	results := c.crossValidateAll(seqs, params, c.NumTrees)
+	sortCVResults(results)
+	return results
+}
+
+// SuccessiveHalving searches over randomly sampled
+// hyperparameters, spending more trees on the ones which
+// look most promising.
+//
+// Every round trains the remaining candidates with a
+// budget of trees, keeps the best 1/eta of them, and
+// multiplies the budget by eta for the next round.
+// The first round uses minTrees trees, and the budget
+// never exceeds c.NumTrees.
+//
+// The result contains every round, with each round sorted
+// from best to worst mean loss. The best hyperparameters
+// are the first entry of the last round.
+func (c *CrossValidator) SuccessiveHalving(seqs []Sequence, space *SearchSpace, trials,
+	minTrees, eta int) [][]*CVResult {
+	if eta < 2 {
+		panic("successive halving requires eta of at least 2")
+	}
+	if minTrees < 1 {
+		panic("successive halving requires minTrees of at least 1")
+	}
+	if trials < 1 {
+		panic("successive halving requires at least 1 trial")
+	}
+	params := make([]TrainParams, trials)
+	for i := range params {
+		params[i] = space.Sample()
+	}
+
+	var rounds [][]*CVResult
+	numTrees := minTrees
+	for {
+		if numTrees > c.NumTrees {
+			numTrees = c.NumTrees
+		}
+		results := c.crossValidateAll(seqs, params, numTrees)
+		sortCVResults(results)
+		rounds = append(rounds, results)
+		if len(results) == 1 || numTrees == c.NumTrees {
+			break
+		}
+		numKeep := len(results) / eta
+		if numKeep < 1 {
+			numKeep = 1
+		}
+		params = params[:numKeep]
+		for i, r := range results[:numKeep] {
+			params[i] = r.Params
+		}
+		numTrees *= eta
+	}
+	return rounds
+}
+
+func sortCVResults(results []*CVResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Mean < results[j].Mean
+	})
+}
@@ -80,16 +80,61 @@ func TimestepSamples(seqs []Sequence) []*TimestepSample {
 // BranchFeature computes the value of the feature, which
 // may be in the past.
 func (t *TimestepSample) BranchFeature(b BranchFeature) bool {
-	if b.StepsInPast > t.Index {
+	ts := t.featureTimestep(b)
+	if ts == nil {
 		return b.Feature == -1
 	}
 	if b.Feature == -1 {
 		return false
 	}
-	ts := t.Sequence[t.Index-b.StepsInPast]
 	return ts.Features.Get(b.Feature)
 }
 
+// BranchLiteral computes the value of the literal.
+func (t *TimestepSample) BranchLiteral(l BranchLiteral) bool {
+	return t.BranchFeature(l.BranchFeature) != l.Negate
+}
+
+// BranchTerm computes the value of the conjunction.
+func (t *TimestepSample) BranchTerm(term BranchTerm) bool {
+	for _, l := range term {
+		if !t.BranchLiteral(l) {
+			return false
+		}
+	}
+	return true
+}
+
+// featureTimestep finds the timestep that a BranchFeature
+// refers to, or returns nil if the feature refers to a
+// position outside of the sequence.
+//
+// For 2D features, positions outside of the grid and
+// positions which come after the current timestep are
+// both treated as outside of the sequence.
+// The grid may be incomplete, in which case positions
+// past the end of the sequence are outside of the grid.
+func (t *TimestepSample) featureTimestep(b BranchFeature) *Timestep {
+	if !b.Is2D() {
+		if b.StepsInPast > t.Index {
+			return nil
+		}
+		return t.Sequence[t.Index-b.StepsInPast]
+	}
+	width := b.GridWidth
+	offset := b.offset()
+	x := t.Index%width + offset.DX
+	y := t.Index/width + offset.DY
+	if x < 0 || x >= width || y < 0 {
+		return nil
+	}
+	idx := x + y*width
+	if idx > t.Index || idx >= len(t.Sequence) {
+		return nil
+	}
+	return t.Sequence[idx]
+}
+
 // Timestep gets the corresponding Timestep.
 func (t *TimestepSample) Timestep() *Timestep {
 	return t.Sequence[t.Index]
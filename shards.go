@@ -0,0 +1,471 @@
+package seqtree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	shardMetaFile    = "meta.json"
+	shardOutputsFile = "outputs.f32"
+	shardTargetsFile = "targets.f32"
+)
+
+// A SequenceSource is a collection of sequences which can
+// be visited one chunk at a time, so that the entire
+// collection never has to be in memory at once.
+type SequenceSource interface {
+	// IterateChunks calls f for every chunk of sequences,
+	// in order.
+	//
+	// If modify is true, changes that f makes to the
+	// features of the sequences are persisted.
+	// Changes to outputs may or may not be persisted,
+	// depending on the source.
+	IterateChunks(modify bool, f func(chunk []Sequence)) error
+}
+
+// SequenceChunks is an in-memory SequenceSource.
+type SequenceChunks [][]Sequence
+
+// IterateChunks calls f for every chunk.
+func (s SequenceChunks) IterateChunks(modify bool, f func(chunk []Sequence)) error {
+	for _, chunk := range s {
+		f(chunk)
+	}
+	return nil
+}
+
+type shardMeta struct {
+	NumFeatures int
+	OutputSize  int
+	TargetSize  int
+	Chunks      []shardChunk
+}
+
+type shardChunk struct {
+	// Offset is the index of the first timestep of the
+	// chunk in the output and target arrays.
+	Offset int
+
+	Sequences int
+	Timesteps int
+}
+
+// A ShardWriter creates a ShardStore on disk.
+type ShardWriter struct {
+	dir         string
+	numFeatures int
+	chunkSize   int
+
+	meta    shardMeta
+	current []Sequence
+
+	outputs *os.File
+	targets *os.File
+	outBuf  *bufio.Writer
+	tarBuf  *bufio.Writer
+}
+
+// NewShardWriter creates a ShardWriter that writes to a
+// directory, creating the directory if necessary.
+//
+// The numFeatures argument is the size of the feature
+// bitmap stored for every timestep. It should leave room
+// for any features that a model will add.
+//
+// The chunkSize argument is the number of sequences to
+// store in each chunk.
+func NewShardWriter(dir string, numFeatures, chunkSize int) (*ShardWriter, error) {
+	if chunkSize < 1 {
+		panic("chunk size must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create shard writer")
+	}
+	outputs, err := os.Create(filepath.Join(dir, shardOutputsFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "create shard writer")
+	}
+	targets, err := os.Create(filepath.Join(dir, shardTargetsFile))
+	if err != nil {
+		outputs.Close()
+		return nil, errors.Wrap(err, "create shard writer")
+	}
+	return &ShardWriter{
+		dir:         dir,
+		numFeatures: numFeatures,
+		chunkSize:   chunkSize,
+		meta:        shardMeta{NumFeatures: numFeatures, OutputSize: -1, TargetSize: -1},
+		outputs:     outputs,
+		targets:     targets,
+		outBuf:      bufio.NewWriter(outputs),
+		tarBuf:      bufio.NewWriter(targets),
+	}, nil
+}
+
+// Write adds a sequence to the store.
+//
+// All timesteps of all sequences must have the same
+// output and target sizes.
+func (s *ShardWriter) Write(seq Sequence) error {
+	for _, ts := range seq {
+		if s.meta.OutputSize == -1 {
+			s.meta.OutputSize = len(ts.Output)
+			s.meta.TargetSize = len(ts.Target)
+		} else if len(ts.Output) != s.meta.OutputSize || len(ts.Target) != s.meta.TargetSize {
+			return errors.New("write shard: inconsistent output or target size")
+		}
+	}
+	s.current = append(s.current, seq)
+	if len(s.current) == s.chunkSize {
+		return s.flushChunk()
+	}
+	return nil
+}
+
+// Close writes any remaining data to disk.
+func (s *ShardWriter) Close() (err error) {
+	defer func() {
+		err1 := s.outputs.Close()
+		err2 := s.targets.Close()
+		if err == nil && err1 != nil {
+			err = errors.Wrap(err1, "close shard writer")
+		} else if err == nil && err2 != nil {
+			err = errors.Wrap(err2, "close shard writer")
+		}
+	}()
+	if len(s.current) > 0 {
+		if err := s.flushChunk(); err != nil {
+			return err
+		}
+	}
+	if err := s.outBuf.Flush(); err != nil {
+		return errors.Wrap(err, "close shard writer")
+	}
+	if err := s.tarBuf.Flush(); err != nil {
+		return errors.Wrap(err, "close shard writer")
+	}
+	if s.meta.OutputSize == -1 {
+		s.meta.OutputSize = 0
+		s.meta.TargetSize = 0
+	}
+	data, err := json.Marshal(&s.meta)
+	if err != nil {
+		return errors.Wrap(err, "close shard writer")
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.dir, shardMetaFile), data, 0644); err != nil {
+		return errors.Wrap(err, "close shard writer")
+	}
+	return nil
+}
+
+func (s *ShardWriter) flushChunk() error {
+	chunk := shardChunk{Sequences: len(s.current)}
+	for _, seq := range s.current {
+		chunk.Timesteps += len(seq)
+	}
+	if n := len(s.meta.Chunks); n > 0 {
+		last := s.meta.Chunks[n-1]
+		chunk.Offset = last.Offset + last.Timesteps
+	}
+	idx := len(s.meta.Chunks)
+	if err := writeShardChunk(s.dir, idx, s.numFeatures, s.current); err != nil {
+		return errors.Wrap(err, "write shard")
+	}
+	for _, seq := range s.current {
+		for _, ts := range seq {
+			if _, err := s.outBuf.Write(float32Bytes(ts.Output)); err != nil {
+				return errors.Wrap(err, "write shard")
+			}
+			if _, err := s.tarBuf.Write(float32Bytes(ts.Target)); err != nil {
+				return errors.Wrap(err, "write shard")
+			}
+		}
+	}
+	s.meta.Chunks = append(s.meta.Chunks, chunk)
+	s.current = nil
+	return nil
+}
+
+// A ShardStore is a SequenceSource which is backed by a
+// directory on disk.
+//
+// Sequence features are stored in chunk files, which are
+// loaded into memory one at a time. Outputs and targets
+// are stored in memory-mapped arrays, so that changes to
+// timestep outputs are written directly to disk.
+// Targets are mapped read-only, and must not be modified.
+type ShardStore struct {
+	// Prefetch is the number of chunks to load in the
+	// background while the current chunk is being used.
+	Prefetch int
+
+	dir  string
+	meta shardMeta
+
+	outputFile *os.File
+	targetFile *os.File
+	outputData []byte
+	targetData []byte
+	outputs    []float32
+	targets    []float32
+}
+
+// OpenShardStore opens a store created by a ShardWriter.
+func OpenShardStore(dir string) (*ShardStore, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, shardMetaFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "open shard store")
+	}
+	s := &ShardStore{Prefetch: 1, dir: dir}
+	if err := json.Unmarshal(data, &s.meta); err != nil {
+		return nil, errors.Wrap(err, "open shard store")
+	}
+	var numTimesteps int
+	if n := len(s.meta.Chunks); n > 0 {
+		numTimesteps = s.meta.Chunks[n-1].Offset + s.meta.Chunks[n-1].Timesteps
+	}
+
+	s.outputFile, s.outputData, err = openMappedFile(filepath.Join(dir, shardOutputsFile),
+		numTimesteps*s.meta.OutputSize*4, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "open shard store")
+	}
+	s.targetFile, s.targetData, err = openMappedFile(filepath.Join(dir, shardTargetsFile),
+		numTimesteps*s.meta.TargetSize*4, false)
+	if err != nil {
+		unmapFile(s.outputFile, s.outputData, true)
+		s.outputFile.Close()
+		return nil, errors.Wrap(err, "open shard store")
+	}
+	s.outputs = bytesFloat32(s.outputData)
+	s.targets = bytesFloat32(s.targetData)
+	return s, nil
+}
+
+// NumChunks gets the number of chunks in the store.
+func (s *ShardStore) NumChunks() int {
+	return len(s.meta.Chunks)
+}
+
+// NumFeatures gets the size of the stored feature maps.
+func (s *ShardStore) NumFeatures() int {
+	return s.meta.NumFeatures
+}
+
+// ReadChunk loads the sequences in a chunk.
+//
+// The outputs of the resulting timesteps point directly
+// into the memory-mapped output array.
+func (s *ShardStore) ReadChunk(idx int) ([]Sequence, error) {
+	chunk := s.meta.Chunks[idx]
+	f, err := os.Open(shardChunkPath(s.dir, idx))
+	if err != nil {
+		return nil, errors.Wrap(err, "read chunk")
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	numBytes := len(NewBitmap(s.meta.NumFeatures).bytes)
+	offset := chunk.Offset
+	res := make([]Sequence, chunk.Sequences)
+	for i := range res {
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return nil, errors.Wrap(err, "read chunk")
+		}
+		seq := make(Sequence, length)
+		for j := range seq {
+			bitmap := &Bitmap{numBits: s.meta.NumFeatures, bytes: make([]uint8, numBytes)}
+			if _, err := io.ReadFull(r, bitmap.bytes); err != nil {
+				return nil, errors.Wrap(err, "read chunk")
+			}
+			outSize, tarSize := s.meta.OutputSize, s.meta.TargetSize
+			seq[j] = &Timestep{
+				Features: bitmap,
+				Output:   s.outputs[offset*outSize : (offset+1)*outSize : (offset+1)*outSize],
+				Target:   s.targets[offset*tarSize : (offset+1)*tarSize : (offset+1)*tarSize],
+			}
+			offset++
+		}
+		res[i] = seq
+	}
+	return res, nil
+}
+
+// WriteChunk saves the features of a chunk's sequences
+// back to disk.
+func (s *ShardStore) WriteChunk(idx int, seqs []Sequence) error {
+	if err := writeShardChunk(s.dir, idx, s.meta.NumFeatures, seqs); err != nil {
+		return errors.Wrap(err, "write chunk")
+	}
+	return nil
+}
+
+// IterateChunks calls f for every chunk, loading up to
+// s.Prefetch chunks in the background.
+//
+// Changes to outputs are always persisted, since the
+// outputs are memory-mapped.
+func (s *ShardStore) IterateChunks(modify bool, f func(chunk []Sequence)) error {
+	type loadResult struct {
+		Seqs []Sequence
+		Err  error
+	}
+	results := make(chan loadResult, s.Prefetch)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(results)
+		for i := 0; i < s.NumChunks(); i++ {
+			seqs, err := s.ReadChunk(i)
+			select {
+			case results <- loadResult{Seqs: seqs, Err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var idx int
+	for result := range results {
+		if result.Err != nil {
+			return result.Err
+		}
+		f(result.Seqs)
+		if modify {
+			if err := s.WriteChunk(idx, result.Seqs); err != nil {
+				return err
+			}
+		}
+		idx++
+	}
+	return nil
+}
+
+// ResetOutputs sets all of the stored outputs to zero.
+func (s *ShardStore) ResetOutputs() {
+	for i := range s.outputs {
+		s.outputs[i] = 0
+	}
+}
+
+// Close unmaps the output and target arrays.
+//
+// Sequences loaded from the store must not be used after
+// the store is closed.
+func (s *ShardStore) Close() error {
+	var firstErr error
+	for _, err := range []error{
+		unmapFile(s.outputFile, s.outputData, true),
+		unmapFile(s.targetFile, s.targetData, false),
+		s.outputFile.Close(),
+		s.targetFile.Close(),
+	} {
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrap(err, "close shard store")
+		}
+	}
+	s.outputs, s.targets = nil, nil
+	s.outputData, s.targetData = nil, nil
+	return firstErr
+}
+
+func shardChunkPath(dir string, idx int) string {
+	return filepath.Join(dir, fmt.Sprintf("chunk-%06d.bin", idx))
+}
+
+func writeShardChunk(dir string, idx, numFeatures int, seqs []Sequence) error {
+	f, err := os.Create(shardChunkPath(dir, idx))
+	if err != nil {
+		return err
+	}
+	err = writeShardFeatures(f, numFeatures, seqs)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeShardFeatures(f io.Writer, numFeatures int, seqs []Sequence) error {
+	w := bufio.NewWriter(f)
+	var bitmap *Bitmap
+	for _, seq := range seqs {
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(seq))); err != nil {
+			return err
+		}
+		for _, ts := range seq {
+			if b, ok := ts.Features.(*Bitmap); ok && b.numBits == numFeatures {
+				bitmap = b
+			} else {
+				bitmap = NewBitmap(numFeatures)
+				for i := 0; i < ts.Features.Len(); i++ {
+					if !ts.Features.Get(i) {
+						continue
+					}
+					if i >= numFeatures {
+						return fmt.Errorf("feature %d exceeds shard size %d", i, numFeatures)
+					}
+					bitmap.Set(i, true)
+				}
+			}
+			if _, err := w.Write(bitmap.bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func openMappedFile(path string, size int, writable bool) (*os.File, []byte, error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.Size() != int64(size) {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: expected %d bytes but got %d", path, size, info.Size())
+	}
+	data, err := mapFile(f, size, writable)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, data, nil
+}
+
+func float32Bytes(v []float32) []byte {
+	if len(v) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&v[0])), len(v)*4)
+}
+
+func bytesFloat32(b []byte) []float32 {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*float32)(unsafe.Pointer(&b[0])), len(b)/4)
+}
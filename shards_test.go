@@ -0,0 +1,212 @@
+package seqtree
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestShardStoreRoundTrip(t *testing.T) {
+	m := generateTestModel(5)
+	seqs := generateTestSequences(m)
+	store, cleanup := createTestShardStore(t, m, seqs, 4)
+	defer cleanup()
+
+	if store.NumChunks() != 4 {
+		t.Fatalf("expected 4 chunks but got %d", store.NumChunks())
+	}
+
+	var idx int
+	err := store.IterateChunks(false, func(chunk []Sequence) {
+		for _, seq := range chunk {
+			expected := seqs[idx]
+			idx++
+			if len(seq) != len(expected) {
+				t.Fatalf("expected length %d but got %d", len(expected), len(seq))
+			}
+			for i, ts := range seq {
+				exp := expected[i]
+				if !reflect.DeepEqual(ts.Output, exp.Output) ||
+					!reflect.DeepEqual(ts.Target, exp.Target) {
+					t.Fatalf("mismatched outputs or targets at sequence %d", idx-1)
+				}
+				for j := 0; j < exp.Features.Len(); j++ {
+					if ts.Features.Get(j) != exp.Features.Get(j) {
+						t.Fatalf("mismatched feature %d at sequence %d", j, idx-1)
+					}
+				}
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != len(seqs) {
+		t.Errorf("expected %d sequences but got %d", len(seqs), idx)
+	}
+}
+
+func TestShardWriterFeatureRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seqtree-shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := NewShardWriter(dir, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	features := NewBitmap(8)
+	features.Set(5, true)
+	seq := Sequence{{Features: features, Output: []float32{0}, Target: []float32{1}}}
+	if err := w.Write(seq); err == nil {
+		t.Error("expected error for out-of-range feature")
+	}
+	w.Close()
+}
+
+func TestShardStoreEvaluate(t *testing.T) {
+	m := generateTestModel(5)
+	seqs := generateTestSequences(&Model{BaseFeatures: 5})
+	store, cleanup := createTestShardStore(t, m, seqs, 4)
+	defer cleanup()
+
+	m.EvaluateAll(seqs)
+	if err := m.EvaluateSource(store); err != nil {
+		t.Fatal(err)
+	}
+
+	var idx int
+	err := store.IterateChunks(false, func(chunk []Sequence) {
+		for _, seq := range chunk {
+			for i, ts := range seq {
+				expected := seqs[idx][i].Output
+				for j, x := range expected {
+					if math.Abs(float64(x-ts.Output[j])) > 1e-5 {
+						t.Fatalf("expected output %v but got %v", expected, ts.Output)
+					}
+				}
+			}
+			idx++
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildSource(t *testing.T) {
+	for _, maxUnion := range []int{1, 3} {
+		m := generateTestModel(5)
+		seqs := generateTestSequences(m)
+		store, cleanup := createTestShardStore(t, m, seqs, 4)
+
+		b := &Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			Depth:           3,
+			MinSplitSamples: 10,
+			MaxUnion:        maxUnion,
+			Horizons:        []int{0, 1, 2},
+		}
+		samples := TimestepSamples(seqs)
+		expected := b.Build(samples)
+		actual, err := b.BuildSource(store)
+		cleanup()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedLoss := AvgLossDelta(samples, expected, Softmax{}, 1)
+		actualLoss := AvgLossDelta(samples, actual, Softmax{}, 1)
+		if math.Abs(float64(expectedLoss-actualLoss)) > 1e-4 {
+			t.Errorf("union %d: expected loss delta %f but got %f", maxUnion, expectedLoss,
+				actualLoss)
+		}
+	}
+}
+
+func TestOptimalStepSource(t *testing.T) {
+	m := generateTestModel(5)
+	seqs := generateTestSequences(m)
+	store, cleanup := createTestShardStore(t, m, seqs, 4)
+	defer cleanup()
+
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           3,
+		MinSplitSamples: 10,
+		Horizons:        []int{0, 1, 2},
+	}
+	samples := TimestepSamples(seqs)
+	tree := b.Build(samples)
+
+	expected := OptimalStep(samples, tree, Softmax{}, 40.0, 50)
+	actual, err := OptimalStepSource(store, tree, Softmax{}, 40.0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLoss := AvgLossDelta(samples, tree, Softmax{}, expected)
+	actualLoss := AvgLossDelta(samples, tree, Softmax{}, actual)
+	if math.Abs(float64(expectedLoss-actualLoss)) > 1e-4 {
+		t.Errorf("expected step %f (loss=%f) but got %f (loss=%f)", expected, expectedLoss,
+			actual, actualLoss)
+	}
+}
+
+func TestPruneSource(t *testing.T) {
+	m := generateTestModel(5)
+	seqs := generateTestSequences(m)
+	store, cleanup := createTestShardStore(t, m, seqs, 4)
+	defer cleanup()
+
+	b := &Builder{
+		Heuristic:       GradientHeuristic{Loss: Softmax{}},
+		Depth:           4,
+		MinSplitSamples: 5,
+		Horizons:        []int{0, 1, 2},
+	}
+	samples := TimestepSamples(seqs)
+	tree := b.Build(samples)
+	p := &Pruner{Heuristic: b.Heuristic, MaxLeaves: 4}
+
+	expected := p.Prune(samples, tree)
+	actual, err := p.PruneSource(store, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLoss := AvgLossDelta(samples, expected, Softmax{}, 1)
+	actualLoss := AvgLossDelta(samples, actual, Softmax{}, 1)
+	if math.Abs(float64(expectedLoss-actualLoss)) > 1e-4 {
+		t.Errorf("expected loss delta %f but got %f", expectedLoss, actualLoss)
+	}
+}
+
+func createTestShardStore(t *testing.T, m *Model, seqs []Sequence,
+	chunkSize int) (*ShardStore, func()) {
+	dir, err := ioutil.TempDir("", "seqtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewShardWriter(dir, m.NumFeatures(), chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range seqs {
+		if err := w.Write(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenShardStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -6,20 +6,28 @@ import (
 	"image/png"
 	"log"
 	"os"
+	"time"
 
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/mnist"
+	"github.com/unixpickle/seqtree"
 )
 
 const Batch = 1000000
 
 func main() {
-	data := DatasetBoolImgs(mnist.LoadTrainingDataSet())
-	testData := DatasetBoolImgs(mnist.LoadTestingDataSet())
+	data := DatasetGrayImgs(mnist.LoadTrainingDataSet())
+	testData := DatasetGrayImgs(mnist.LoadTestingDataSet())
 
 	seqModel := NewSequenceModel()
 	seqModel.Model.Load("model.json")
+
+	metrics, err := seqtree.OpenMetricsFile("metrics.jsonl")
+	essentials.Must(err)
+	defer metrics.Close()
+
 	for i := 0; true; i++ {
+		start := time.Now()
 		testSeqs := seqModel.Timesteps(testData, Batch)
 		testLoss := seqModel.MeanLoss(testSeqs)
 
@@ -27,8 +35,16 @@ func main() {
 		validSeqs := seqModel.Timesteps(data, Batch)
 		loss, delta := seqModel.AddTree(trainSeqs, validSeqs)
 
-		log.Printf("tree %d: loss=%f delta=%f test=%f", len(seqModel.Model.Trees)-1, loss, -delta,
-			testLoss)
+		log.Printf("tree %d: loss=%f bits/dim=%f delta=%f test=%f test_bits/dim=%f",
+			len(seqModel.Model.Trees)-1, loss, seqModel.Loss.BitsPerDim(loss), -delta,
+			testLoss, seqModel.Loss.BitsPerDim(testLoss))
+		essentials.Must(metrics.WriteMetrics(&seqtree.IterationMetrics{
+			Iteration: len(seqModel.Model.Trees) - 1,
+			TrainLoss: loss,
+			LossDelta: delta,
+			ValidLoss: &testLoss,
+			Seconds:   time.Since(start).Seconds(),
+		}))
 		seqModel.Model.Save("model.json")
 		GenerateSamples(seqModel)
 	}
@@ -41,11 +57,9 @@ func GenerateSamples(s *SequenceModel) {
 			pixels := s.Sample()
 			for i := 0; i < ImageSize; i++ {
 				for j := 0; j < ImageSize; j++ {
-					pixel := 0
-					if pixels[i*ImageSize+j] {
-						pixel = 255
-					}
-					img.SetGray(row*ImageSize+j, col*ImageSize+i, color.Gray{Y: uint8(pixel)})
+					pixel := pixels[i*ImageSize+j]
+					img.SetGray(row*ImageSize+j, col*ImageSize+i,
+						color.Gray{Y: uint8(pixel*255 + 0.5)})
 				}
 			}
 		}
@@ -56,10 +70,10 @@ func GenerateSamples(s *SequenceModel) {
 	essentials.Must(png.Encode(w, img))
 }
 
-func DatasetBoolImgs(ds mnist.DataSet) []BoolImg {
-	res := make([]BoolImg, len(ds.Samples))
+func DatasetGrayImgs(ds mnist.DataSet) []GrayImg {
+	res := make([]GrayImg, len(ds.Samples))
 	for i, s := range ds.Samples {
-		res[i] = NewBoolImgSample(s)
+		res[i] = NewGrayImgSample(s)
 	}
 	return res
 }
@@ -8,15 +8,17 @@ import (
 
 type SequenceModel struct {
 	Model *seqtree.Model
+	Loss  *seqtree.LogisticMixture
 }
 
 func NewSequenceModel() *SequenceModel {
 	return &SequenceModel{
-		Model: &seqtree.Model{BaseFeatures: SequenceLength + ImageSize*2},
+		Model: &seqtree.Model{BaseFeatures: SequenceLength*IntensityBits + ImageSize*2},
+		Loss:  &seqtree.LogisticMixture{NumComponents: NumComponents},
 	}
 }
 
-func (s *SequenceModel) Timesteps(samples []BoolImg, n int) []*seqtree.Timestep {
+func (s *SequenceModel) Timesteps(samples []GrayImg, n int) []*seqtree.Timestep {
 	res := make([]*seqtree.Timestep, n)
 	for i := 0; i < n; i++ {
 		img := samples[rand.Intn(len(samples))]
@@ -25,14 +27,14 @@ func (s *SequenceModel) Timesteps(samples []BoolImg, n int) []*seqtree.Timestep
 	return res
 }
 
-func (s *SequenceModel) Sample() []bool {
-	sample := NewBoolImg()
+func (s *SequenceModel) Sample() GrayImg {
+	sample := NewGrayImg()
 	for y := 0; y < ImageSize; y++ {
 		for x := 0; x < ImageSize; x++ {
 			ts := sampleTimestep(sample, x, y)
 			seq := seqtree.Sequence{ts}
 			s.Model.Evaluate(seq)
-			sample.Set(x, y, seqtree.Sigmoid{}.Sample(ts.Output)[0])
+			sample.Set(x, y, s.Loss.Sample(ts.Output)[0])
 		}
 	}
 	return sample
@@ -57,13 +59,11 @@ func (s *SequenceModel) AddTree(samples, validation []*seqtree.Timestep) (loss,
 	s.Model.EvaluateAll(validationSeqs)
 
 	for _, seq := range seqs {
-		loss += seq.MeanLoss(seqtree.Sigmoid{})
+		loss += seq.MeanLoss(s.Loss)
 	}
 
 	builder := seqtree.Builder{
-		Heuristic: seqtree.PolynomialHeuristic{
-			Loss: seqtree.Sigmoid{},
-		},
+		Heuristic:       seqtree.GradientHeuristic{Loss: s.Loss},
 		Depth:           5,
 		MinSplitSamples: 100,
 		Horizons:        []int{0},
@@ -75,9 +75,8 @@ func (s *SequenceModel) AddTree(samples, validation []*seqtree.Timestep) (loss,
 	}
 	tree := builder.Build(seqtree.TimestepSamples(seqs))
 	tree = pruner.Prune(seqtree.TimestepSamples(seqs), tree)
-	seqtree.ScaleOptimalStep(seqtree.TimestepSamples(seqs), tree, seqtree.Sigmoid{},
-		40.0, 10, 30)
-	delta += seqtree.AvgLossDelta(seqtree.TimestepSamples(validationSeqs), tree, seqtree.Sigmoid{},
+	seqtree.ScaleOptimalStep(seqtree.TimestepSamples(seqs), tree, s.Loss, 40.0, 10, 30)
+	delta += seqtree.AvgLossDelta(seqtree.TimestepSamples(validationSeqs), tree, s.Loss,
 		shrinkage)
 	s.Model.Add(tree, shrinkage)
 
@@ -94,19 +93,15 @@ func (s *SequenceModel) MeanLoss(samples []*seqtree.Timestep) float32 {
 
 	var loss float32
 	for _, seq := range seqs {
-		loss += seq.MeanLoss(seqtree.Sigmoid{})
+		loss += seq.MeanLoss(s.Loss)
 	}
 	return loss / float32(len(samples))
 }
 
-func sampleTimestep(img BoolImg, x, y int) *seqtree.Timestep {
-	ts := &seqtree.Timestep{
+func sampleTimestep(img GrayImg, x, y int) *seqtree.Timestep {
+	return &seqtree.Timestep{
 		Features: &FeatureMap{Img: img, X: x, Y: y},
-		Output:   make([]float32, 1),
-		Target:   make([]float32, 1),
+		Output:   make([]float32, NumComponents*3),
+		Target:   []float32{img.At(x, y)},
 	}
-	if img.At(x, y) {
-		ts.Target[0] = 1
-	}
-	return ts
 }
@@ -6,25 +6,35 @@ const (
 	ImageSize      = 28
 	WindowSize     = 10
 	SequenceLength = (WindowSize*2 + 2) * WindowSize
+
+	// Pixels are modeled as a mixture of logistics, and
+	// the intensities in the window are given as a set of
+	// thresholded features per pixel.
+	NumComponents = 5
+	IntensityBits = 4
 )
 
 type FeatureMap struct {
-	Img BoolImg
+	Img GrayImg
 	X   int
 	Y   int
 }
 
 func (f *FeatureMap) Len() int {
-	return SequenceLength + ImageSize*2
+	return SequenceLength*IntensityBits + ImageSize*2
 }
 
 func (f *FeatureMap) Get(i int) bool {
-	if i < SequenceLength {
-		return f.Img.GetWindow(f.X, f.Y, i)
-	} else if i < SequenceLength+ImageSize {
-		return f.X == i-SequenceLength
+	if i < SequenceLength*IntensityBits {
+		intensity := f.Img.GetWindow(f.X, f.Y, i/IntensityBits)
+		threshold := float32(i%IntensityBits+1) / (IntensityBits + 1)
+		return intensity > threshold
+	}
+	i -= SequenceLength * IntensityBits
+	if i < ImageSize {
+		return f.X == i
 	} else {
-		return f.Y == i-(SequenceLength+ImageSize)
+		return f.Y == i-ImageSize
 	}
 }
 
@@ -32,33 +42,33 @@ func (f *FeatureMap) Set(i int, b bool) {
 	panic("feature map is immutable")
 }
 
-type BoolImg []bool
+type GrayImg []float32
 
-func NewBoolImg() BoolImg {
-	return make(BoolImg, ImageSize*ImageSize)
+func NewGrayImg() GrayImg {
+	return make(GrayImg, ImageSize*ImageSize)
 }
 
-func NewBoolImgSample(sample mnist.Sample) BoolImg {
-	res := NewBoolImg()
+func NewGrayImgSample(sample mnist.Sample) GrayImg {
+	res := NewGrayImg()
 	for i, x := range sample.Intensities {
-		res[i] = x >= 0.5
+		res[i] = float32(x)
 	}
 	return res
 }
 
-func (b BoolImg) At(x, y int) bool {
+func (g GrayImg) At(x, y int) float32 {
 	if x < 0 || x >= ImageSize || y < 0 || y >= ImageSize {
-		return false
+		return 0
 	}
-	return b[x+y*ImageSize]
+	return g[x+y*ImageSize]
 }
 
-func (b BoolImg) Set(x, y int, v bool) {
-	b[x+y*ImageSize] = v
+func (g GrayImg) Set(x, y int, v float32) {
+	g[x+y*ImageSize] = v
 }
 
-func (b BoolImg) GetWindow(x, y int, idx int) bool {
+func (g GrayImg) GetWindow(x, y int, idx int) float32 {
 	rowIdx := idx / (WindowSize*2 + 1)
 	colIdx := idx % (WindowSize*2 + 1)
-	return b.At(x-WindowSize+colIdx, y-WindowSize+rowIdx)
+	return g.At(x-WindowSize+colIdx, y-WindowSize+rowIdx)
 }
@@ -0,0 +1,215 @@
+package seqtree
+
+import (
+	"math"
+
+	"github.com/gonum/blas"
+	"github.com/gonum/blas/blas64"
+)
+
+// SolverDiagnostics describes how a HessianSolver solved a
+// linear system.
+type SolverDiagnostics struct {
+	// Method is the name of the method which produced the
+	// solution, e.g. "cg" or "cholesky".
+	Method string
+
+	// Iterations is the number of iterations used by an
+	// iterative method.
+	Iterations int
+
+	// Residual is the norm of Hx-b for the solution.
+	Residual float32
+
+	// Converged is false if an iterative method stopped
+	// before reaching its tolerance.
+	Converged bool
+
+	// Fallback is true if a direct method failed and a
+	// fallback solver was used instead.
+	Fallback bool
+}
+
+// A HessianSolver solves linear systems Hx = b, where H is
+// a symmetric (typically positive definite) Hessian.
+type HessianSolver interface {
+	Solve(h *Hessian, b []float32) []float32
+}
+
+// CGSolver is a HessianSolver that uses the conjugate
+// gradient method.
+type CGSolver struct {
+	// MaxIters is the maximum number of iterations.
+	// If 0, 2*Dim iterations are used.
+	MaxIters int
+
+	// Tolerance is the residual norm at which to stop,
+	// relative to the norm of b.
+	// If 0, 1e-5 is used.
+	Tolerance float32
+
+	// Diagnostics, if non-nil, is called after every
+	// solve.
+	Diagnostics func(d SolverDiagnostics)
+}
+
+// Solve solves the equation Hx=b for x.
+func (c CGSolver) Solve(h *Hessian, b []float32) []float32 {
+	// See https://en.wikipedia.org/wiki/Conjugate_gradient_method.
+
+	tolerance := c.Tolerance
+	if tolerance == 0 {
+		tolerance = 1e-5
+	}
+	maxIters := c.MaxIters
+	if maxIters == 0 {
+		maxIters = h.Dim * 2
+	}
+	earlyStopError := math.Sqrt(float64(vectorNormSquared(b))) * float64(tolerance)
+
+	x := make([]float32, len(b))
+	r := vectorDifference(b, h.Apply(x))
+	p := r
+
+	// Hard-limit the number of iterations to avoid bad
+	// computation times for poorly conditioned problems.
+	var iters int
+	converged := false
+	for iters = 0; iters < maxIters; iters++ {
+		rMag := vectorNormSquared(r)
+		if math.Sqrt(float64(rMag)) <= earlyStopError {
+			converged = true
+			break
+		}
+
+		hp := h.Apply(p)
+		a := rMag / vectorDot(p, hp)
+		nextX := addDelta(x, p, a)
+
+		// Use explicit update for r to avoid compounding
+		// error over many updates.
+		nextR := vectorDifference(b, h.Apply(nextX))
+		nextRMag := vectorNormSquared(nextR)
+
+		beta := nextRMag / rMag
+		nextP := addDelta(nextR, p, beta)
+		x, r, p = nextX, nextR, nextP
+	}
+
+	residual := float32(math.Sqrt(float64(vectorNormSquared(r))))
+	if !converged && float64(residual) <= earlyStopError {
+		converged = true
+	}
+	if c.Diagnostics != nil {
+		c.Diagnostics(SolverDiagnostics{
+			Method:     "cg",
+			Iterations: iters,
+			Residual:   residual,
+			Converged:  converged,
+		})
+	}
+	return x
+}
+
+// CholeskySolver is a HessianSolver that factorizes the
+// Hessian as LL^T in 64-bit precision and solves the
+// system directly.
+//
+// This is exact (up to rounding) for positive definite
+// Hessians, regardless of conditioning, but it takes
+// O(Dim^3) time.
+type CholeskySolver struct {
+	// Fallback is used when the Hessian is not positive
+	// definite. If nil, CGSolver{} is used.
+	Fallback HessianSolver
+
+	// Diagnostics, if non-nil, is called after every
+	// solve.
+	//
+	// When the fallback is used, Converged indicates if
+	// the residual is within the default CG tolerance.
+	Diagnostics func(d SolverDiagnostics)
+}
+
+// Solve solves the equation Hx=b for x.
+func (c CholeskySolver) Solve(h *Hessian, b []float32) []float32 {
+	lower, ok := choleskyFactor(h)
+	if !ok {
+		fallback := c.Fallback
+		if fallback == nil {
+			fallback = CGSolver{}
+		}
+		res := fallback.Solve(h, b)
+		if c.Diagnostics != nil {
+			residual := hessianResidual(h, res, b)
+			c.Diagnostics(SolverDiagnostics{
+				Method:    "fallback",
+				Residual:  residual,
+				Converged: residual <= 1e-5*float32(math.Sqrt(float64(vectorNormSquared(b)))),
+				Fallback:  true,
+			})
+		}
+		return res
+	}
+
+	x := make([]float64, len(b))
+	for i, y := range b {
+		x[i] = float64(y)
+	}
+	vec := blas64.Vector{Inc: 1, Data: x}
+	blas64.Trsv(blas.NoTrans, lower, vec)
+	blas64.Trsv(blas.Trans, lower, vec)
+
+	res := make([]float32, len(x))
+	for i, y := range x {
+		res[i] = float32(y)
+	}
+	if c.Diagnostics != nil {
+		c.Diagnostics(SolverDiagnostics{
+			Method:    "cholesky",
+			Residual:  hessianResidual(h, res, b),
+			Converged: true,
+		})
+	}
+	return res
+}
+
+// choleskyFactor computes the lower-triangular Cholesky
+// factor of h, or returns false if h is not positive
+// definite.
+func choleskyFactor(h *Hessian) (blas64.Triangular, bool) {
+	n := h.Dim
+	data := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i; j++ {
+			// Average both triangles in case of slight
+			// asymmetry from floating point sums.
+			data[j+i*n] = (float64(h.Data[j+i*n]) + float64(h.Data[i+j*n])) / 2
+		}
+	}
+	for j := 0; j < n; j++ {
+		row := blas64.Vector{Inc: 1, Data: data[j*n : j*n+j]}
+		diag := data[j+j*n] - blas64.Dot(j, row, row)
+		if diag <= 0 || math.IsNaN(diag) {
+			return blas64.Triangular{}, false
+		}
+		diag = math.Sqrt(diag)
+		data[j+j*n] = diag
+		for i := j + 1; i < n; i++ {
+			other := blas64.Vector{Inc: 1, Data: data[i*n : i*n+j]}
+			data[j+i*n] = (data[j+i*n] - blas64.Dot(j, row, other)) / diag
+		}
+	}
+	return blas64.Triangular{
+		N:      n,
+		Stride: n,
+		Data:   data,
+		Uplo:   blas.Lower,
+		Diag:   blas.NonUnit,
+	}, true
+}
+
+func hessianResidual(h *Hessian, x, b []float32) float32 {
+	r := vectorDifference(h.Apply(x), b)
+	return float32(math.Sqrt(float64(vectorNormSquared(r))))
+}
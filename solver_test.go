@@ -0,0 +1,121 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestCholeskySolver(t *testing.T) {
+	const dim = 16
+	hess := &Hessian{Dim: dim, Data: make([]float32, dim*dim)}
+	vecs := make([][]float32, dim)
+	for i := range vecs {
+		vecs[i] = make([]float32, dim*2)
+		for j := range vecs[i] {
+			vecs[i][j] = float32(rand.NormFloat64())
+		}
+	}
+	for i := 0; i < dim; i++ {
+		for j := 0; j < dim; j++ {
+			hess.Data[i+j*dim] = vectorDot(vecs[i], vecs[j])
+		}
+	}
+	b := make([]float32, dim)
+	for i := range b {
+		b[i] = float32(rand.NormFloat64())
+	}
+
+	var diagnostics []SolverDiagnostics
+	solver := CholeskySolver{
+		Diagnostics: func(d SolverDiagnostics) {
+			diagnostics = append(diagnostics, d)
+		},
+	}
+	x := solver.Solve(hess, b)
+	if r := hessianResidual(hess, x, b); r > 1e-4 {
+		t.Errorf("residual error of %f exceeds threshold", r)
+	}
+	if len(diagnostics) != 1 {
+		t.Fatalf("expected 1 diagnostic but got %d", len(diagnostics))
+	}
+	d := diagnostics[0]
+	if d.Method != "cholesky" || d.Fallback || !d.Converged {
+		t.Errorf("unexpected diagnostics: %+v", d)
+	}
+	if math.Abs(float64(d.Residual-hessianResidual(hess, x, b))) > 1e-6 {
+		t.Errorf("unexpected residual: %f", d.Residual)
+	}
+}
+
+func TestCholeskySolverIllConditioned(t *testing.T) {
+	// A damped softmax Hessian with very confident logits
+	// has eigenvalues spanning several orders of magnitude.
+	const dim = 32
+	logits := make([]float32, dim)
+	targets := make([]float32, dim)
+	for i := range logits {
+		logits[i] = float32(i) / 2
+	}
+	targets[0] = 1
+	hess := Softmax{}.LossHessian(logits, targets)
+	for i := 0; i < dim; i++ {
+		hess.Data[i+i*dim] += 1e-4
+	}
+	b := Softmax{}.LossGrad(logits, targets)
+	bNorm := math.Sqrt(float64(vectorNormSquared(b)))
+
+	var cgDiagnostics SolverDiagnostics
+	cg := CGSolver{
+		MaxIters: 3,
+		Diagnostics: func(d SolverDiagnostics) {
+			cgDiagnostics = d
+		},
+	}
+	cg.Solve(hess, b)
+	if cgDiagnostics.Converged || cgDiagnostics.Iterations != 3 {
+		t.Errorf("unexpected CG diagnostics: %+v", cgDiagnostics)
+	}
+
+	x := CholeskySolver{}.Solve(hess, b)
+	if r := hessianResidual(hess, x, b); float64(r) > 1e-3*bNorm {
+		t.Errorf("residual error of %f is too large relative to %f", r, bNorm)
+	}
+}
+
+func TestCholeskySolverFallback(t *testing.T) {
+	hess := &Hessian{Dim: 2, Data: []float32{1, 0, 0, -1}}
+	fallback := &testCountingSolver{}
+	var diagnostics SolverDiagnostics
+	solver := CholeskySolver{
+		Fallback: fallback,
+		Diagnostics: func(d SolverDiagnostics) {
+			diagnostics = d
+		},
+	}
+	x := solver.Solve(hess, []float32{1, 2})
+	if fallback.Count != 1 {
+		t.Errorf("expected fallback to be used once but got %d", fallback.Count)
+	}
+	if x[0] != 1 || x[1] != -2 {
+		t.Errorf("unexpected solution: %v", x)
+	}
+	if !diagnostics.Fallback || !diagnostics.Converged {
+		t.Errorf("unexpected diagnostics: %+v", diagnostics)
+	}
+}
+
+// testCountingSolver solves diagonal systems and counts
+// how many times it has been called.
+type testCountingSolver struct {
+	Count int
+}
+
+func (t *testCountingSolver) Solve(h *Hessian, b []float32) []float32 {
+	t.Count++
+	res := make([]float32, len(b))
+	for i, x := range b {
+		res[i] = x / h.Data[i+i*h.Dim]
+	}
+	return res
+}
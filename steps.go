@@ -7,43 +7,32 @@ import (
 
 // OptimalStep performs a line search to find a step size
 // that minimizes the loss.
+//
+// This runs a fixed number of golden-section iterations
+// between 0 and maxStep. Use OptimalStepSearch for other
+// line searches.
 func OptimalStep(timesteps []*TimestepSample, t *Tree, l LossFunc, maxStep float32,
 	iters int) float32 {
-	outputDeltas := make([][]float32, len(timesteps))
-	for i, ts := range timesteps {
-		outputDeltas[i] = t.Evaluate(ts).OutputDelta
-	}
+	return OptimalStepSearch(timesteps, t, l, &FixedGoldenSection{Max: maxStep, Iters: iters})
+}
 
-	return minimizeUnary(0, maxStep, iters, func(stepSize float32) float32 {
-		var lock sync.Mutex
-		var currentLoss float32
+// OptimalStepSource is like OptimalStep, but it streams
+// the timesteps from a SequenceSource.
+//
+// Every iteration of the line search makes a full pass
+// over the source.
+func OptimalStepSource(src SequenceSource, t *Tree, l LossFunc, maxStep float32,
+	iters int) (float32, error) {
+	return OptimalStepSourceSearch(src, t, l, &FixedGoldenSection{Max: maxStep, Iters: iters})
+}
 
-		var wg sync.WaitGroup
-		numProcs := runtime.GOMAXPROCS(0)
-		for i := 0; i < numProcs; i++ {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				total := newKahanSum(1)
-				tmpAddition := []float32{0.0}
-				tmpOutput := make([]float32, len(timesteps[0].Timestep().Output))
-				for j := i; j < len(outputDeltas); j += numProcs {
-					outputDelta := outputDeltas[j]
-					ts := timesteps[j].Timestep()
-					for i, x := range ts.Output {
-						tmpOutput[i] = x + stepSize*outputDelta[i]
-					}
-					tmpAddition[0] = l.Loss(tmpOutput, ts.Target)
-					total.Add(tmpAddition)
-				}
-				lock.Lock()
-				currentLoss += total.Sum()[0]
-				lock.Unlock()
-			}(i)
-		}
-		wg.Wait()
-		return currentLoss
-	})
+// OptimalStepSourceSearch is like OptimalStepSearch, but
+// it streams the timesteps from a SequenceSource.
+func OptimalStepSourceSearch(src SequenceSource, t *Tree, l LossFunc,
+	search LineSearch) (float32, error) {
+	f := &sourceLineFunc{Source: src, Tree: t, LossFunc: l}
+	step := search.Minimize(f)
+	return step, f.Err
 }
 
 // ScaleOptimalStep scales the leaves of t individually to
@@ -55,48 +44,8 @@ func OptimalStep(timesteps []*TimestepSample, t *Tree, l LossFunc, maxStep float
 // scaled.
 func ScaleOptimalStep(timesteps []*TimestepSample, t *Tree, l LossFunc, maxStep float32,
 	minLeafSamples, iters int) {
-	leafToSample := map[*Leaf][]*Timestep{}
-	for _, ts := range timesteps {
-		leaf := t.Evaluate(ts)
-		leafToSample[leaf] = append(leafToSample[leaf], ts.Timestep())
-	}
-	for leaf, samples := range leafToSample {
-		if len(samples) < minLeafSamples || len(samples) == 0 {
-			continue
-		}
-		scale := minimizeUnary(0, maxStep, iters, func(stepSize float32) float32 {
-			var lock sync.Mutex
-			var currentLoss float32
-
-			var wg sync.WaitGroup
-			numProcs := runtime.GOMAXPROCS(0)
-			for i := 0; i < numProcs; i++ {
-				wg.Add(1)
-				go func(i int) {
-					defer wg.Done()
-					total := newKahanSum(1)
-					tmpAddition := []float32{0.0}
-					tmpOutput := make([]float32, len(samples[0].Output))
-					for j := i; j < len(samples); j += numProcs {
-						sample := samples[j]
-						for k, x := range sample.Output {
-							tmpOutput[k] = x + stepSize*leaf.OutputDelta[k]
-						}
-						tmpAddition[0] = l.Loss(tmpOutput, sample.Target)
-						total.Add(tmpAddition)
-					}
-					lock.Lock()
-					currentLoss += total.Sum()[0]
-					lock.Unlock()
-				}(i)
-			}
-			wg.Wait()
-			return currentLoss
-		})
-		for i, x := range leaf.OutputDelta {
-			leaf.OutputDelta[i] = x * scale
-		}
-	}
+	ScaleOptimalStepSearch(timesteps, t, l, &FixedGoldenSection{Max: maxStep, Iters: iters},
+		minLeafSamples)
 }
 
 // scaleOptimalStepCluster is like ScaleOptimalStep, but
@@ -107,44 +56,50 @@ func ScaleOptimalStep(timesteps []*TimestepSample, t *Tree, l LossFunc, maxStep
 // range, allowing for efficient steps with MultiSoftmax
 // and other block-diagonal loss functions.
 func scaleOptimalStepCluster(data, targets [][]float32, delta []float32, l LossFunc,
-	maxStep float32, iters, startIdx, length int) {
+	search LineSearch, startIdx, length int) {
 	if length == 0 {
 		length = len(delta) - startIdx
 	}
+	f := &stepLineFunc{LossFunc: l}
+	for i, x := range data {
+		f.Outputs = append(f.Outputs, x[startIdx:startIdx+length])
+		f.Targets = append(f.Targets, targets[i][startIdx:startIdx+length])
+		f.Deltas = append(f.Deltas, delta[startIdx:startIdx+length])
+	}
+	scale := search.Minimize(f.lineFunc())
+	for i := startIdx; i < startIdx+length; i++ {
+		delta[i] *= scale
+	}
+}
 
-	scale := minimizeUnary(0, maxStep, iters, func(stepSize float32) float32 {
-		var lock sync.Mutex
-		var currentLoss float32
+// A sourceLineFunc is a LineFunc for the total loss of a
+// SequenceSource after taking a step with a tree.
+//
+// The first error from the source is stored in Err, after
+// which the loss is always 0.
+type sourceLineFunc struct {
+	Source   SequenceSource
+	Tree     *Tree
+	LossFunc LossFunc
+	Err      error
+}
 
-		var wg sync.WaitGroup
-		numProcs := runtime.GOMAXPROCS(0)
-		for i := 0; i < numProcs; i++ {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				total := newKahanSum(1)
-				tmpAddition := []float32{0.0}
-				tmpOutput := make([]float32, length)
-				for j := i; j < len(data); j += numProcs {
-					sample := data[j][startIdx : startIdx+length]
-					target := targets[j][startIdx : startIdx+length]
-					for k, x := range sample {
-						tmpOutput[k] = x + stepSize*delta[k+startIdx]
-					}
-					tmpAddition[0] = l.Loss(tmpOutput, target)
-					total.Add(tmpAddition)
-				}
-				lock.Lock()
-				currentLoss += total.Sum()[0]
-				lock.Unlock()
-			}(i)
+func (s *sourceLineFunc) Loss(step float32) float32 {
+	if s.Err != nil {
+		return 0
+	}
+	var total float64
+	s.Err = s.Source.IterateChunks(false, func(chunk []Sequence) {
+		f := &stepLineFunc{LossFunc: s.LossFunc}
+		for _, ts := range TimestepSamples(chunk) {
+			timestep := ts.Timestep()
+			f.Outputs = append(f.Outputs, timestep.Output)
+			f.Targets = append(f.Targets, timestep.Target)
+			f.Deltas = append(f.Deltas, s.Tree.Evaluate(ts).OutputDelta)
 		}
-		wg.Wait()
-		return currentLoss
+		total += float64(f.Loss(step))
 	})
-	for i := startIdx; i < startIdx+length; i++ {
-		delta[i] *= scale
-	}
+	return float32(total)
 }
 
 // AvgLossDelta computes the average change in the loss
@@ -0,0 +1,404 @@
+package seqtree
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultTrainerMaxStep        = 40.0
+	defaultTrainerMinLeafSamples = 10
+	defaultTrainerStepIters      = 30
+)
+
+// A SampleProvider produces sequences for a Trainer.
+//
+// The provider is given the current model, for example so
+// that it can sample new sequences from the model.
+// The provider is also given the Trainer's RNG, which it
+// should use for any random choices so that resumed runs
+// draw the same sequences as uninterrupted ones.
+//
+// The returned sequences should have room for all of the
+// model's features. They may be returned more than once,
+// since the Trainer resets their outputs and the features
+// added by the model before evaluating them.
+type SampleProvider func(m *Model, gen *rand.Rand) []Sequence
+
+// A ShrinkageSchedule determines the step size for each
+// iteration of training.
+type ShrinkageSchedule func(iteration int) float32
+
+// ConstantShrinkage creates a ShrinkageSchedule which
+// always returns the same step size.
+func ConstantShrinkage(stepSize float32) ShrinkageSchedule {
+	return func(iteration int) float32 {
+		return stepSize
+	}
+}
+
+// IterationMetrics describes a single iteration of a
+// Trainer.
+type IterationMetrics struct {
+	// Iteration is the index of the iteration, starting
+	// at 0.
+	Iteration int
+
+	// TrainLoss is the mean loss per timestep on the
+	// training samples, before the new tree was added.
+	TrainLoss float32
+
+	// LossDelta is the mean change in loss per timestep
+	// caused by the new tree on the step samples.
+	LossDelta float32
+
+	// ValidLoss is the mean loss per timestep on the
+	// validation samples, after the new tree was added.
+	// It is nil if there is no validation provider.
+	ValidLoss *float32 `json:",omitempty"`
+
+	// StepSize is the shrinkage used for the tree.
+	StepSize float32
+
+	// NumLeaves is the number of leaves in the tree.
+	NumLeaves int
+
+	// Seconds is the wall time taken by the iteration,
+	// including validation.
+	Seconds float64
+}
+
+// A Trainer runs a boosting loop, building and adding a
+// tree to a model at every iteration.
+//
+// Every iteration samples a batch for building the tree,
+// and then a fresh batch for pruning the tree and scaling
+// its leaves with ScaleOptimalStep.
+//
+// The Builder's Rand is replaced by the Trainer's RNG for
+// every tree.
+type Trainer struct {
+	Model   *Model
+	Builder *Builder
+	Loss    LossFunc
+
+	// Pruner, if non-nil, is used to prune every tree.
+	//
+	// If it is a ValidationPruner and Validation is set,
+	// it selects subtrees with the validation samples,
+	// after scaling them as the tree would be scaled.
+	Pruner TreePruner
+
+	// Shrinkage is the step size schedule.
+	// If nil, a step size of 1 is used.
+	Shrinkage ShrinkageSchedule
+
+	// Train provides the training sequences.
+	Train SampleProvider
+
+	// Validation, if non-nil, provides validation
+	// sequences for early stopping.
+	Validation SampleProvider
+
+	// Patience is the number of iterations without an
+	// improvement in validation loss before stopping.
+	// When training stops early, the model is rolled back
+	// to the tree count with the best validation loss.
+	// If 0, training never stops early.
+	Patience int
+
+	// MaxStep, MinLeafSamples, and StepIters are passed to
+	// ScaleOptimalStep. If 0, defaults are used.
+	MaxStep        float32
+	MinLeafSamples int
+	StepIters      int
+
+	// LineSearch, if non-nil, is used to scale the leaves
+	// of every tree instead of a golden-section search
+	// with MaxStep and StepIters.
+	LineSearch LineSearch
+
+	// DART, if non-nil, is used to drop trees while
+	// fitting every new tree, using the Trainer's RNG.
+	// The training metrics are computed without the
+	// dropped trees.
+	DART *DART
+
+	// Callback, if non-nil, is called after every
+	// iteration, for example to log or save the model.
+	Callback func(m IterationMetrics)
+
+	// Metrics, if non-nil, receives the metrics from every
+	// iteration.
+	Metrics MetricsSink
+
+	// Checkpointer, if non-nil, is used to save a
+	// checkpoint after every iteration.
+	Checkpointer *Checkpointer
+
+	// ExtraState, if non-nil, is called to produce the
+	// Extra field of every checkpoint.
+	ExtraState func() json.RawMessage
+
+	// RestoreExtraState, if non-nil, is called by Resume()
+	// with the Extra field of the checkpoint.
+	RestoreExtraState func(extra json.RawMessage) error
+
+	// Seed is combined with the iteration number to seed
+	// the Trainer's RNG at the start of every iteration, so
+	// that a resumed run draws the same random numbers as
+	// an uninterrupted one.
+	// If 0, a random seed is chosen by the first call to
+	// Run(), and saved in checkpoints.
+	Seed int64
+
+	iteration int
+	metrics   []IterationMetrics
+	started   bool
+	stopped   bool
+	bestLoss  float32
+	bestTrees int
+	sinceBest int
+
+	// bestWeights is a copy of the model's tree weights
+	// at the best validation loss, since DART may rescale
+	// earlier trees after they are added.
+	bestWeights []float32
+}
+
+// Resume restores the model and the training state from
+// the latest checkpoint, if there is one.
+//
+// It returns false if there was no checkpoint.
+func (t *Trainer) Resume() (bool, error) {
+	ckpt, err := t.Checkpointer.Latest()
+	if err != nil || ckpt == nil {
+		return false, err
+	}
+	*t.Model = *ckpt.Model
+	t.iteration = ckpt.Iteration
+	t.Seed = ckpt.Seed
+	t.metrics = ckpt.Metrics
+	t.started = true
+	t.stopped = ckpt.Stopped
+	t.bestLoss = ckpt.BestLoss
+	t.bestTrees = ckpt.BestTrees
+	t.bestWeights = ckpt.BestWeights
+	t.sinceBest = ckpt.SinceBest
+	if t.Builder.HorizonSelector != nil {
+		t.Builder.HorizonSelector.setUsage(ckpt.HorizonUsage)
+	}
+	if t.RestoreExtraState != nil {
+		if err := t.RestoreExtraState(ckpt.Extra); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Checkpoint creates a snapshot of the current training
+// state.
+func (t *Trainer) Checkpoint() *Checkpoint {
+	ckpt := &Checkpoint{
+		Model:     t.Model,
+		Iteration: t.iteration,
+		Seed:      t.Seed,
+		Metrics:   t.metrics,
+		BestLoss:  t.bestLoss,
+		BestTrees: t.bestTrees,
+		SinceBest: t.sinceBest,
+		Stopped:   t.stopped,
+
+		BestWeights: t.bestWeights,
+	}
+	if t.Builder.HorizonSelector != nil {
+		ckpt.HorizonUsage = t.Builder.HorizonSelector.usageCopy()
+	}
+	if t.ExtraState != nil {
+		ckpt.Extra = t.ExtraState()
+	}
+	return ckpt
+}
+
+// Run trains until a total of iters iterations have been
+// completed, or forever if iters is 0, stopping early if
+// the validation loss stops improving.
+//
+// Iterations completed before a call to Resume() count
+// towards the total.
+//
+// It returns the metrics for every iteration, including
+// iterations from before the run was resumed.
+func (t *Trainer) Run(iters int) ([]IterationMetrics, error) {
+	if !t.started {
+		t.started = true
+		for t.Seed == 0 {
+			t.Seed = rand.Int63()
+		}
+		if t.Validation != nil {
+			t.bestLoss = t.validationLoss(t.iterationRand(-1))
+			t.saveBest()
+		}
+	}
+
+	for !t.stopped && (iters == 0 || t.iteration < iters) {
+		gen := t.iterationRand(t.iteration)
+		start := time.Now()
+		m := t.step(t.iteration, gen)
+		if t.Validation != nil {
+			validLoss := t.validationLoss(gen)
+			m.ValidLoss = &validLoss
+			if validLoss < t.bestLoss {
+				t.bestLoss = validLoss
+				t.saveBest()
+				t.sinceBest = 0
+			} else {
+				t.sinceBest++
+			}
+		}
+		m.Seconds = time.Since(start).Seconds()
+		t.metrics = append(t.metrics, m)
+		t.iteration++
+		if t.Patience > 0 && t.sinceBest >= t.Patience {
+			t.Model.Truncate(t.bestTrees)
+			t.Model.Weights = append([]float32(nil), t.bestWeights...)
+			t.stopped = true
+		}
+
+		// Metrics are written before the checkpoint, so an
+		// interruption may cause an iteration to be logged
+		// twice, but never skipped.
+		if t.Metrics != nil {
+			if err := t.Metrics.WriteMetrics(&m); err != nil {
+				return t.metrics, err
+			}
+		}
+		if t.Checkpointer != nil {
+			if err := t.Checkpointer.Save(t.Checkpoint()); err != nil {
+				return t.metrics, err
+			}
+		}
+		if t.Callback != nil {
+			t.Callback(m)
+		}
+	}
+	return t.metrics, nil
+}
+
+// saveBest records the current model as the one with the
+// best validation loss.
+func (t *Trainer) saveBest() {
+	t.bestTrees = len(t.Model.Trees)
+	t.bestWeights = append([]float32(nil), t.Model.Weights...)
+}
+
+// iterationRand creates the RNG for an iteration.
+func (t *Trainer) iterationRand(iteration int) *rand.Rand {
+	return rand.New(rand.NewSource(t.Seed + int64(iteration+1)*1000003))
+}
+
+func (t *Trainer) step(i int, gen *rand.Rand) IterationMetrics {
+	var dropped []int
+	if t.DART != nil {
+		dart := *t.DART
+		dart.Rand = gen
+		dropped = dart.Drop(t.Model)
+	}
+	samples := t.samples(t.Train, gen, dropped)
+	trainLoss := meanTimestepLoss(samples, t.Loss)
+	builder := *t.Builder
+	builder.Rand = gen
+	tree := builder.Build(samples)
+
+	stepSamples := t.samples(t.Train, gen, dropped)
+	stepSize := float32(1)
+	if t.Shrinkage != nil {
+		stepSize = t.Shrinkage(i)
+	}
+	search := t.LineSearch
+	if search == nil {
+		search = &FixedGoldenSection{Max: t.maxStep(), Iters: t.stepIters()}
+	}
+	scale := func(tree *Tree) {
+		ScaleOptimalStepSearch(stepSamples, tree, t.Loss, search, t.minLeafSamples())
+	}
+	if vp, ok := t.Pruner.(ValidationPruner); ok && t.Validation != nil {
+		valid := t.samples(t.Validation, gen, dropped)
+		tree = vp.PruneValidation(stepSamples, valid, tree, scale, stepSize)
+	} else {
+		if t.Pruner != nil {
+			tree = t.Pruner.Prune(stepSamples, tree)
+		}
+		scale(tree)
+	}
+	delta := AvgLossDelta(stepSamples, tree, t.Loss, stepSize)
+	if t.DART != nil {
+		t.DART.Add(t.Model, tree, dropped, stepSize)
+	} else {
+		t.Model.Add(tree, stepSize)
+	}
+
+	return IterationMetrics{
+		Iteration: i,
+		TrainLoss: trainLoss,
+		LossDelta: delta,
+		StepSize:  stepSize,
+		NumLeaves: len(tree.Leaves()),
+	}
+}
+
+func (t *Trainer) validationLoss(gen *rand.Rand) float32 {
+	return meanTimestepLoss(t.samples(t.Validation, gen, nil), t.Loss)
+}
+
+func (t *Trainer) samples(p SampleProvider, gen *rand.Rand,
+	dropped []int) []*TimestepSample {
+	seqs := p(t.Model, gen)
+	for _, seq := range seqs {
+		for _, ts := range seq {
+			for i := range ts.Output {
+				ts.Output[i] = 0
+			}
+			for i := t.Model.BaseFeatures; i < ts.Features.Len(); i++ {
+				ts.Features.Set(i, false)
+			}
+		}
+	}
+	t.Model.EvaluateAllDropped(seqs, dropped)
+	return TimestepSamples(seqs)
+}
+
+func (t *Trainer) maxStep() float32 {
+	if t.MaxStep == 0 {
+		return defaultTrainerMaxStep
+	}
+	return t.MaxStep
+}
+
+func (t *Trainer) minLeafSamples() int {
+	if t.MinLeafSamples == 0 {
+		return defaultTrainerMinLeafSamples
+	}
+	return t.MinLeafSamples
+}
+
+func (t *Trainer) stepIters() int {
+	if t.StepIters == 0 {
+		return defaultTrainerStepIters
+	}
+	return t.StepIters
+}
+
+// meanTimestepLoss computes the mean loss of the samples.
+func meanTimestepLoss(samples []*TimestepSample, l LossFunc) float32 {
+	if len(samples) == 0 {
+		return 0
+	}
+	total := newKahanSum(1)
+	for _, s := range samples {
+		ts := s.Timestep()
+		total.Add([]float32{l.Loss(ts.Output, ts.Target)})
+	}
+	return total.Sum()[0] / float32(len(samples))
+}
@@ -0,0 +1,259 @@
+package seqtree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestTrainer(t *testing.T) {
+	m := &Model{BaseFeatures: 5}
+	var iterations int
+	trainer := &Trainer{
+		Model: m,
+		Builder: &Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			Depth:           3,
+			MinSplitSamples: 5,
+			Horizons:        []int{0, 1},
+		},
+		Pruner:    &Pruner{Heuristic: GradientHeuristic{Loss: Softmax{}}, MaxLeaves: 4},
+		Loss:      Softmax{},
+		Shrinkage: ConstantShrinkage(0.5),
+		Train: func(m *Model, gen *rand.Rand) []Sequence {
+			return successorTestSequences(gen, m, 30)
+		},
+		Callback: func(m IterationMetrics) {
+			iterations++
+		},
+	}
+	metrics, err := trainer.Run(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 5 || iterations != 5 {
+		t.Fatalf("expected 5 iterations but got %d (%d callbacks)", len(metrics), iterations)
+	}
+	if len(m.Trees) != 5 {
+		t.Errorf("expected 5 trees but got %d", len(m.Trees))
+	}
+	for i, x := range metrics {
+		if x.Iteration != i || x.StepSize != 0.5 || x.NumLeaves > 4 {
+			t.Errorf("unexpected metrics: %+v", x)
+		}
+		if x.LossDelta >= 0 {
+			t.Errorf("iteration %d: expected loss to decrease but got delta %f", i, x.LossDelta)
+		}
+	}
+	if metrics[4].TrainLoss >= metrics[0].TrainLoss {
+		t.Errorf("training loss did not decrease: %f -> %f", metrics[0].TrainLoss,
+			metrics[4].TrainLoss)
+	}
+}
+
+func TestTrainerEarlyStopping(t *testing.T) {
+	m := &Model{BaseFeatures: 5}
+
+	// Validation targets disagree with the training data,
+	// so the validation loss should get worse.
+	validation := successorTestSequences(nil, m, 30)
+	for _, seq := range validation {
+		for _, ts := range seq {
+			target := make([]float32, len(ts.Target))
+			for i, x := range ts.Target {
+				target[(i+1)%len(target)] = x
+			}
+			ts.Target = target
+		}
+	}
+
+	trainer := &Trainer{
+		Model: m,
+		Builder: &Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			Depth:           3,
+			MinSplitSamples: 5,
+			Horizons:        []int{0, 1},
+		},
+		Loss: Softmax{},
+		Train: func(m *Model, gen *rand.Rand) []Sequence {
+			return successorTestSequences(gen, m, 30)
+		},
+		Validation: func(m *Model, gen *rand.Rand) []Sequence {
+			return validation
+		},
+		Patience: 3,
+	}
+	metrics, err := trainer.Run(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) == 50 {
+		t.Fatal("training did not stop early")
+	}
+
+	// Compute the loss before any trees were added.
+	initial := zeroedTestSequences(validation)
+	bestLoss := meanTimestepLoss(TimestepSamples(initial), Softmax{})
+	bestTrees := 0
+	for i, x := range metrics {
+		if *x.ValidLoss < bestLoss {
+			bestLoss = *x.ValidLoss
+			bestTrees = i + 1
+		}
+	}
+	if len(metrics) != bestTrees+trainer.Patience {
+		t.Errorf("expected to stop after %d iterations but got %d", bestTrees+trainer.Patience,
+			len(metrics))
+	}
+	if len(m.Trees) != bestTrees {
+		t.Errorf("expected rollback to %d trees but got %d", bestTrees, len(m.Trees))
+	}
+	if m.ExtraFeatures != 0 {
+		t.Errorf("unexpected extra features: %d", m.ExtraFeatures)
+	}
+}
+
+func TestTrainerEarlyStoppingDART(t *testing.T) {
+	m := &Model{BaseFeatures: 5}
+
+	// The validation targets are shifted once the model
+	// has enough trees, so the validation loss gets worse
+	// while DART keeps rescaling the earlier trees.
+	clean := successorTestSequences(nil, m, 30)
+	shifted := successorTestSequences(nil, m, 30)
+	for _, seq := range shifted {
+		for _, ts := range seq {
+			target := make([]float32, len(ts.Target))
+			for i, x := range ts.Target {
+				target[(i+1)%len(target)] = x
+			}
+			ts.Target = target
+		}
+	}
+	validation := func(m *Model, gen *rand.Rand) []Sequence {
+		if len(m.Trees) <= 4 {
+			return clean
+		}
+		return shifted
+	}
+
+	trainer := &Trainer{
+		Model: m,
+		Builder: &Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			Depth:           3,
+			MinSplitSamples: 5,
+			Horizons:        []int{0, 1},
+		},
+		Loss: Softmax{},
+		Train: func(m *Model, gen *rand.Rand) []Sequence {
+			return successorTestSequences(gen, m, 30)
+		},
+		Validation: validation,
+		Patience:   3,
+		Shrinkage:  ConstantShrinkage(0.5),
+		DART:       &DART{DropRate: 0.5},
+		Seed:       1337,
+	}
+	metrics, err := trainer.Run(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) == 50 {
+		t.Fatal("training did not stop early")
+	}
+
+	bestLoss := float32(math.Inf(1))
+	for _, x := range metrics {
+		bestLoss = float32(math.Min(float64(bestLoss), float64(*x.ValidLoss)))
+	}
+	if m.Weights != nil && len(m.Weights) != len(m.Trees) {
+		t.Fatalf("expected %d weights but got %d", len(m.Trees), len(m.Weights))
+	}
+	seqs := zeroedTestSequences(validation(m, nil))
+	m.EvaluateAll(seqs)
+	actual := meanTimestepLoss(TimestepSamples(seqs), Softmax{})
+	if math.Abs(float64(actual-bestLoss)) > 1e-4 {
+		t.Errorf("rolled back model has loss %f but best loss was %f", actual, bestLoss)
+	}
+}
+
+func TestTrainerValidationPruner(t *testing.T) {
+	m := &Model{BaseFeatures: 5}
+	validation := successorTestSequences(nil, m, 20)
+	pruner := &testValidationPruner{
+		CostComplexityPruner: CostComplexityPruner{
+			Heuristic: GradientHeuristic{Loss: Softmax{}},
+			Loss:      Softmax{},
+		},
+	}
+	trainer := &Trainer{
+		Model: m,
+		Builder: &Builder{
+			Heuristic:       GradientHeuristic{Loss: Softmax{}},
+			Depth:           3,
+			MinSplitSamples: 5,
+			Horizons:        []int{0, 1},
+		},
+		Pruner:    pruner,
+		Loss:      Softmax{},
+		Shrinkage: ConstantShrinkage(0.5),
+		Train: func(m *Model, gen *rand.Rand) []Sequence {
+			return successorTestSequences(gen, m, 30)
+		},
+		Validation: func(m *Model, gen *rand.Rand) []Sequence {
+			return validation
+		},
+	}
+	if _, err := trainer.Run(3); err != nil {
+		t.Fatal(err)
+	}
+	if pruner.calls != 3 {
+		t.Fatalf("expected 3 calls to PruneValidation but got %d", pruner.calls)
+	}
+	if pruner.numValid != len(TimestepSamples(validation)) {
+		t.Errorf("expected %d validation samples but got %d", len(TimestepSamples(validation)),
+			pruner.numValid)
+	}
+	if pruner.stepSize != 0.5 {
+		t.Errorf("expected step size 0.5 but got %f", pruner.stepSize)
+	}
+}
+
+type testValidationPruner struct {
+	CostComplexityPruner
+
+	calls    int
+	numValid int
+	stepSize float32
+}
+
+func (t *testValidationPruner) PruneValidation(train, valid []*TimestepSample, tree *Tree,
+	scale func(t *Tree), stepSize float32) *Tree {
+	if scale == nil {
+		panic("missing scale function")
+	}
+	t.calls++
+	t.numValid = len(valid)
+	t.stepSize = stepSize
+	return t.CostComplexityPruner.PruneValidation(train, valid, tree, scale, stepSize)
+}
+
+// successorTestSequences creates sequences where each
+// token is usually one more than the previous.
+func successorTestSequences(gen *rand.Rand, m *Model, count int) []Sequence {
+	var seqs []Sequence
+	for i := 0; i < count; i++ {
+		seq := []int{randIntn(gen, 5)}
+		for j := 1; j < 20; j++ {
+			if randIntn(gen, 4) == 0 {
+				seq = append(seq, randIntn(gen, 5))
+			} else {
+				seq = append(seq, (seq[j-1]+1)%5)
+			}
+		}
+		seqs = append(seqs, MakeOneHotSequence(seq, 5, m.NumFeatures()))
+	}
+	return seqs
+}